@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Account and routing numbers returned by /auth/get are encrypted with
+// VAULT_KEY and kept per account in the account_numbers collection. API
+// responses carry masked numbers; the full numbers are only returned by the
+// reveal endpoint, which needs the reveal:numbers scope. The verification
+// status of accounts verified with micro-deposits is tracked alongside.
+
+// VAULT_KEY is the base64-encoded 32-byte AES-256 key account numbers are
+// encrypted with. Without it numbers are masked but not stored.
+var VAULT_KEY = ""
+
+var vaultAEAD cipher.AEAD
+
+var errVaultDisabled = errors.New("VAULT_KEY is not set, account numbers are not stored")
+
+// verificationStatusChange is a change of an account's verification_status.
+type verificationStatusChange struct {
+	From   string    `bson:"from,omitempty" json:"from,omitempty"`
+	Status string    `bson:"status" json:"status"`
+	At     time.Time `bson:"at" json:"at"`
+	Source string    `bson:"source" json:"source"`
+}
+
+// accountNumbers are the numbers of one account, as encrypted in the vault.
+type accountNumbers struct {
+	ACH           []plaid.NumbersACH           `json:"ach,omitempty"`
+	EFT           []plaid.NumbersEFT           `json:"eft,omitempty"`
+	International []plaid.NumbersInternational `json:"international,omitempty"`
+	BACS          []plaid.NumbersBACS          `json:"bacs,omitempty"`
+}
+
+type storedAccountNumbers struct {
+	AccountID           string                     `bson:"_id" json:"account_id"`
+	UserID              string                     `bson:"user_id" json:"-"`
+	ItemID              string                     `bson:"item_id" json:"item_id"`
+	Ciphertext          []byte                     `bson:"ciphertext,omitempty" json:"-"`
+	VerificationStatus  string                     `bson:"verification_status,omitempty" json:"verification_status,omitempty"`
+	VerificationHistory []verificationStatusChange `bson:"verification_history" json:"verification_history"`
+	UpdatedAt           time.Time                  `bson:"updated_at" json:"updated_at"`
+}
+
+func initVault() {
+	VAULT_KEY = os.Getenv("VAULT_KEY")
+	if VAULT_KEY == "" {
+		log.Println("Warning: VAULT_KEY is not set, account numbers will not be stored")
+	} else {
+		key, err := base64.StdEncoding.DecodeString(VAULT_KEY)
+		if err != nil || len(key) != 32 {
+			log.Fatalf("Invalid VAULT_KEY: must be 32 bytes, base64-encoded")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			log.Fatalf("Invalid VAULT_KEY: %v", err)
+		}
+		vaultAEAD, err = cipher.NewGCM(block)
+		if err != nil {
+			log.Fatalf("Invalid VAULT_KEY: %v", err)
+		}
+	}
+
+	registerWebhookHandler("AUTH", handleAuthWebhook)
+}
+
+// sealNumbers encrypts plaintext with a random nonce, which is prepended to
+// the ciphertext. The account ID is authenticated with it so that a
+// ciphertext cannot be moved to another account.
+func sealNumbers(accountID string, plaintext []byte) ([]byte, error) {
+	if vaultAEAD == nil {
+		return nil, errVaultDisabled
+	}
+	nonce := make([]byte, vaultAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return vaultAEAD.Seal(nonce, nonce, plaintext, []byte(accountID)), nil
+}
+
+func openNumbers(accountID string, ciphertext []byte) ([]byte, error) {
+	if vaultAEAD == nil {
+		return nil, errVaultDisabled
+	}
+	n := vaultAEAD.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("vaulted account numbers are corrupt")
+	}
+	return vaultAEAD.Open(nil, ciphertext[:n], ciphertext[n:], []byte(accountID))
+}
+
+// maskNumber keeps the last four characters of a number.
+func maskNumber(s string) string {
+	if len(s) <= 4 {
+		return strings.Repeat("*", len(s))
+	}
+	return strings.Repeat("*", len(s)-4) + s[len(s)-4:]
+}
+
+// maskNumbers returns a copy of numbers with account, routing, sort code
+// and IBAN values masked.
+func maskNumbers(numbers plaid.AuthGetNumbers) plaid.AuthGetNumbers {
+	masked := plaid.AuthGetNumbers{
+		Ach:           make([]plaid.NumbersACH, 0, len(numbers.Ach)),
+		Eft:           make([]plaid.NumbersEFT, 0, len(numbers.Eft)),
+		International: make([]plaid.NumbersInternational, 0, len(numbers.International)),
+		Bacs:          make([]plaid.NumbersBACS, 0, len(numbers.Bacs)),
+	}
+	for _, n := range numbers.Ach {
+		m := *plaid.NewNumbersACH(n.AccountId, maskNumber(n.Account), maskNumber(n.Routing), *plaid.NewNullableString(nil))
+		if w, ok := n.GetWireRoutingOk(); ok && w != nil {
+			m.SetWireRouting(maskNumber(*w))
+		}
+		masked.Ach = append(masked.Ach, m)
+	}
+	for _, n := range numbers.Eft {
+		masked.Eft = append(masked.Eft, *plaid.NewNumbersEFT(n.AccountId, maskNumber(n.Account), maskNumber(n.Institution), maskNumber(n.Branch)))
+	}
+	for _, n := range numbers.International {
+		masked.International = append(masked.International, *plaid.NewNumbersInternational(n.AccountId, maskNumber(n.Iban), n.Bic))
+	}
+	for _, n := range numbers.Bacs {
+		masked.Bacs = append(masked.Bacs, *plaid.NewNumbersBACS(n.AccountId, maskNumber(n.Account), maskNumber(n.SortCode)))
+	}
+	return masked
+}
+
+// numbersByAccount groups the numbers of an /auth/get response by account.
+func numbersByAccount(numbers plaid.AuthGetNumbers) map[string]*accountNumbers {
+	byAccount := map[string]*accountNumbers{}
+	get := func(accountID string) *accountNumbers {
+		if byAccount[accountID] == nil {
+			byAccount[accountID] = &accountNumbers{}
+		}
+		return byAccount[accountID]
+	}
+	for _, n := range numbers.Ach {
+		a := get(n.AccountId)
+		a.ACH = append(a.ACH, n)
+	}
+	for _, n := range numbers.Eft {
+		a := get(n.AccountId)
+		a.EFT = append(a.EFT, n)
+	}
+	for _, n := range numbers.International {
+		a := get(n.AccountId)
+		a.International = append(a.International, n)
+	}
+	for _, n := range numbers.Bacs {
+		a := get(n.AccountId)
+		a.BACS = append(a.BACS, n)
+	}
+	return byAccount
+}
+
+// saveAccountNumbers vaults the numbers of the item's accounts and records
+// verification status changes. Without a vault key only the verification
+// status is tracked.
+func saveAccountNumbers(ctx context.Context, it *storedItem, resp *plaid.AuthGetResponse) error {
+	byAccount := numbersByAccount(resp.GetNumbers())
+	for _, a := range resp.GetAccounts() {
+		set := bson.M{"user_id": it.UserID, "item_id": it.ItemID, "updated_at": time.Now().UTC()}
+		if numbers, ok := byAccount[a.AccountId]; ok && vaultAEAD != nil {
+			plaintext, err := json.Marshal(numbers)
+			if err != nil {
+				return err
+			}
+			ciphertext, err := sealNumbers(a.AccountId, plaintext)
+			if err != nil {
+				return err
+			}
+			set["ciphertext"] = ciphertext
+		}
+
+		_, err := collection("account_numbers").UpdateOne(ctx,
+			bson.M{"_id": a.AccountId},
+			bson.M{
+				"$set":         set,
+				"$setOnInsert": bson.M{"verification_history": []verificationStatusChange{}},
+			},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return err
+		}
+
+		if status, ok := a.GetVerificationStatusOk(); ok && status != nil {
+			if _, err := transitionVerificationStatus(ctx, a.AccountId, *status, "auth"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// transitionVerificationStatus records a new verification status of the
+// account. It reports whether the status changed.
+func transitionVerificationStatus(ctx context.Context, accountID, to, source string) (bool, error) {
+	var stored storedAccountNumbers
+	if err := collection("account_numbers").FindOne(ctx, bson.M{"_id": accountID}).Decode(&stored); err != nil {
+		return false, err
+	}
+	if stored.VerificationStatus == to {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	res, err := collection("account_numbers").UpdateOne(ctx,
+		// Matching on the old status makes concurrent updates from a webhook
+		// and /auth/get apply only once.
+		bson.M{"_id": accountID, "verification_status": optionalStatus(stored.VerificationStatus)},
+		bson.M{
+			"$set": bson.M{"verification_status": to, "updated_at": now},
+			"$push": bson.M{"verification_history": verificationStatusChange{
+				From:   stored.VerificationStatus,
+				Status: to,
+				At:     now,
+				Source: source,
+			}},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	if res.ModifiedCount == 0 {
+		return false, nil
+	}
+	log.Printf("Account %s verification status %q -> %q from %s\n", accountID, stored.VerificationStatus, to, source)
+	return true, nil
+}
+
+// optionalStatus matches a status field that may not be set yet.
+func optionalStatus(status string) interface{} {
+	if status == "" {
+		return bson.M{"$exists": false}
+	}
+	return status
+}
+
+type authWebhook struct {
+	AccountID string `json:"account_id"`
+}
+
+// handleAuthWebhook records verification changes of micro-deposit
+// verified accounts that Plaid reports without being asked.
+func handleAuthWebhook(ctx context.Context, wh *webhook) error {
+	var status string
+	switch wh.WebhookCode {
+	case "AUTOMATICALLY_VERIFIED":
+		status = "automatically_verified"
+	case "VERIFICATION_EXPIRED":
+		status = "verification_expired"
+	default:
+		return nil
+	}
+
+	var body authWebhook
+	if err := json.Unmarshal(wh.Body, &body); err != nil {
+		return err
+	}
+
+	_, err := transitionVerificationStatus(ctx, body.AccountID, status, "webhook")
+	if err == mongo.ErrNoDocuments {
+		log.Printf("Webhook for unknown account %s\n", body.AccountID)
+		return nil
+	}
+	return err
+}
+
+func auth(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := requireItem(c)
+	if !ok {
+		return
+	}
+
+	authGetResp, _, err := client.PlaidApi.AuthGet(ctx).AuthGetRequest(
+		*plaid.NewAuthGetRequest(it.AccessToken),
+	).Execute()
+
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	if err := saveAccountNumbers(ctx, it, &authGetResp); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"accounts": authGetResp.GetAccounts(),
+		"numbers":  maskNumbers(authGetResp.GetNumbers()),
+	})
+}
+
+func findAccountNumbers(ctx context.Context, userID, accountID string) (*storedAccountNumbers, error) {
+	var stored storedAccountNumbers
+	err := collection("account_numbers").FindOne(ctx, bson.M{"_id": accountID, "user_id": userID}).Decode(&stored)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// getAccountVerification returns the verification status of an account and
+// its history.
+func getAccountVerification(c *gin.Context) {
+	stored, err := findAccountNumbers(c.Request.Context(), currentPrincipal(c).Subject, c.Param("account_id"))
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+		return
+	}
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, stored)
+}
+
+// revealAccountNumbers decrypts and returns the full numbers of an account.
+// Every reveal is logged. Numbers are never revealed to unauthenticated
+// callers, even though AUTH_MODE none grants them every scope.
+func revealAccountNumbers(c *gin.Context) {
+	p := currentPrincipal(c)
+	if !p.authenticated() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "revealing account numbers requires authentication"})
+		return
+	}
+	accountID := c.Param("account_id")
+	stored, err := findAccountNumbers(c.Request.Context(), p.Subject, accountID)
+	if err == nil && stored.Ciphertext == nil {
+		err = mongo.ErrNoDocuments
+	}
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no account numbers stored for the account"})
+		return
+	}
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	if vaultAEAD == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errVaultDisabled.Error()})
+		return
+	}
+	plaintext, err := openNumbers(accountID, stored.Ciphertext)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	var numbers accountNumbers
+	if err := json.Unmarshal(plaintext, &numbers); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	log.Printf("Account numbers of %s revealed to %s (%s)\n", accountID, p.Subject, p.Method)
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"account_id": accountID,
+		"item_id":    stored.ItemID,
+		"numbers":    numbers,
+	})
+}
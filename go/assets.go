@@ -0,0 +1,847 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Asset reports are generated asynchronously by Plaid. Creating, refreshing
+// or filtering one records a pending report in the asset_reports collection;
+// the ASSETS PRODUCT_READY webhook or the poller stores its contents and
+// marks it ready. Reports are snapshots handed to lenders and are kept when
+// one of their items is removed.
+
+// Asset report statuses.
+const (
+	assetReportPending = "pending"
+	assetReportReady   = "ready"
+	assetReportFailed  = "failed"
+)
+
+// assetReportUser identifies the borrower on the report. The SSN is passed to
+// Plaid but never stored.
+type assetReportUser struct {
+	ClientUserID string `bson:"client_user_id,omitempty" json:"client_user_id,omitempty"`
+	FirstName    string `bson:"first_name,omitempty" json:"first_name,omitempty"`
+	MiddleName   string `bson:"middle_name,omitempty" json:"middle_name,omitempty"`
+	LastName     string `bson:"last_name,omitempty" json:"last_name,omitempty"`
+	PhoneNumber  string `bson:"phone_number,omitempty" json:"phone_number,omitempty"`
+	Email        string `bson:"email,omitempty" json:"email,omitempty"`
+	SSN          string `bson:"-" json:"ssn,omitempty"`
+}
+
+// assetReportAuditCopy is a copy of a report shared with an auditor such as
+// a lender, who fetches it with the audit copy token.
+type assetReportAuditCopy struct {
+	AuditorID      string    `bson:"auditor_id" json:"auditor_id"`
+	AuditCopyToken string    `bson:"audit_copy_token" json:"audit_copy_token"`
+	CreatedAt      time.Time `bson:"created_at" json:"created_at"`
+}
+
+type storedAssetReport struct {
+	AssetReportID    string                 `bson:"_id" json:"asset_report_id"`
+	AssetReportToken string                 `bson:"asset_report_token" json:"-"`
+	UserID           string                 `bson:"user_id" json:"-"`
+	ItemIDs          []string               `bson:"item_ids" json:"item_ids"`
+	DaysRequested    int32                  `bson:"days_requested" json:"days_requested"`
+	User             *assetReportUser       `bson:"user,omitempty" json:"user,omitempty"`
+	RefreshedFrom    string                 `bson:"refreshed_from,omitempty" json:"refreshed_from,omitempty"`
+	FilteredFrom     string                 `bson:"filtered_from,omitempty" json:"filtered_from,omitempty"`
+	ExcludedAccounts []string               `bson:"excluded_accounts,omitempty" json:"excluded_accounts,omitempty"`
+	AuditCopies      []assetReportAuditCopy `bson:"audit_copies,omitempty" json:"audit_copies,omitempty"`
+	Status           string                 `bson:"status" json:"status"`
+	Error            string                 `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt        time.Time              `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time              `bson:"updated_at" json:"updated_at"`
+	ReadyAt          *time.Time             `bson:"ready_at,omitempty" json:"ready_at,omitempty"`
+
+	// Report is the report as returned by /asset_report/get, stored once
+	// it is ready.
+	Report bson.M `bson:"report,omitempty" json:"-"`
+}
+
+// ASSET_REPORT_POLL_INTERVAL is how often pending asset reports are checked
+// at Plaid, in case the PRODUCT_READY webhook is missed.
+var ASSET_REPORT_POLL_INTERVAL = time.Minute
+
+// Plaid accepts between 0 and 731 days of history.
+const (
+	defaultAssetReportDays = 10
+	maxAssetReportDays     = 731
+)
+
+func initAssets() {
+	if v := os.Getenv("ASSET_REPORT_POLL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid ASSET_REPORT_POLL_INTERVAL %q: %v", v, err)
+		}
+		ASSET_REPORT_POLL_INTERVAL = d
+	}
+
+	registerWebhookHandler("ASSETS", handleAssetsWebhook)
+	registerJob("asset-report-poll", ASSET_REPORT_POLL_INTERVAL, pollAssetReports)
+}
+
+func (u *assetReportUser) plaidUser() *plaid.AssetReportUser {
+	user := plaid.NewAssetReportUser()
+	set := func(v string, setter func(string)) {
+		if v != "" {
+			setter(v)
+		}
+	}
+	set(u.ClientUserID, user.SetClientUserId)
+	set(u.FirstName, user.SetFirstName)
+	set(u.MiddleName, user.SetMiddleName)
+	set(u.LastName, user.SetLastName)
+	set(u.PhoneNumber, user.SetPhoneNumber)
+	set(u.Email, user.SetEmail)
+	set(u.SSN, user.SetSsn)
+	return user
+}
+
+// stored returns a copy of the user without the SSN, or nil when there is
+// no user.
+func (u *assetReportUser) stored() *assetReportUser {
+	if u == nil {
+		return nil
+	}
+	cp := *u
+	cp.SSN = ""
+	return &cp
+}
+
+// assetReportOptions is the body accepted when creating or refreshing a
+// report. Fields left empty fall back to the defaults, or for a refresh to
+// the original report.
+type assetReportOptions struct {
+	ItemIDs       []string         `json:"item_ids"`
+	DaysRequested *int32           `json:"days_requested"`
+	User          *assetReportUser `json:"user"`
+}
+
+// bindAssetReportOptions binds the optional JSON body of the request.
+func bindAssetReportOptions(c *gin.Context) (*assetReportOptions, bool) {
+	var opts assetReportOptions
+	if err := c.ShouldBindJSON(&opts); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if d := opts.DaysRequested; d != nil && (*d < 0 || *d > maxAssetReportDays) {
+		renderError(c, invalidf("days_requested must be between 0 and %d", maxAssetReportDays))
+		return nil, false
+	}
+	return &opts, true
+}
+
+func (o *assetReportOptions) days(def int32) int32 {
+	if o.DaysRequested != nil {
+		return *o.DaysRequested
+	}
+	return def
+}
+
+// createAssetReport asks Plaid to generate an asset report for the items and
+// records it as pending.
+func createAssetReport(ctx context.Context, userID string, items []*storedItem, days int32, user *assetReportUser) (*storedAssetReport, error) {
+	accessTokens := make([]string, 0, len(items))
+	itemIDs := make([]string, 0, len(items))
+	for _, it := range items {
+		accessTokens = append(accessTokens, it.AccessToken)
+		itemIDs = append(itemIDs, it.ItemID)
+	}
+
+	request := plaid.NewAssetReportCreateRequest(accessTokens, days)
+	if user != nil {
+		opts := plaid.NewAssetReportCreateRequestOptions()
+		opts.SetUser(*user.plaidUser())
+		request.SetOptions(*opts)
+	}
+
+	assetReportCreateResp, _, err := client.PlaidApi.AssetReportCreate(ctx).AssetReportCreateRequest(*request).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	report := storedAssetReport{
+		AssetReportID:    assetReportCreateResp.GetAssetReportId(),
+		AssetReportToken: assetReportCreateResp.GetAssetReportToken(),
+		UserID:           userID,
+		ItemIDs:          itemIDs,
+		DaysRequested:    days,
+		User:             user.stored(),
+		Status:           assetReportPending,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if _, err := collection("asset_reports").InsertOne(ctx, report); err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// refreshAssetReport asks Plaid for a new report with the same items and
+// fresh data, recorded as pending.
+func refreshAssetReport(ctx context.Context, orig *storedAssetReport, opts *assetReportOptions) (*storedAssetReport, error) {
+	days := opts.days(orig.DaysRequested)
+	user := orig.User
+	if opts.User != nil {
+		user = opts.User
+	}
+
+	request := plaid.NewAssetReportRefreshRequest(orig.AssetReportToken)
+	request.SetDaysRequested(days)
+	if opts.User != nil {
+		refreshOpts := plaid.NewAssetReportRefreshRequestOptions()
+		refreshOpts.SetUser(*opts.User.plaidUser())
+		request.SetOptions(*refreshOpts)
+	}
+
+	assetReportRefreshResp, _, err := client.PlaidApi.AssetReportRefresh(ctx).AssetReportRefreshRequest(*request).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	report := storedAssetReport{
+		AssetReportID:    assetReportRefreshResp.GetAssetReportId(),
+		AssetReportToken: assetReportRefreshResp.GetAssetReportToken(),
+		UserID:           orig.UserID,
+		ItemIDs:          orig.ItemIDs,
+		DaysRequested:    days,
+		User:             user.stored(),
+		RefreshedFrom:    orig.AssetReportID,
+		Status:           assetReportPending,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if _, err := collection("asset_reports").InsertOne(ctx, report); err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// filterAssetReport creates a copy of a ready report without the excluded
+// accounts. Plaid usually has the copy ready at once; otherwise it is left
+// pending for the poller.
+func filterAssetReport(ctx context.Context, orig *storedAssetReport, exclude []string) (*storedAssetReport, error) {
+	if err := loadAssetReportContents(ctx, orig); err != nil {
+		return nil, err
+	}
+	known := orig.accountIDs()
+	for _, id := range exclude {
+		if !itemExists(known, id) {
+			return nil, invalidf("account %q is not in asset report %s", id, orig.AssetReportID)
+		}
+	}
+
+	assetReportFilterResp, _, err := client.PlaidApi.AssetReportFilter(ctx).AssetReportFilterRequest(
+		*plaid.NewAssetReportFilterRequest(orig.AssetReportToken, exclude),
+	).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	report := storedAssetReport{
+		AssetReportID:    assetReportFilterResp.GetAssetReportId(),
+		AssetReportToken: assetReportFilterResp.GetAssetReportToken(),
+		UserID:           orig.UserID,
+		ItemIDs:          orig.ItemIDs,
+		DaysRequested:    orig.DaysRequested,
+		User:             orig.User,
+		FilteredFrom:     orig.AssetReportID,
+		ExcludedAccounts: append(append([]string{}, orig.ExcludedAccounts...), exclude...),
+		Status:           assetReportPending,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if _, err := collection("asset_reports").InsertOne(ctx, report); err != nil {
+		return nil, err
+	}
+
+	if err := checkAssetReport(ctx, &report); err != nil {
+		log.Printf("Error checking asset report %s: %v\n", report.AssetReportID, err)
+	}
+	return &report, nil
+}
+
+// loadAssetReportContents fetches and stores the contents of a ready report
+// that became ready before contents were stored.
+func loadAssetReportContents(ctx context.Context, r *storedAssetReport) error {
+	if r.Report != nil {
+		return nil
+	}
+
+	assetReportGetResp, _, err := client.PlaidApi.AssetReportGet(ctx).AssetReportGetRequest(
+		*plaid.NewAssetReportGetRequest(r.AssetReportToken),
+	).Execute()
+	if err != nil {
+		return err
+	}
+	doc, err := toDocument(assetReportGetResp.GetReport())
+	if err != nil {
+		return err
+	}
+	if _, err := collection("asset_reports").UpdateOne(ctx,
+		bson.M{"_id": r.AssetReportID},
+		bson.M{"$set": bson.M{"report": doc}},
+	); err != nil {
+		return err
+	}
+	r.Report = doc
+	return nil
+}
+
+// accountIDs lists the accounts in the stored report contents.
+func (r *storedAssetReport) accountIDs() []string {
+	var contents struct {
+		Items []struct {
+			Accounts []struct {
+				AccountID string `json:"account_id"`
+			} `json:"accounts"`
+		} `json:"items"`
+	}
+	b, err := json.Marshal(r.Report)
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(b, &contents); err != nil {
+		return nil
+	}
+
+	var ids []string
+	for _, it := range contents.Items {
+		for _, a := range it.Accounts {
+			ids = append(ids, a.AccountID)
+		}
+	}
+	return ids
+}
+
+func findAssetReport(ctx context.Context, userID, id string) (*storedAssetReport, error) {
+	var report storedAssetReport
+	err := collection("asset_reports").FindOne(ctx, bson.M{"_id": id, "user_id": userID}).Decode(&report)
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// checkAssetReport fetches a pending report from Plaid and stores it when it
+// is ready, or marks it failed when Plaid reports an error other than the
+// report not being ready yet.
+func checkAssetReport(ctx context.Context, report *storedAssetReport) error {
+	assetReportGetResp, _, err := client.PlaidApi.AssetReportGet(ctx).AssetReportGetRequest(
+		*plaid.NewAssetReportGetRequest(report.AssetReportToken),
+	).Execute()
+	if err != nil {
+		plaidErr, perr := plaid.ToPlaidError(err)
+		if perr != nil {
+			return err
+		}
+		if plaidErr.ErrorCode == "PRODUCT_NOT_READY" {
+			return nil
+		}
+		return finishAssetReport(ctx, report, nil, plaidErr.ErrorCode+": "+plaidErr.ErrorMessage)
+	}
+
+	contents := assetReportGetResp.GetReport()
+	return finishAssetReport(ctx, report, &contents, "")
+}
+
+// finishAssetReport moves a pending report to ready with its contents, or
+// to failed when reason is not empty.
+func finishAssetReport(ctx context.Context, report *storedAssetReport, contents *plaid.AssetReport, reason string) error {
+	now := time.Now().UTC()
+	set := bson.M{"status": assetReportFailed, "updated_at": now, "error": reason}
+	if reason == "" {
+		doc, err := toDocument(contents)
+		if err != nil {
+			return err
+		}
+		set = bson.M{"status": assetReportReady, "updated_at": now, "ready_at": now, "report": doc}
+		report.Report = doc
+		report.ReadyAt = &now
+	}
+
+	res, err := collection("asset_reports").UpdateOne(ctx,
+		bson.M{"_id": report.AssetReportID, "status": assetReportPending},
+		bson.M{"$set": set},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		report.Status = set["status"].(string)
+		report.Error = reason
+		report.UpdatedAt = now
+	}
+	return nil
+}
+
+type assetsWebhook struct {
+	AssetReportID string `json:"asset_report_id"`
+}
+
+func handleAssetsWebhook(ctx context.Context, wh *webhook) error {
+	var body assetsWebhook
+	if err := json.Unmarshal(wh.Body, &body); err != nil {
+		return err
+	}
+
+	var report storedAssetReport
+	err := collection("asset_reports").FindOne(ctx, bson.M{"_id": body.AssetReportID}).Decode(&report)
+	if err == mongo.ErrNoDocuments {
+		log.Printf("Webhook for unknown asset report %s\n", body.AssetReportID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch wh.WebhookCode {
+	case "PRODUCT_READY":
+		return checkAssetReport(ctx, &report)
+	case "ERROR":
+		reason := "asset report generation failed"
+		if wh.Error != nil {
+			reason = wh.Error.ErrorCode + ": " + wh.Error.ErrorMessage
+		}
+		return finishAssetReport(ctx, &report, nil, reason)
+	}
+	return nil
+}
+
+// pollAssetReports checks pending reports that have waited for at least a
+// poll interval.
+func pollAssetReports(ctx context.Context) error {
+	curr, err := collection("asset_reports").Find(ctx, bson.M{
+		"status":     assetReportPending,
+		"created_at": bson.M{"$lt": time.Now().Add(-ASSET_REPORT_POLL_INTERVAL)},
+	})
+	if err != nil {
+		return err
+	}
+
+	var pending []storedAssetReport
+	if err := curr.All(ctx, &pending); err != nil {
+		return err
+	}
+
+	for i := range pending {
+		if err := checkAssetReport(ctx, &pending[i]); err != nil {
+			log.Printf("Error polling asset report %s: %v\n", pending[i].AssetReportID, err)
+		}
+	}
+	return nil
+}
+
+// ownedAssetReport loads the caller's asset report named by the :id path
+// parameter and renders a 404 when it does not exist.
+func ownedAssetReport(c *gin.Context) (*storedAssetReport, bool) {
+	report, err := findAssetReport(c.Request.Context(), currentPrincipal(c).Subject, c.Param("id"))
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "asset report not found"})
+		return nil, false
+	}
+	if err != nil {
+		renderError(c, err)
+		return nil, false
+	}
+	return report, true
+}
+
+// readyAssetReport is ownedAssetReport for endpoints that need the report to
+// have been generated. It renders a 409 while the report is pending or has
+// failed.
+func readyAssetReport(c *gin.Context) (*storedAssetReport, bool) {
+	report, ok := ownedAssetReport(c)
+	if !ok {
+		return nil, false
+	}
+	if report.Status != assetReportReady {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "asset report is " + report.Status,
+			"report": report,
+		})
+		return nil, false
+	}
+	return report, true
+}
+
+// assetReportItems resolves the items a new report covers: the caller's
+// items named in itemIDs, or the item picked by requireItem when there are
+// none.
+func assetReportItems(c *gin.Context, itemIDs []string) ([]*storedItem, bool) {
+	if len(itemIDs) == 0 {
+		it, ok := requireItem(c)
+		if !ok {
+			return nil, false
+		}
+		return []*storedItem{it}, true
+	}
+
+	ctx := c.Request.Context()
+	userID := currentPrincipal(c).Subject
+
+	items := make([]*storedItem, 0, len(itemIDs))
+	for _, id := range itemIDs {
+		if itemExists(itemIDs[:len(items)], id) {
+			renderError(c, invalidf("item %q is listed twice", id))
+			return nil, false
+		}
+		it, err := findItem(ctx, userID, id)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "item " + id + " not found"})
+			return nil, false
+		}
+		if err != nil {
+			renderError(c, err)
+			return nil, false
+		}
+		items = append(items, it)
+	}
+	return items, true
+}
+
+// postAssetReport starts generating an asset report and returns its ID right
+// away. Poll GET /api/assets/:id until the status is ready.
+func postAssetReport(c *gin.Context) {
+	opts, ok := bindAssetReportOptions(c)
+	if !ok {
+		return
+	}
+	items, ok := assetReportItems(c, opts.ItemIDs)
+	if !ok {
+		return
+	}
+
+	report, err := createAssetReport(c.Request.Context(), currentPrincipal(c).Subject,
+		items, opts.days(defaultAssetReportDays), opts.User)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"report": report})
+}
+
+func listAssetReports(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	curr, err := collection("asset_reports").Find(ctx,
+		bson.M{"user_id": currentPrincipal(c).Subject},
+		options.Find().
+			SetSort(bson.M{"created_at": -1}).
+			SetProjection(bson.M{"report": 0}),
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	all := make([]storedAssetReport, 0)
+	if err := curr.All(ctx, &all); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reports": all})
+}
+
+// getAssetReport returns the report's status and, once it is ready, its
+// contents.
+func getAssetReport(c *gin.Context) {
+	report, ok := ownedAssetReport(c)
+	if !ok {
+		return
+	}
+
+	resp := gin.H{"report": report}
+	if report.Status == assetReportReady {
+		if err := loadAssetReportContents(c.Request.Context(), report); err != nil {
+			renderError(c, err)
+			return
+		}
+		resp["json"] = report.Report
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func postAssetReportRefresh(c *gin.Context) {
+	report, ok := readyAssetReport(c)
+	if !ok {
+		return
+	}
+	opts, ok := bindAssetReportOptions(c)
+	if !ok {
+		return
+	}
+	if len(opts.ItemIDs) > 0 {
+		renderError(c, invalidf("a refreshed report covers the items of the original, item_ids cannot be changed"))
+		return
+	}
+
+	refreshed, err := refreshAssetReport(c.Request.Context(), report, opts)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"report": refreshed})
+}
+
+type filterAssetReportRequest struct {
+	AccountIDsToExclude []string `json:"account_ids_to_exclude" binding:"required,min=1"`
+}
+
+func postAssetReportFilter(c *gin.Context) {
+	report, ok := readyAssetReport(c)
+	if !ok {
+		return
+	}
+
+	var req filterAssetReportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filtered, err := filterAssetReport(c.Request.Context(), report, req.AccountIDsToExclude)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	status := http.StatusAccepted
+	if filtered.Status == assetReportReady {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"report": filtered})
+}
+
+type auditCopyRequest struct {
+	AuditorID string `json:"auditor_id" binding:"required"`
+}
+
+// postAssetReportAuditCopy shares the report with an auditor. The returned
+// audit copy token is what the auditor uses to fetch the report.
+func postAssetReportAuditCopy(c *gin.Context) {
+	ctx := c.Request.Context()
+	report, ok := readyAssetReport(c)
+	if !ok {
+		return
+	}
+
+	var req auditCopyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.AuditorID = strings.TrimSpace(req.AuditorID)
+
+	auditCopyCreateResp, _, err := client.PlaidApi.AssetReportAuditCopyCreate(ctx).AssetReportAuditCopyCreateRequest(
+		*plaid.NewAssetReportAuditCopyCreateRequest(report.AssetReportToken, req.AuditorID),
+	).Execute()
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	auditCopy := assetReportAuditCopy{
+		AuditorID:      req.AuditorID,
+		AuditCopyToken: auditCopyCreateResp.GetAuditCopyToken(),
+		CreatedAt:      time.Now().UTC(),
+	}
+	_, err = collection("asset_reports").UpdateOne(ctx,
+		bson.M{"_id": report.AssetReportID},
+		bson.M{
+			"$push": bson.M{"audit_copies": auditCopy},
+			"$set":  bson.M{"updated_at": auditCopy.CreatedAt},
+		},
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"audit_copy": auditCopy})
+}
+
+// removeAssetReport invalidates the report at Plaid, revoking its audit
+// copies first so no auditor keeps access, and then deletes it.
+func removeAssetReport(c *gin.Context) {
+	ctx := c.Request.Context()
+	report, ok := ownedAssetReport(c)
+	if !ok {
+		return
+	}
+
+	for _, auditCopy := range report.AuditCopies {
+		_, _, err := client.PlaidApi.AssetReportAuditCopyRemove(ctx).AssetReportAuditCopyRemoveRequest(
+			*plaid.NewAssetReportAuditCopyRemoveRequest(auditCopy.AuditCopyToken),
+		).Execute()
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+	}
+
+	_, _, err := client.PlaidApi.AssetReportRemove(ctx).AssetReportRemoveRequest(
+		*plaid.NewAssetReportRemoveRequest(report.AssetReportToken),
+	).Execute()
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	if _, err := collection("asset_reports").DeleteOne(ctx, bson.M{"_id": report.AssetReportID}); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"asset_report_id": report.AssetReportID,
+		"removed":         true,
+	})
+}
+
+// assetReportPdf fetches the report's PDF from Plaid. The caller must close
+// the file, which removes it.
+func assetReportPdf(ctx context.Context, report *storedAssetReport) (*assetReportPdfFile, error) {
+	pdfFile, _, err := client.PlaidApi.AssetReportPdfGet(ctx).AssetReportPDFGetRequest(
+		*plaid.NewAssetReportPDFGetRequest(report.AssetReportToken),
+	).Execute()
+	if err != nil {
+		return nil, err
+	}
+	return &assetReportPdfFile{pdfFile}, nil
+}
+
+// assetReportPdfFile is the temporary file the Plaid client downloads the
+// PDF to.
+type assetReportPdfFile struct {
+	*os.File
+}
+
+func (f *assetReportPdfFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+func getAssetReportPdf(c *gin.Context) {
+	report, ok := readyAssetReport(c)
+	if !ok {
+		return
+	}
+
+	pdf, err := assetReportPdf(c.Request.Context(), report)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	defer pdf.Close()
+
+	info, err := pdf.Stat()
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.DataFromReader(http.StatusOK, info.Size(), "application/pdf", pdf, map[string]string{
+		"Content-Disposition": `attachment; filename="asset-report-` + report.AssetReportID + `.pdf"`,
+	})
+}
+
+// assetsFrontendMaxAge is how long the quickstart frontend is served the
+// same asset report before a new one is generated.
+const assetsFrontendMaxAge = 24 * time.Hour
+
+// assets serves the quickstart frontend. It returns the caller's latest
+// unfiltered asset report of the selected item with its PDF inline once
+// ready. When there is none from the last assetsFrontendMaxAge, or it
+// failed, this GET starts generating one, as the frontend has no other way
+// to ask for it, and answers 202 so the frontend can ask again.
+func assets(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := currentPrincipal(c).Subject
+	it, ok := requireItem(c)
+	if !ok {
+		return
+	}
+
+	var report storedAssetReport
+	err := collection("asset_reports").FindOne(ctx,
+		bson.M{
+			"user_id":       userID,
+			"item_ids":      bson.A{it.ItemID},
+			"filtered_from": bson.M{"$exists": false},
+			"created_at":    bson.M{"$gte": time.Now().Add(-assetsFrontendMaxAge)},
+		},
+		options.FindOne().SetSort(bson.M{"created_at": -1}),
+	).Decode(&report)
+	if err == mongo.ErrNoDocuments || (err == nil && report.Status == assetReportFailed) {
+		created, err := createAssetReport(ctx, userID, []*storedItem{it}, defaultAssetReportDays, nil)
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		report = *created
+	} else if err != nil {
+		renderError(c, err)
+		return
+	}
+	if report.Status == assetReportPending {
+		// Shaped like a Plaid error so the frontend shows it.
+		c.JSON(http.StatusAccepted, gin.H{
+			"report": report,
+			"error": gin.H{
+				"error_type":    "ASSET_REPORT_ERROR",
+				"error_code":    "PRODUCT_NOT_READY",
+				"error_message": "the asset report is being generated, try again shortly",
+			},
+		})
+		return
+	}
+
+	if err := loadAssetReportContents(ctx, &report); err != nil {
+		renderError(c, err)
+		return
+	}
+	pdf, err := assetReportPdf(ctx, &report)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	defer pdf.Close()
+
+	content, err := ioutil.ReadAll(pdf)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"json": report.Report,
+		"pdf":  base64.StdEncoding.EncodeToString(content),
+	})
+}
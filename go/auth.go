@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Scopes granted to API keys and bearer tokens.
+const (
+	scopeReadAccounts      = "read:accounts"
+	scopeReadTransactions  = "read:transactions"
+	scopeWriteTransactions = "write:transactions"
+	scopeReadInvestments   = "read:investments"
+	scopeReadAssets        = "read:assets"
+	scopeShareAssets       = "share:assets"
+	scopeRevealNumbers     = "reveal:numbers"
+	scopeLink              = "link"
+	scopePayments          = "payments"
+	scopeExport            = "export"
+	scopeAdminItems        = "admin:items"
+	scopeAdminKeys         = "admin:keys"
+
+	// scopeAll is only held by the bootstrap admin key.
+	scopeAll = "*"
+)
+
+// AUTH_MODE is a comma-separated list of the authenticators accepted on
+// /api routes: "apikey" and/or "oidc". "none" leaves the API open.
+var AUTH_MODE = ""
+
+// ADMIN_API_KEY is a key held only in the environment that carries every
+// scope. It is used to create the first stored API keys.
+var ADMIN_API_KEY = ""
+
+const principalKey = "principal"
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	Subject string
+	Scopes  []string
+	Method  string
+}
+
+func (p *principal) hasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == scopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticated tells whether the caller proved who they are. AUTH_MODE
+// none grants every scope to anyone, but does not authenticate them.
+func (p *principal) authenticated() bool {
+	return AUTH_MODE != "none" && p.Method != "none"
+}
+
+var errUnauthenticated = errors.New("missing or invalid credentials")
+
+// authenticator resolves the credentials of a request to a principal. It
+// returns (nil, nil) when the request carries no credentials it understands.
+type authenticator func(c *gin.Context) (*principal, error)
+
+var authenticators []authenticator
+
+func initAuth() {
+	AUTH_MODE = strings.ToLower(os.Getenv("AUTH_MODE"))
+	if AUTH_MODE == "" {
+		AUTH_MODE = "none"
+	}
+	ADMIN_API_KEY = os.Getenv("ADMIN_API_KEY")
+
+	for _, mode := range strings.Split(AUTH_MODE, ",") {
+		switch strings.TrimSpace(mode) {
+		case "none":
+		case "apikey":
+			authenticators = append(authenticators, authenticateAPIKey)
+		case "oidc":
+			if err := initOIDC(); err != nil {
+				log.Fatal(err)
+			}
+			authenticators = append(authenticators, authenticateBearerToken)
+		default:
+			log.Fatalf("Unknown AUTH_MODE %q", mode)
+		}
+	}
+
+	if len(authenticators) == 0 {
+		log.Println("Warning: AUTH_MODE is none, /api routes are not authenticated")
+	}
+	log.Printf("Auth mode: %s\n", AUTH_MODE)
+}
+
+// authenticate rejects requests that no configured authenticator accepts and
+// stores the resulting principal on the context.
+func authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(authenticators) == 0 {
+			c.Set(principalKey, &principal{Subject: "anonymous", Scopes: []string{scopeAll}, Method: "none"})
+			c.Next()
+			return
+		}
+
+		for _, authn := range authenticators {
+			p, err := authn(c)
+			if err == errUnauthenticated {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				// A lookup failure says nothing about the credentials.
+				log.Println("Error authenticating request", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "could not check credentials"})
+				return
+			}
+			if p != nil {
+				c.Set(principalKey, p)
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": errUnauthenticated.Error()})
+	}
+}
+
+// requireScope rejects callers whose principal does not hold scope.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p := currentPrincipal(c)
+		if p == nil || !p.hasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "missing scope " + scope})
+			return
+		}
+		c.Next()
+	}
+}
+
+func currentPrincipal(c *gin.Context) *principal {
+	v, ok := c.Get(principalKey)
+	if !ok {
+		return nil
+	}
+	p, _ := v.(*principal)
+	return p
+}
+
+// bearerToken returns the credentials from the Authorization header.
+func bearerToken(c *gin.Context) string {
+	h := c.GetHeader("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// isJWT tells a compact JWT apart from an opaque API key.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// apiKey is a stored API key. Only the SHA-256 hash of the key is kept.
+type apiKey struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	Subject   string             `bson:"subject" json:"subject"`
+	KeyHash   string             `bson:"key_hash" json:"-"`
+	Scopes    []string           `bson:"scopes" json:"scopes"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	RevokedAt *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "qs_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func authenticateAPIKey(c *gin.Context) (*principal, error) {
+	key := c.GetHeader("X-API-Key")
+	if key == "" {
+		if token := bearerToken(c); token != "" && !isJWT(token) {
+			key = token
+		}
+	}
+	if key == "" {
+		return nil, nil
+	}
+
+	if ADMIN_API_KEY != "" && hashAPIKey(key) == hashAPIKey(ADMIN_API_KEY) {
+		return &principal{Subject: "admin", Scopes: []string{scopeAll}, Method: "api_key"}, nil
+	}
+
+	stored, err := findAPIKey(c.Request.Context(), hashAPIKey(key))
+	if err == mongo.ErrNoDocuments {
+		return nil, errUnauthenticated
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &principal{Subject: stored.Subject, Scopes: stored.Scopes, Method: "api_key"}, nil
+}
+
+func findAPIKey(ctx context.Context, keyHash string) (*apiKey, error) {
+	var key apiKey
+	err := collection("api_keys").FindOne(ctx, bson.M{
+		"key_hash":   keyHash,
+		"revoked_at": bson.M{"$exists": false},
+	}).Decode(&key)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+type createAPIKeyRequest struct {
+	Name    string   `json:"name" binding:"required"`
+	Subject string   `json:"subject" binding:"required"`
+	Scopes  []string `json:"scopes" binding:"required"`
+}
+
+var knownScopes = []string{
+	scopeReadAccounts, scopeReadTransactions, scopeWriteTransactions, scopeReadInvestments, scopeReadAssets,
+	scopeShareAssets, scopeRevealNumbers, scopeLink, scopePayments, scopeExport, scopeAdminItems, scopeAdminKeys,
+}
+
+// createAPIKey stores a new key and returns it in clear text. This is the only
+// time the key itself is available.
+func createAPIKey(c *gin.Context) {
+	var req createAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, s := range req.Scopes {
+		if !itemExists(knownScopes, s) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope " + s})
+			return
+		}
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	stored := apiKey{
+		Name:      req.Name,
+		Subject:   req.Subject,
+		KeyHash:   hashAPIKey(key),
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	res, err := collection("api_keys").InsertOne(c.Request.Context(), stored)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	stored.ID = res.InsertedID.(primitive.ObjectID)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"api_key": stored,
+		"key":     key,
+	})
+}
+
+func listAPIKeys(c *gin.Context) {
+	curr, err := collection("api_keys").Find(c.Request.Context(), bson.M{})
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	keys := make([]apiKey, 0)
+	if err := curr.All(c.Request.Context(), &keys); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+func revokeAPIKey(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key id"})
+		return
+	}
+
+	res, err := collection("api_keys").UpdateOne(c.Request.Context(),
+		bson.M{"_id": id, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now().UTC()}},
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	if res.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
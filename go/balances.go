@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every time balances are fetched, one snapshot per account is recorded in
+// the balance_snapshots collection. The net worth series is built from the
+// last snapshot of each account on or before every day.
+
+// Balance snapshot sources.
+const (
+	balanceSourceBalance      = "balance"
+	balanceSourceTransactions = "transactions"
+	balanceSourceScheduled    = "scheduled"
+)
+
+type balanceSnapshot struct {
+	UserID                 string   `bson:"user_id" json:"-"`
+	ItemID                 string   `bson:"item_id" json:"item_id"`
+	AccountID              string   `bson:"account_id" json:"account_id"`
+	Type                   string   `bson:"type" json:"type"`
+	Subtype                string   `bson:"subtype,omitempty" json:"subtype,omitempty"`
+	Current                *float64 `bson:"current,omitempty" json:"current,omitempty"`
+	Available              *float64 `bson:"available,omitempty" json:"available,omitempty"`
+	Limit                  *float64 `bson:"limit,omitempty" json:"limit,omitempty"`
+	IsoCurrencyCode        string   `bson:"iso_currency_code,omitempty" json:"iso_currency_code,omitempty"`
+	UnofficialCurrencyCode string   `bson:"unofficial_currency_code,omitempty" json:"unofficial_currency_code,omitempty"`
+	Source                 string   `bson:"source" json:"source"`
+
+	// Date is the local date of FetchedAt, which the net worth series
+	// groups by.
+	Date      string    `bson:"date" json:"date"`
+	FetchedAt time.Time `bson:"fetched_at" json:"fetched_at"`
+}
+
+// The net worth series covers at most five years.
+const maxNetWorthDays = 5 * 366
+
+// BALANCE_SNAPSHOT_INTERVAL is how often the balances of every item are
+// snapshotted.
+var BALANCE_SNAPSHOT_INTERVAL = 24 * time.Hour
+
+func initBalances() {
+	if v := os.Getenv("BALANCE_SNAPSHOT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid BALANCE_SNAPSHOT_INTERVAL %q: %v", v, err)
+		}
+		BALANCE_SNAPSHOT_INTERVAL = d
+	}
+
+	registerJob("balance-snapshot", BALANCE_SNAPSHOT_INTERVAL, snapshotAllBalances)
+}
+
+// currency is the ISO code of the balance, or its unofficial code for
+// currencies such as cryptocurrencies.
+func (s *balanceSnapshot) currency() string {
+	if s.IsoCurrencyCode != "" {
+		return s.IsoCurrencyCode
+	}
+	return s.UnofficialCurrencyCode
+}
+
+// isLiability tells whether the account's current balance is owed rather
+// than held.
+func (s *balanceSnapshot) isLiability() bool {
+	return s.Type == string(plaid.ACCOUNTTYPE_CREDIT) || s.Type == string(plaid.ACCOUNTTYPE_LOAN)
+}
+
+// recordBalanceSnapshots stores a snapshot of the balances of the item's
+// accounts.
+func recordBalanceSnapshots(ctx context.Context, it *storedItem, accounts []plaid.AccountBase, source string) error {
+	if len(accounts) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	docs := make([]interface{}, 0, len(accounts))
+	for _, a := range accounts {
+		docs = append(docs, balanceSnapshot{
+			UserID:                 it.UserID,
+			ItemID:                 it.ItemID,
+			AccountID:              a.AccountId,
+			Type:                   string(a.Type),
+			Subtype:                string(a.GetSubtype()),
+			Current:                optionalFloat64(a.Balances.GetCurrentOk()),
+			Available:              optionalFloat64(a.Balances.GetAvailableOk()),
+			Limit:                  optionalFloat64(a.Balances.GetLimitOk()),
+			IsoCurrencyCode:        a.Balances.GetIsoCurrencyCode(),
+			UnofficialCurrencyCode: a.Balances.GetUnofficialCurrencyCode(),
+			Source:                 source,
+			Date:                   now.Local().Format("2006-01-02"),
+			FetchedAt:              now.UTC(),
+		})
+	}
+	_, err := collection("balance_snapshots").InsertMany(ctx, docs)
+	return err
+}
+
+// snapshotAllBalances snapshots the balances of every healthy item. It uses
+// /accounts/get, whose balances Plaid refreshes about once a day, rather
+// than requesting real-time balances for every account.
+func snapshotAllBalances(ctx context.Context) error {
+	curr, err := collection("items").Find(ctx, bson.M{"status": itemStatusHealthy})
+	if err != nil {
+		return err
+	}
+
+	var items []storedItem
+	if err := curr.All(ctx, &items); err != nil {
+		return err
+	}
+
+	for i := range items {
+		it := &items[i]
+		accountsGetResp, _, err := client.PlaidApi.AccountsGet(ctx).AccountsGetRequest(
+			*plaid.NewAccountsGetRequest(it.AccessToken),
+		).Execute()
+		if err == nil {
+			err = recordBalanceSnapshots(ctx, it, accountsGetResp.GetAccounts(), balanceSourceScheduled)
+		}
+		if err == nil {
+			err = backfillTransactionCurrencies(ctx, it, accountsGetResp.GetAccounts())
+		}
+		if err == nil {
+			continue
+		}
+		if plaidErr, perr := plaid.ToPlaidError(err); perr == nil {
+			if status, ok := itemErrorStatuses[plaidErr.ErrorCode]; ok {
+				if err := setItemStatus(ctx, it.ItemID, status, plaidErr.ErrorCode); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		log.Printf("Error snapshotting balances of item %s: %v\n", it.ItemID, err)
+	}
+	return nil
+}
+
+func balance(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := requireItem(c)
+	if !ok {
+		return
+	}
+
+	balancesGetResp, _, err := client.PlaidApi.AccountsBalanceGet(ctx).AccountsBalanceGetRequest(
+		*plaid.NewAccountsBalanceGetRequest(it.AccessToken),
+	).Execute()
+
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	if err := recordBalanceSnapshots(ctx, it, balancesGetResp.GetAccounts(), balanceSourceBalance); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"accounts": balancesGetResp.GetAccounts(),
+	})
+}
+
+// latestSnapshotsBefore returns the last snapshot of each account before
+// date, which carry into the first days of a series.
+func latestSnapshotsBefore(ctx context.Context, filter bson.M, date string) ([]balanceSnapshot, error) {
+	match := bson.M{"date": bson.M{"$lt": date}}
+	for k, v := range filter {
+		match[k] = v
+	}
+
+	curr, err := collection("balance_snapshots").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: bson.M{"fetched_at": 1}}},
+		{{Key: "$group", Value: bson.M{"_id": "$account_id", "snapshot": bson.M{"$last": "$$ROOT"}}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$snapshot"}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []balanceSnapshot
+	if err := curr.All(ctx, &snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+type netWorthPoint struct {
+	Date        string  `json:"date"`
+	Assets      float64 `json:"assets"`
+	Liabilities float64 `json:"liabilities"`
+	NetWorth    float64 `json:"net_worth"`
+	Accounts    int     `json:"accounts"`
+}
+
+// netWorthSeries builds a daily series per currency from snapshots sorted by
+// fetch time. Each account counts with its last balance on or before the
+// day; accounts are left out until their first snapshot.
+func netWorthSeries(snapshots []balanceSnapshot, start, end time.Time) map[string][]netWorthPoint {
+	latest := map[string]*balanceSnapshot{}
+	series := map[string][]netWorthPoint{}
+
+	i := 0
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		for ; i < len(snapshots) && snapshots[i].Date <= date; i++ {
+			latest[snapshots[i].AccountID] = &snapshots[i]
+		}
+
+		points := map[string]*netWorthPoint{}
+		for _, s := range latest {
+			if s.Current == nil {
+				continue
+			}
+			p, ok := points[s.currency()]
+			if !ok {
+				p = &netWorthPoint{Date: date}
+				points[s.currency()] = p
+			}
+			if s.isLiability() {
+				p.Liabilities += *s.Current
+			} else {
+				p.Assets += *s.Current
+			}
+			p.Accounts++
+		}
+		for currency, p := range points {
+			p.Assets = roundCents(p.Assets)
+			p.Liabilities = roundCents(p.Liabilities)
+			p.NetWorth = roundCents(p.Assets - p.Liabilities)
+			series[currency] = append(series[currency], *p)
+		}
+	}
+	return series
+}
+
+// netWorth returns the daily net worth of the caller, assets minus
+// liabilities, with one series per currency. Balances are not converted
+// between currencies.
+func netWorth(c *gin.Context) {
+	ctx := c.Request.Context()
+	startDate, endDate, err := dateRange(c, 90)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	start, _ := time.Parse("2006-01-02", startDate)
+	end, _ := time.Parse("2006-01-02", endDate)
+	if end.Sub(start) > maxNetWorthDays*24*time.Hour {
+		renderError(c, invalidf("the range must not exceed %d days", maxNetWorthDays))
+		return
+	}
+
+	filter := bson.M{"user_id": currentPrincipal(c).Subject}
+	if id := c.Query("item_id"); id != "" {
+		filter["item_id"] = id
+	}
+
+	snapshots, err := latestSnapshotsBefore(ctx, filter, startDate)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].FetchedAt.Before(snapshots[j].FetchedAt) })
+
+	inRange := bson.M{"date": bson.M{"$gte": startDate, "$lte": endDate}}
+	for k, v := range filter {
+		inRange[k] = v
+	}
+	curr, err := collection("balance_snapshots").Find(ctx, inRange,
+		options.Find().SetSort(bson.M{"fetched_at": 1}),
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	var recent []balanceSnapshot
+	if err := curr.All(ctx, &recent); err != nil {
+		renderError(c, err)
+		return
+	}
+	snapshots = append(snapshots, recent...)
+
+	c.JSON(http.StatusOK, gin.H{
+		"start_date": startDate,
+		"end_date":   endDate,
+		"series":     netWorthSeries(snapshots, start, end),
+	})
+}
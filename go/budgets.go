@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Budgets cap the spending in one category per week or month. Spend is the
+// net amount of the stored transactions in the budget's category and
+// currency, refunds included, pending transactions counted. When a sync
+// pushes spend past one of the budget's thresholds an alert is recorded in
+// budget_alerts, once per threshold and period.
+
+// Budget periods. Weeks start on Monday.
+const (
+	budgetWeekly  = "weekly"
+	budgetMonthly = "monthly"
+)
+
+var defaultBudgetThresholds = []int{80, 100}
+
+type budget struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID         string             `bson:"user_id" json:"-"`
+	Name           string             `bson:"name" json:"name"`
+	Period         string             `bson:"period" json:"period"`
+	Amount         float64            `bson:"amount" json:"amount"`
+	Currency       string             `bson:"currency" json:"currency"`
+	CustomCategory string             `bson:"custom_category,omitempty" json:"custom_category,omitempty"`
+	PlaidCategory  []string           `bson:"plaid_category,omitempty" json:"plaid_category,omitempty"`
+	Thresholds     []int              `bson:"thresholds" json:"thresholds"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// budgetRequest is the body accepted when creating or updating a budget.
+// Exactly one of custom_category and plaid_category is required.
+type budgetRequest struct {
+	Name           string   `json:"name" binding:"required"`
+	Period         string   `json:"period" binding:"required"`
+	Amount         float64  `json:"amount"`
+	Currency       string   `json:"currency"`
+	CustomCategory string   `json:"custom_category"`
+	PlaidCategory  []string `json:"plaid_category"`
+	Thresholds     []int    `json:"thresholds"`
+}
+
+type budgetPeriod struct {
+	Start     string  `json:"start"`
+	End       string  `json:"end"`
+	Budgeted  float64 `json:"budgeted"`
+	Spent     float64 `json:"spent"`
+	Remaining float64 `json:"remaining"`
+	Percent   float64 `json:"percent"`
+}
+
+type budgetAlert struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID      string             `bson:"user_id" json:"-"`
+	BudgetID    primitive.ObjectID `bson:"budget_id" json:"budget_id"`
+	BudgetName  string             `bson:"budget_name" json:"budget_name"`
+	PeriodStart string             `bson:"period_start" json:"period_start"`
+	Threshold   int                `bson:"threshold" json:"threshold"`
+	Budgeted    float64            `bson:"budgeted" json:"budgeted"`
+	Spent       float64            `bson:"spent" json:"spent"`
+	Percent     float64            `bson:"percent" json:"percent"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func (r *budgetRequest) validate() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Period = strings.ToLower(r.Period)
+	if r.Period != budgetWeekly && r.Period != budgetMonthly {
+		return invalidf("period must be %s or %s", budgetWeekly, budgetMonthly)
+	}
+	if r.Amount <= 0 {
+		return invalidf("amount must be positive")
+	}
+	r.Currency = strings.ToUpper(strings.TrimSpace(r.Currency))
+	if r.Currency == "" {
+		r.Currency = "USD"
+	}
+	r.CustomCategory = strings.TrimSpace(r.CustomCategory)
+	if (r.CustomCategory == "") == (len(r.PlaidCategory) == 0) {
+		return invalidf("exactly one of custom_category and plaid_category is required")
+	}
+	if r.Thresholds == nil {
+		r.Thresholds = defaultBudgetThresholds
+	}
+	for _, t := range r.Thresholds {
+		if t <= 0 || t > 1000 {
+			return invalidf("thresholds must be percentages between 1 and 1000")
+		}
+	}
+	sort.Ints(r.Thresholds)
+	return nil
+}
+
+// periodAt returns the first and last day of the budget period containing
+// day.
+func (b *budget) periodAt(day time.Time) (time.Time, time.Time) {
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	if b.Period == budgetWeekly {
+		start := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, 6)
+	}
+	start := day.AddDate(0, 0, 1-day.Day())
+	return start, start.AddDate(0, 1, -1)
+}
+
+// transactionFilter matches the user's transactions in the budget's
+// category and currency, leaving out merged duplicates.
+func (b *budget) transactionFilter() bson.M {
+	filter := bson.M{"user_id": b.UserID, "currency": b.Currency, "duplicate_of": bson.M{"$exists": false}}
+	if b.CustomCategory != "" {
+		filter["custom_category"] = b.CustomCategory
+	}
+	for i, c := range b.PlaidCategory {
+		filter["category."+strconv.Itoa(i)] = c
+	}
+	return filter
+}
+
+// spent sums the budget's transactions between start and end.
+func (b *budget) spent(ctx context.Context, start, end time.Time) (float64, error) {
+	match := b.transactionFilter()
+	match["date"] = bson.M{"$gte": start.Format("2006-01-02"), "$lte": end.Format("2006-01-02")}
+
+	curr, err := collection("transactions").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "spent": bson.M{"$sum": "$amount"}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var res []struct {
+		Spent float64 `bson:"spent"`
+	}
+	if err := curr.All(ctx, &res); err != nil {
+		return 0, err
+	}
+	if len(res) == 0 {
+		return 0, nil
+	}
+	return roundCents(res[0].Spent), nil
+}
+
+// period computes spend against the budget for the period containing day.
+func (b *budget) period(ctx context.Context, day time.Time) (*budgetPeriod, error) {
+	start, end := b.periodAt(day)
+	spent, err := b.spent(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &budgetPeriod{
+		Start:     start.Format("2006-01-02"),
+		End:       end.Format("2006-01-02"),
+		Budgeted:  b.Amount,
+		Spent:     spent,
+		Remaining: roundCents(b.Amount - spent),
+		Percent:   roundCents(spent / b.Amount * 100),
+	}, nil
+}
+
+func listBudgets(ctx context.Context, userID string) ([]budget, error) {
+	curr, err := collection("budgets").Find(ctx, bson.M{"user_id": userID},
+		options.Find().SetSort(bson.M{"created_at": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	all := make([]budget, 0)
+	if err := curr.All(ctx, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// checkBudgetAlerts records an alert for every threshold the user's
+// budgets have crossed in the current period and not alerted on yet.
+func checkBudgetAlerts(ctx context.Context, userID string) error {
+	budgets, err := listBudgets(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	today := localToday()
+	for i := range budgets {
+		b := &budgets[i]
+		p, err := b.period(ctx, today)
+		if err != nil {
+			return err
+		}
+		for _, threshold := range b.Thresholds {
+			if p.Percent < float64(threshold) {
+				break
+			}
+			alert := budgetAlert{
+				UserID:      userID,
+				BudgetID:    b.ID,
+				BudgetName:  b.Name,
+				PeriodStart: p.Start,
+				Threshold:   threshold,
+				Budgeted:    p.Budgeted,
+				Spent:       p.Spent,
+				Percent:     p.Percent,
+				CreatedAt:   time.Now().UTC(),
+			}
+			res, err := collection("budget_alerts").UpdateOne(ctx,
+				bson.M{"budget_id": b.ID, "period_start": p.Start, "threshold": threshold},
+				bson.M{"$setOnInsert": alert},
+				options.Update().SetUpsert(true),
+			)
+			if err != nil {
+				return err
+			}
+			if res.UpsertedCount > 0 {
+				log.Printf("Budget %s (%s) of user %s reached %d%%: %.2f of %.2f %s\n",
+					b.ID.Hex(), b.Name, userID, threshold, p.Spent, p.Budgeted, b.Currency)
+			}
+		}
+	}
+	return nil
+}
+
+func bindBudget(c *gin.Context) (*budgetRequest, bool) {
+	var req budgetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err := req.validate(); err != nil {
+		renderError(c, err)
+		return nil, false
+	}
+	return &req, true
+}
+
+// ownedBudget loads the caller's budget named by the :id path parameter and
+// renders a 404 when it does not exist.
+func ownedBudget(c *gin.Context) (*budget, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "budget not found"})
+		return nil, false
+	}
+
+	var b budget
+	err = collection("budgets").FindOne(c.Request.Context(), bson.M{"_id": id, "user_id": currentPrincipal(c).Subject}).Decode(&b)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "budget not found"})
+		return nil, false
+	}
+	if err != nil {
+		renderError(c, err)
+		return nil, false
+	}
+	return &b, true
+}
+
+type budgetWithPeriod struct {
+	budget
+	Current *budgetPeriod `json:"current_period"`
+}
+
+func withCurrentPeriod(ctx context.Context, b *budget) (*budgetWithPeriod, error) {
+	p, err := b.period(ctx, localToday())
+	if err != nil {
+		return nil, err
+	}
+	return &budgetWithPeriod{budget: *b, Current: p}, nil
+}
+
+func createBudget(c *gin.Context) {
+	req, ok := bindBudget(c)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	b := budget{
+		UserID:         currentPrincipal(c).Subject,
+		Name:           req.Name,
+		Period:         req.Period,
+		Amount:         req.Amount,
+		Currency:       req.Currency,
+		CustomCategory: req.CustomCategory,
+		PlaidCategory:  req.PlaidCategory,
+		Thresholds:     req.Thresholds,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	res, err := collection("budgets").InsertOne(c.Request.Context(), b)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	b.ID = res.InsertedID.(primitive.ObjectID)
+
+	c.JSON(http.StatusCreated, b)
+}
+
+// getBudgets lists the caller's budgets with spend in their current period.
+func getBudgets(c *gin.Context) {
+	ctx := c.Request.Context()
+	all, err := listBudgets(ctx, currentPrincipal(c).Subject)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	budgets := make([]*budgetWithPeriod, 0, len(all))
+	for i := range all {
+		b, err := withCurrentPeriod(ctx, &all[i])
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		budgets = append(budgets, b)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"budgets": budgets})
+}
+
+func getBudget(c *gin.Context) {
+	b, ok := ownedBudget(c)
+	if !ok {
+		return
+	}
+
+	res, err := withCurrentPeriod(c.Request.Context(), b)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func updateBudget(c *gin.Context) {
+	b, ok := ownedBudget(c)
+	if !ok {
+		return
+	}
+	req, ok := bindBudget(c)
+	if !ok {
+		return
+	}
+
+	b.Name = req.Name
+	b.Period = req.Period
+	b.Amount = req.Amount
+	b.Currency = req.Currency
+	b.CustomCategory = req.CustomCategory
+	b.PlaidCategory = req.PlaidCategory
+	b.Thresholds = req.Thresholds
+	b.UpdatedAt = time.Now().UTC()
+	if _, err := collection("budgets").ReplaceOne(c.Request.Context(), bson.M{"_id": b.ID}, b); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, b)
+}
+
+// deleteBudget removes the budget and its alerts.
+func deleteBudget(c *gin.Context) {
+	ctx := c.Request.Context()
+	b, ok := ownedBudget(c)
+	if !ok {
+		return
+	}
+
+	if _, err := collection("budget_alerts").DeleteMany(ctx, bson.M{"budget_id": b.ID}); err != nil {
+		renderError(c, err)
+		return
+	}
+	if _, err := collection("budgets").DeleteOne(ctx, bson.M{"_id": b.ID}); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// budgetPeriods returns spend against the budget for its last periods, the
+// current one first. count defaults to 6.
+func budgetPeriods(c *gin.Context) {
+	ctx := c.Request.Context()
+	b, ok := ownedBudget(c)
+	if !ok {
+		return
+	}
+
+	count := 6
+	if v := c.Query("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 60 {
+			renderError(c, invalidf("count must be between 1 and 60"))
+			return
+		}
+		count = n
+	}
+
+	periods := make([]*budgetPeriod, 0, count)
+	day := localToday()
+	for i := 0; i < count; i++ {
+		p, err := b.period(ctx, day)
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		periods = append(periods, p)
+		start, _ := b.periodAt(day)
+		day = start.AddDate(0, 0, -1)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"budget":  b,
+		"periods": periods,
+	})
+}
+
+// listBudgetAlerts returns the caller's budget alerts, most recent first.
+func listBudgetAlerts(c *gin.Context) {
+	ctx := c.Request.Context()
+	filter := bson.M{"user_id": currentPrincipal(c).Subject}
+	if v := c.Query("budget_id"); v != "" {
+		id, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			renderError(c, invalidf("budget_id is not a valid id"))
+			return
+		}
+		filter["budget_id"] = id
+	}
+
+	curr, err := collection("budget_alerts").Find(ctx, filter,
+		options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(500),
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	alerts := make([]budgetAlert, 0)
+	if err := curr.All(ctx, &alerts); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"alerts": alerts})
+}
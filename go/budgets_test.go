@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBudgetPeriodAt(t *testing.T) {
+	tests := []struct {
+		period     string
+		day        time.Time
+		start, end string
+	}{
+		// 2024-03-03 is a Sunday and ends the week that started on Monday.
+		{budgetWeekly, time.Date(2024, 3, 3, 23, 59, 0, 0, time.UTC), "2024-02-26", "2024-03-03"},
+		{budgetWeekly, time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), "2024-03-04", "2024-03-10"},
+		{budgetWeekly, time.Date(2024, 12, 31, 12, 0, 0, 0, time.UTC), "2024-12-30", "2025-01-05"},
+		{budgetMonthly, time.Date(2024, 2, 29, 18, 0, 0, 0, time.UTC), "2024-02-01", "2024-02-29"},
+		{budgetMonthly, time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC), "2023-02-01", "2023-02-28"},
+		{budgetMonthly, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), "2024-01-01", "2024-01-31"},
+		{budgetMonthly, time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC), "2024-12-01", "2024-12-31"},
+	}
+	for _, tt := range tests {
+		b := budget{Period: tt.period}
+		start, end := b.periodAt(tt.day)
+		if got := start.Format("2006-01-02"); got != tt.start {
+			t.Errorf("%s period of %s starts %s, want %s", tt.period, tt.day, got, tt.start)
+		}
+		if got := end.Format("2006-01-02"); got != tt.end {
+			t.Errorf("%s period of %s ends %s, want %s", tt.period, tt.day, got, tt.end)
+		}
+	}
+}
+
+func TestBudgetRequestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		req  budgetRequest
+		ok   bool
+	}{
+		{"custom category", budgetRequest{Name: "Coffee", Period: "Weekly", Amount: 20, CustomCategory: "Coffee"}, true},
+		{"plaid category", budgetRequest{Name: "Food", Period: "monthly", Amount: 400, PlaidCategory: []string{"Food and Drink"}}, true},
+		{"both categories", budgetRequest{Name: "Food", Period: "monthly", Amount: 400, CustomCategory: "Food", PlaidCategory: []string{"Food and Drink"}}, false},
+		{"no category", budgetRequest{Name: "Food", Period: "monthly", Amount: 400}, false},
+		{"unknown period", budgetRequest{Name: "Food", Period: "yearly", Amount: 400, CustomCategory: "Food"}, false},
+		{"zero amount", budgetRequest{Name: "Food", Period: "monthly", CustomCategory: "Food"}, false},
+		{"bad threshold", budgetRequest{Name: "Food", Period: "monthly", Amount: 400, CustomCategory: "Food", Thresholds: []int{0}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.req.validate(); (err == nil) != tt.ok {
+				t.Errorf("validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
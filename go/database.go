@@ -7,8 +7,10 @@ import (
 
 	"github.com/plaid/plaid-go/plaid"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
 const (
@@ -16,20 +18,28 @@ const (
 	connStr       = "mongodb+srv://clusterdevopsexperts.lujoh.mongodb.net/myFirstDatabase?authSource=%24external&authMechanism=MONGODB-X509&retryWrites=true&w=majority&tlsCertificateKeyFile=" + mongoUserCert
 )
 
+const databaseName = "plaid-trans"
+
 var mongoCli *mongo.Client
 
-func init() {
+func collection(name string) *mongo.Collection {
+	return mongoCli.Database(databaseName).Collection(name)
+}
+
+// connectMongo creates the MongoDB client. Invalid configuration is fatal; an
+// unreachable server is only logged here and left to the readiness checks.
+func connectMongo() {
 
 	var err error
 
-	mongoCli, err = mongo.NewClient(options.Client().ApplyURI(connStr))
+	mongoCli, err = mongo.NewClient(options.Client().ApplyURI(connStr).SetMonitor(otelmongo.NewMonitor()))
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Println("Created MongoDB client")
 
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	//defer cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
 	err = mongoCli.Connect(ctx)
 
@@ -37,9 +47,8 @@ func init() {
 		log.Fatal(err)
 	}
 	log.Println("Connected to MongoDB")
-	//defer mongoCli.Disconnect(ctx)
 
-	err = mongoCli.Ping(ctx, nil)
+	err = pingMongo(ctx)
 	if err != nil {
 		log.Println("No connection to MongoDB")
 		return
@@ -47,64 +56,361 @@ func init() {
 
 	log.Println("Ping MongoDB successful")
 
+	if err := ensureIndexes(ctx); err != nil {
+		log.Println("Error creating MongoDB indexes", err)
+	}
+}
+
+// indexes lists the secondary indexes of each collection.
+var indexes = map[string][]mongo.IndexModel{
+	"api_keys": {
+		{Keys: bson.D{{Key: "key_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"items": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	},
+	"accounts": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "item_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "accountid", Value: 1}}},
+	},
+	"transactions": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "item_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "date", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "transactionid", Value: 1}}},
+	},
+	"duplicate_candidates": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "pair_key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "status", Value: 1}, {Key: "original.date", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "duplicate.transaction_id", Value: 1}}},
+	},
+	"superseded_transactions": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "item_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "transactionid", Value: 1}}},
+	},
+	"payment_recipients": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "fingerprint", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"payments": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "updated_at", Value: 1}}},
+	},
+	"transfers": {
+		{Keys: bson.D{{Key: "transfer_id", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	"investment_transactions": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "item_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "date", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "security_id", Value: 1}, {Key: "date", Value: -1}}},
+	},
+	"holdings_snapshots": {
+		{Keys: bson.D{{Key: "account_id", Value: 1}, {Key: "security_id", Value: 1}, {Key: "date", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "date", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "security_id", Value: 1}, {Key: "date", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "item_id", Value: 1}}},
+	},
+	"liabilities": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "item_id", Value: 1}}},
+	},
+	"account_numbers": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "item_id", Value: 1}}},
+	},
+	"balance_snapshots": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "date", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "item_id", Value: 1}}},
+	},
+	"category_rules": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "priority", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	"budgets": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	"budget_alerts": {
+		{Keys: bson.D{{Key: "budget_id", Value: 1}, {Key: "period_start", Value: 1}, {Key: "threshold", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	},
+	"identities": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "item_id", Value: 1}}},
+	},
+	"identity_match_checks": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	},
+	"asset_reports": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+}
+
+func ensureIndexes(ctx context.Context) error {
+	for name, models := range indexes {
+		if _, err := collection(name).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pingMongo(ctx context.Context) error {
+	return mongoCli.Ping(ctx, nil)
+}
+
+// storedAccount is an account as saved in MongoDB, tagged with the user and
+// item it was fetched for.
+type storedAccount struct {
+	plaid.AccountBase `bson:",inline"`
+	UserID            string    `bson:"user_id"`
+	ItemID            string    `bson:"item_id"`
+	UpdatedAt         time.Time `bson:"updated_at"`
+
+	// Mask is Plaid's mask of the account number, kept as a plain string
+	// for matching.
+	Mask string `bson:"account_mask"`
+}
+
+// storedTransaction is a transaction as saved in MongoDB, tagged with the
+// user and item it was fetched for.
+type storedTransaction struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty"`
+	plaid.Transaction `bson:",inline"`
+	UserID            string `bson:"user_id"`
+	ItemID            string `bson:"item_id"`
+
+	// Merchant is Plaid's merchant_name and Currency its ISO or unofficial
+	// currency code, kept as plain strings for matching and aggregation.
+	Merchant string `bson:"merchant_name,omitempty"`
+	Currency string `bson:"currency,omitempty"`
+
+	// PendingTransactionID is Plaid's pending_transaction_id of a posted
+	// transaction, and Reconciliation its link to that pending transaction.
+	PendingTransactionID string                 `bson:"pending_transaction_id,omitempty"`
+	Reconciliation       *pendingReconciliation `bson:"reconciliation,omitempty"`
+
+	// CustomCategory and Tags are set by the categorization rule RuleID.
+	CustomCategory string              `bson:"custom_category,omitempty"`
+	Tags           []string            `bson:"tags,omitempty"`
+	RuleID         *primitive.ObjectID `bson:"rule_id,omitempty"`
+
+	// DuplicateOf is the ID of the transaction of another item the user
+	// merged this one into.
+	DuplicateOf string `bson:"duplicate_of,omitempty"`
 }
 
-func saveToDb(ctx context.Context, accounts []plaid.AccountBase, transactions []plaid.Transaction) error {
+func saveToDb(ctx context.Context, it *storedItem, accounts []plaid.AccountBase, transactions []plaid.Transaction) error {
 
 	log.Println("Saving response")
 
-	res, err := saveAccounts(ctx, accounts)
+	savedAccounts, err := saveAccounts(ctx, it, accounts)
 	if err != nil {
 		log.Println("Error saving accounts", err)
 	} else {
-		log.Println("Accounts inserted: ", len(res.InsertedIDs))
+		log.Println("Accounts saved: ", savedAccounts)
 	}
 
-	res, err = saveTransactions(ctx, transactions)
+	saved, err := saveTransactions(ctx, it, transactions)
 	if err != nil {
 		log.Println("Error saving transactions", err)
 	} else {
-		log.Println("Transactions inserted: ", len(res.InsertedIDs))
+		log.Println("Transactions saved: ", saved)
+	}
+
+	if err := checkBudgetAlerts(ctx, it.UserID); err != nil {
+		log.Println("Error checking budgets", err)
 	}
 
 	return nil
 }
 
-func saveAccounts(ctx context.Context, accounts []plaid.AccountBase) (*mongo.InsertManyResult, error) {
-	accountsCollection := mongoCli.Database("plaid-trans").Collection("accounts")
+// saveAccounts replaces the stored accounts of the item and records a
+// snapshot of their balances. Accounts are upserted by account ID, and
+// only then are the ones the item no longer reports removed, so that a
+// failed write never loses the accounts already stored.
+func saveAccounts(ctx context.Context, it *storedItem, accounts []plaid.AccountBase) (int, error) {
+	if len(accounts) == 0 {
+		return 0, nil
+	}
+	accountsCollection := collection("accounts")
 
-	var data []interface{}
+	now := time.Now().UTC()
+	models := make([]mongo.WriteModel, 0, len(accounts))
+	ids := make([]string, 0, len(accounts))
 	for _, a := range accounts {
-		data = append(data, a)
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"user_id": it.UserID, "accountid": a.AccountId}).
+			SetReplacement(storedAccount{AccountBase: a, UserID: it.UserID, ItemID: it.ItemID, UpdatedAt: now, Mask: a.GetMask()}).
+			SetUpsert(true))
+		ids = append(ids, a.AccountId)
+	}
+	if _, err := accountsCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		return 0, err
+	}
+	if _, err := accountsCollection.DeleteMany(ctx, bson.M{
+		"user_id":   it.UserID,
+		"item_id":   it.ItemID,
+		"accountid": bson.M{"$nin": ids},
+	}); err != nil {
+		return 0, err
 	}
 
-	return accountsCollection.InsertMany(ctx, data)
+	if err := recordBalanceSnapshots(ctx, it, accounts, balanceSourceTransactions); err != nil {
+		return 0, err
+	}
+	if err := backfillTransactionCurrencies(ctx, it, accounts); err != nil {
+		return 0, err
+	}
+	return len(accounts), nil
 }
 
-func saveTransactions(ctx context.Context, transactions []plaid.Transaction) (*mongo.InsertManyResult, error) {
-	transactionsCollection := mongoCli.Database("plaid-trans").Collection("transactions")
+// transactionCurrency is the ISO currency code of the transaction, or its
+// unofficial code for currencies such as cryptocurrencies.
+func transactionCurrency(t *plaid.Transaction) string {
+	if code := t.GetIsoCurrencyCode(); code != "" {
+		return code
+	}
+	return t.GetUnofficialCurrencyCode()
+}
 
-	var data []interface{}
+// backfillTransactionCurrencies sets the currency of the item's stored
+// transactions saved before it was kept as a plain field. Plaid's nullable
+// currency codes do not survive bson, so the account's currency is used.
+func backfillTransactionCurrencies(ctx context.Context, it *storedItem, accounts []plaid.AccountBase) error {
+	for _, a := range accounts {
+		code := a.Balances.GetIsoCurrencyCode()
+		if code == "" {
+			code = a.Balances.GetUnofficialCurrencyCode()
+		}
+		if code == "" {
+			continue
+		}
+		if _, err := collection("transactions").UpdateMany(ctx,
+			bson.M{"user_id": it.UserID, "item_id": it.ItemID, "accountid": a.AccountId, "currency": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"currency": code}},
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveTransactions stores the transactions, categorized with the user's
+// rules, replacing stored copies of the same transactions. Posted
+// transactions are linked to their pending predecessors, which are moved
+// out of the collection together with pending transactions that expired.
+// Transactions that look like those of another item are flagged as
+// possible duplicates.
+func saveTransactions(ctx context.Context, it *storedItem, transactions []plaid.Transaction) (int, error) {
+	transactionsCollection := collection("transactions")
+	if len(transactions) == 0 {
+		return 0, nil
+	}
+
+	rules, err := loadCategoryRules(ctx, it.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	stored := make([]storedTransaction, 0, len(transactions))
+	ids := make([]string, 0, len(transactions))
 	for _, t := range transactions {
-		data = append(data, t)
+		st := storedTransaction{
+			Transaction:          t,
+			UserID:               it.UserID,
+			ItemID:               it.ItemID,
+			Merchant:             t.GetMerchantName(),
+			Currency:             transactionCurrency(&t),
+			PendingTransactionID: t.GetPendingTransactionId(),
+		}
+		categorize(rules, &st)
+		stored = append(stored, st)
+		ids = append(ids, t.TransactionId)
+	}
+	if err := linkPendingPredecessors(ctx, it.UserID, stored); err != nil {
+		return 0, err
+	}
+	if err := markMergedDuplicates(ctx, it.UserID, stored); err != nil {
+		return 0, err
+	}
+
+	if err := dropDuplicateCopies(ctx, it.UserID, ids); err != nil {
+		return 0, err
+	}
+	models := make([]mongo.WriteModel, 0, len(stored))
+	for _, st := range stored {
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"user_id": it.UserID, "transactionid": st.TransactionId}).
+			SetReplacement(st).
+			SetUpsert(true))
+	}
+	if _, err := transactionsCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		return 0, err
 	}
 
-	return transactionsCollection.InsertMany(ctx, data)
+	posted, expired, err := supersedePending(ctx, it, stored)
+	if err != nil {
+		return 0, err
+	}
+	if posted > 0 || expired > 0 {
+		log.Printf("Item %s: %d pending transactions posted, %d expired\n", it.ItemID, posted, expired)
+	}
+
+	flagged, err := detectDuplicates(ctx, it, stored)
+	if err != nil {
+		return 0, err
+	}
+	if flagged > 0 {
+		log.Printf("Item %s: %d possible duplicate transactions flagged\n", it.ItemID, flagged)
+	}
+	return len(stored), nil
+}
+
+// dropDuplicateCopies deletes all but one stored copy of each of the
+// transactions, left by earlier versions that inserted every transaction
+// again on each fetch.
+func dropDuplicateCopies(ctx context.Context, userID string, ids []string) error {
+	curr, err := collection("transactions").Find(ctx,
+		bson.M{"user_id": userID, "transactionid": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"_id": 1, "transactionid": 1}),
+	)
+	if err != nil {
+		return err
+	}
+	var docs []struct {
+		ID            primitive.ObjectID `bson:"_id"`
+		TransactionID string             `bson:"transactionid"`
+	}
+	if err := curr.All(ctx, &docs); err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	var extra []primitive.ObjectID
+	for _, d := range docs {
+		if seen[d.TransactionID] {
+			extra = append(extra, d.ID)
+		}
+		seen[d.TransactionID] = true
+	}
+	if len(extra) == 0 {
+		return nil
+	}
+	_, err = collection("transactions").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": extra}})
+	return err
 }
 
-func fetchAllTransactions(ctx context.Context) ([]plaid.Transaction, error) {
-	tc := mongoCli.Database("plaid-trans").Collection("transactions")
+// fetchAllTransactions returns every stored transaction owned by userID.
+func fetchAllTransactions(ctx context.Context, userID string) ([]storedTransaction, error) {
+	tc := collection("transactions")
 
-	curr, err := tc.Find(ctx, bson.M{})
+	curr, err := tc.Find(ctx, bson.M{"user_id": userID})
 	if err != nil {
 		return nil, err
 	}
 	defer curr.Close(context.Background())
 
-	all := make([]plaid.Transaction, 0)
+	all := make([]storedTransaction, 0)
 
 	for curr.Next(context.Background()) {
-		var t plaid.Transaction
+		var t storedTransaction
 		if err := curr.Decode(&t); err != nil {
 			log.Println(err)
 		} else {
@@ -116,19 +422,20 @@ func fetchAllTransactions(ctx context.Context) ([]plaid.Transaction, error) {
 
 }
 
-func fetchAllAccounts(ctx context.Context) ([]plaid.AccountBase, error) {
-	ac := mongoCli.Database("plaid-trans").Collection("accounts")
+// fetchAllAccounts returns every stored account owned by userID.
+func fetchAllAccounts(ctx context.Context, userID string) ([]storedAccount, error) {
+	ac := collection("accounts")
 
-	curr, err := ac.Find(ctx, bson.M{})
+	curr, err := ac.Find(ctx, bson.M{"user_id": userID})
 	if err != nil {
 		return nil, err
 	}
 	defer curr.Close(context.Background())
 
-	all := make([]plaid.AccountBase, 0)
+	all := make([]storedAccount, 0)
 
 	for curr.Next(context.Background()) {
-		var a plaid.AccountBase
+		var a storedAccount
 		if err := curr.Decode(&a); err != nil {
 			log.Println(err)
 		} else {
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The same card linked through two institutions, or linked again as a new
+// item, reports every transaction twice under different IDs. Posted
+// transactions of different items with the same amount and currency, dates
+// a few days apart, similar names and accounts with the same mask are
+// flagged as duplicate candidates. Nothing is hidden until the user merges
+// a candidate; the merged transaction then carries duplicate_of and is left
+// out of reports, budgets, recurring detection and exports.
+
+// Duplicate candidate statuses.
+const (
+	duplicateCandidate = "candidate"
+	duplicateMerged    = "merged"
+	duplicateRejected  = "rejected"
+)
+
+const (
+	// Institutions post the same charge up to this many days apart.
+	duplicateDateWindowDays = 3
+	// Names must share at least this share of the words of the shorter one.
+	duplicateNameSimilarity = 0.6
+)
+
+// duplicateSide is one of the two transactions of a candidate pair.
+type duplicateSide struct {
+	TransactionID string `bson:"transaction_id" json:"transaction_id"`
+	ItemID        string `bson:"item_id" json:"item_id"`
+	AccountID     string `bson:"account_id" json:"account_id"`
+	Mask          string `bson:"mask" json:"mask"`
+	Name          string `bson:"name" json:"name"`
+	Date          string `bson:"date" json:"date"`
+}
+
+// duplicatePair is a candidate pair. Merging it hides Duplicate behind
+// Original; the side stored first is the original unless the user keeps
+// the other one.
+type duplicatePair struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID     string             `bson:"user_id" json:"-"`
+	PairKey    string             `bson:"pair_key" json:"-"`
+	Original   duplicateSide      `bson:"original" json:"original"`
+	Duplicate  duplicateSide      `bson:"duplicate" json:"duplicate"`
+	Amount     float64            `bson:"amount" json:"amount"`
+	Currency   string             `bson:"currency" json:"currency"`
+	DaysApart  int                `bson:"days_apart" json:"days_apart"`
+	Similarity float64            `bson:"similarity" json:"similarity"`
+	Status     string             `bson:"status" json:"status"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	ResolvedAt *time.Time         `bson:"resolved_at,omitempty" json:"resolved_at,omitempty"`
+}
+
+// duplicatePairKey identifies a pair of transactions in either order.
+func duplicatePairKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "|" + b
+}
+
+// nameSimilarity is the share of the words of the shorter normalized name
+// that the other one contains, so that "SQ *BLUE BOTTLE" and "Blue Bottle
+// Coffee" match.
+func nameSimilarity(a, b string) float64 {
+	wa, wb := strings.Fields(normalizeMerchant(a)), strings.Fields(normalizeMerchant(b))
+	if len(wa) == 0 || len(wb) == 0 {
+		return 0
+	}
+	if len(wa) > len(wb) {
+		wa, wb = wb, wa
+	}
+	words := map[string]bool{}
+	for _, w := range wb {
+		words[w] = true
+	}
+	shared := 0
+	for _, w := range wa {
+		if words[w] {
+			shared++
+			delete(words, w)
+		}
+	}
+	return float64(shared) / float64(len(wa))
+}
+
+func transactionDisplayName(t *storedTransaction) string {
+	if t.Merchant != "" {
+		return t.Merchant
+	}
+	return t.Name
+}
+
+// accountMasks returns the mask of every stored account of the user by
+// account ID.
+func accountMasks(ctx context.Context, userID string) (map[string]string, error) {
+	curr, err := collection("accounts").Find(ctx, bson.M{"user_id": userID, "account_mask": bson.M{"$ne": ""}})
+	if err != nil {
+		return nil, err
+	}
+	var accounts []storedAccount
+	if err := curr.All(ctx, &accounts); err != nil {
+		return nil, err
+	}
+	masks := make(map[string]string, len(accounts))
+	for _, a := range accounts {
+		masks[a.AccountId] = a.Mask
+	}
+	return masks, nil
+}
+
+// daysApart is the number of days between two YYYY-MM-DD dates.
+func daysApart(a, b string) (int, bool) {
+	da, err := time.Parse("2006-01-02", a)
+	if err != nil {
+		return 0, false
+	}
+	db, err := time.Parse("2006-01-02", b)
+	if err != nil {
+		return 0, false
+	}
+	return int(math.Abs(da.Sub(db).Hours() / 24)), true
+}
+
+// matchDuplicate tells whether other looks like the same transaction as t
+// reported through another item, and how similar their names are.
+func matchDuplicate(t, other *storedTransaction, masks map[string]string) (int, float64, bool) {
+	if t.ItemID == other.ItemID || t.Amount != other.Amount || t.Currency != other.Currency {
+		return 0, 0, false
+	}
+	if masks[t.AccountId] != masks[other.AccountId] {
+		return 0, 0, false
+	}
+	days, ok := daysApart(t.Date, other.Date)
+	if !ok || days > duplicateDateWindowDays {
+		return 0, 0, false
+	}
+	similarity := nameSimilarity(transactionDisplayName(t), transactionDisplayName(other))
+	if similarity < duplicateNameSimilarity {
+		return 0, 0, false
+	}
+	return days, similarity, true
+}
+
+// detectDuplicates flags the posted transactions of the item's batch that
+// look like transactions already stored for another item. Pairs already
+// flagged, merged or rejected are left as they are. It returns how many new
+// candidates were flagged.
+func detectDuplicates(ctx context.Context, it *storedItem, batch []storedTransaction) (int, error) {
+	masks, err := accountMasks(ctx, it.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	var candidates []*storedTransaction
+	var amounts []float32
+	var earliest, latest string
+	for i := range batch {
+		t := &batch[i]
+		if t.Pending || t.DuplicateOf != "" || masks[t.AccountId] == "" {
+			continue
+		}
+		candidates = append(candidates, t)
+		amounts = append(amounts, t.Amount)
+		if earliest == "" || t.Date < earliest {
+			earliest = t.Date
+		}
+		if t.Date > latest {
+			latest = t.Date
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+	from, err := time.Parse("2006-01-02", earliest)
+	if err != nil {
+		return 0, err
+	}
+	to, err := time.Parse("2006-01-02", latest)
+	if err != nil {
+		return 0, err
+	}
+
+	curr, err := collection("transactions").Find(ctx, bson.M{
+		"user_id":      it.UserID,
+		"item_id":      bson.M{"$ne": it.ItemID},
+		"pending":      false,
+		"duplicate_of": bson.M{"$exists": false},
+		"amount":       bson.M{"$in": amounts},
+		"date": bson.M{
+			"$gte": from.AddDate(0, 0, -duplicateDateWindowDays).Format("2006-01-02"),
+			"$lte": to.AddDate(0, 0, duplicateDateWindowDays).Format("2006-01-02"),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var others []storedTransaction
+	if err := curr.All(ctx, &others); err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	flagged := 0
+	for _, t := range candidates {
+		for i := range others {
+			o := &others[i]
+			days, similarity, ok := matchDuplicate(t, o, masks)
+			if !ok {
+				continue
+			}
+			pair := duplicatePair{
+				UserID:     it.UserID,
+				PairKey:    duplicatePairKey(o.TransactionId, t.TransactionId),
+				Original:   duplicateSide{o.TransactionId, o.ItemID, o.AccountId, masks[o.AccountId], o.Name, o.Date},
+				Duplicate:  duplicateSide{t.TransactionId, t.ItemID, t.AccountId, masks[t.AccountId], t.Name, t.Date},
+				Amount:     toFloat64(t.Amount),
+				Currency:   t.Currency,
+				DaysApart:  days,
+				Similarity: roundCents(similarity),
+				Status:     duplicateCandidate,
+				CreatedAt:  now,
+			}
+			res, err := collection("duplicate_candidates").UpdateOne(ctx,
+				bson.M{"user_id": it.UserID, "pair_key": pair.PairKey},
+				bson.M{"$setOnInsert": pair},
+				options.Update().SetUpsert(true),
+			)
+			if err != nil {
+				return flagged, err
+			}
+			if res.UpsertedCount > 0 {
+				flagged++
+			}
+		}
+	}
+	return flagged, nil
+}
+
+// markMergedDuplicates sets duplicate_of on the transactions of a batch
+// that the user merged into another one, as stored copies are replaced on
+// every fetch.
+func markMergedDuplicates(ctx context.Context, userID string, transactions []storedTransaction) error {
+	ids := make([]string, 0, len(transactions))
+	for i := range transactions {
+		ids = append(ids, transactions[i].TransactionId)
+	}
+
+	curr, err := collection("duplicate_candidates").Find(ctx, bson.M{
+		"user_id":                  userID,
+		"status":                   duplicateMerged,
+		"duplicate.transaction_id": bson.M{"$in": ids},
+	})
+	if err != nil {
+		return err
+	}
+	var pairs []duplicatePair
+	if err := curr.All(ctx, &pairs); err != nil {
+		return err
+	}
+	mergedInto := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		mergedInto[p.Duplicate.TransactionID] = p.Original.TransactionID
+	}
+
+	for i := range transactions {
+		transactions[i].DuplicateOf = mergedInto[transactions[i].TransactionId]
+	}
+	return nil
+}
+
+// releaseItemDuplicates drops the candidate pairs involving the item, which
+// is about to be removed. Transactions of other items merged into one of
+// the item's transactions are shown again, as their original goes away.
+func releaseItemDuplicates(ctx context.Context, it *storedItem) error {
+	curr, err := collection("duplicate_candidates").Find(ctx, bson.M{
+		"user_id":          it.UserID,
+		"status":           duplicateMerged,
+		"original.item_id": it.ItemID,
+	})
+	if err != nil {
+		return err
+	}
+	var pairs []duplicatePair
+	if err := curr.All(ctx, &pairs); err != nil {
+		return err
+	}
+	if len(pairs) > 0 {
+		ids := make([]string, 0, len(pairs))
+		for _, p := range pairs {
+			ids = append(ids, p.Duplicate.TransactionID)
+		}
+		if _, err := collection("transactions").UpdateMany(ctx,
+			bson.M{"user_id": it.UserID, "transactionid": bson.M{"$in": ids}},
+			bson.M{"$unset": bson.M{"duplicate_of": ""}},
+		); err != nil {
+			return err
+		}
+	}
+
+	_, err = collection("duplicate_candidates").DeleteMany(ctx, bson.M{
+		"user_id": it.UserID,
+		"$or": bson.A{
+			bson.M{"original.item_id": it.ItemID},
+			bson.M{"duplicate.item_id": it.ItemID},
+		},
+	})
+	return err
+}
+
+// listDuplicates lists the caller's duplicate pairs with the given status,
+// candidate by default.
+func listDuplicates(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	status := c.DefaultQuery("status", duplicateCandidate)
+	switch status {
+	case duplicateCandidate, duplicateMerged, duplicateRejected:
+	default:
+		renderError(c, invalidf("status must be one of candidate, merged or rejected"))
+		return
+	}
+
+	curr, err := collection("duplicate_candidates").Find(ctx,
+		bson.M{"user_id": currentPrincipal(c).Subject, "status": status},
+		options.Find().SetSort(bson.D{{Key: "original.date", Value: -1}, {Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	pairs := make([]duplicatePair, 0)
+	if err := curr.All(ctx, &pairs); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"duplicates": pairs})
+}
+
+// backfillAccountMasks stores the masks of the accounts of the user's items
+// saved before masks were kept, reading them from /accounts/get. Items Plaid
+// cannot be reached for are skipped.
+func backfillAccountMasks(ctx context.Context, userID string) error {
+	missing, err := collection("accounts").Distinct(ctx, "item_id", bson.M{
+		"user_id":      userID,
+		"account_mask": bson.M{"$exists": false},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range missing {
+		itemID, _ := id.(string)
+		it, err := findItem(ctx, userID, itemID)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		accountsGetResp, _, err := client.PlaidApi.AccountsGet(ctx).AccountsGetRequest(
+			*plaid.NewAccountsGetRequest(it.AccessToken),
+		).Execute()
+		if err != nil {
+			log.Printf("Error reading account masks of item %s: %v\n", itemID, err)
+			continue
+		}
+		for _, a := range accountsGetResp.GetAccounts() {
+			if _, err := collection("accounts").UpdateMany(ctx,
+				bson.M{"user_id": userID, "item_id": itemID, "accountid": a.AccountId},
+				bson.M{"$set": bson.M{"account_mask": a.GetMask()}},
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scanDuplicates looks for duplicates among all of the caller's stored
+// transactions, such as those saved before the detector existed. Account
+// masks missing from such data are read from Plaid first.
+func scanDuplicates(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := currentPrincipal(c).Subject
+
+	if err := backfillAccountMasks(ctx, userID); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	curr, err := collection("transactions").Find(ctx, bson.M{"user_id": userID, "pending": false})
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	var all []storedTransaction
+	if err := curr.All(ctx, &all); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	byItem := map[string][]storedTransaction{}
+	for _, t := range all {
+		byItem[t.ItemID] = append(byItem[t.ItemID], t)
+	}
+	itemIDs := make([]string, 0, len(byItem))
+	for id := range byItem {
+		itemIDs = append(itemIDs, id)
+	}
+	sort.Strings(itemIDs)
+
+	flagged := 0
+	for _, id := range itemIDs {
+		n, err := detectDuplicates(ctx, &storedItem{ItemID: id, UserID: userID}, byItem[id])
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		flagged += n
+	}
+
+	c.JSON(http.StatusOK, gin.H{"flagged": flagged})
+}
+
+// duplicateID parses the :id path parameter and renders a 404 for malformed
+// IDs.
+func duplicateID(c *gin.Context) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "duplicate not found"})
+		return id, false
+	}
+	return id, true
+}
+
+// findDuplicatePair loads the caller's pair named by the :id path
+// parameter, rendering a 404 when there is none.
+func findDuplicatePair(c *gin.Context) (*duplicatePair, bool) {
+	id, ok := duplicateID(c)
+	if !ok {
+		return nil, false
+	}
+	var pair duplicatePair
+	err := collection("duplicate_candidates").FindOne(c.Request.Context(),
+		bson.M{"_id": id, "user_id": currentPrincipal(c).Subject},
+	).Decode(&pair)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "duplicate not found"})
+		return nil, false
+	}
+	if err != nil {
+		renderError(c, err)
+		return nil, false
+	}
+	return &pair, true
+}
+
+// unmergeDuplicate shows both transactions of the pair again.
+func unmergeDuplicate(ctx context.Context, p *duplicatePair) error {
+	_, err := collection("transactions").UpdateMany(ctx,
+		bson.M{"user_id": p.UserID, "$or": bson.A{
+			bson.M{"transactionid": p.Original.TransactionID, "duplicate_of": p.Duplicate.TransactionID},
+			bson.M{"transactionid": p.Duplicate.TransactionID, "duplicate_of": p.Original.TransactionID},
+		}},
+		bson.M{"$unset": bson.M{"duplicate_of": ""}},
+	)
+	return err
+}
+
+// resolveDuplicate stores the pair's new status.
+func resolveDuplicate(ctx context.Context, p *duplicatePair, status string) error {
+	now := time.Now().UTC()
+	p.Status, p.ResolvedAt = status, &now
+	_, err := collection("duplicate_candidates").UpdateOne(ctx,
+		bson.M{"_id": p.ID},
+		bson.M{"$set": bson.M{
+			"original":    p.Original,
+			"duplicate":   p.Duplicate,
+			"status":      status,
+			"resolved_at": now,
+		}},
+	)
+	return err
+}
+
+type mergeDuplicateRequest struct {
+	Keep string `json:"keep"`
+}
+
+// mergeDuplicate confirms the pair as one transaction. The original is kept
+// unless keep names the other one; the other is marked duplicate_of the
+// kept one. A merged or rejected pair can be merged again.
+func mergeDuplicate(c *gin.Context) {
+	ctx := c.Request.Context()
+	pair, ok := findDuplicatePair(c)
+	if !ok {
+		return
+	}
+
+	var req mergeDuplicateRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	switch req.Keep {
+	case "", pair.Original.TransactionID:
+	case pair.Duplicate.TransactionID:
+		pair.Original, pair.Duplicate = pair.Duplicate, pair.Original
+	default:
+		renderError(c, invalidf("keep must be one of the pair's transaction IDs"))
+		return
+	}
+
+	if err := unmergeDuplicate(ctx, pair); err != nil {
+		renderError(c, err)
+		return
+	}
+	if _, err := collection("transactions").UpdateMany(ctx,
+		bson.M{"user_id": pair.UserID, "transactionid": pair.Duplicate.TransactionID},
+		bson.M{"$set": bson.M{"duplicate_of": pair.Original.TransactionID}},
+	); err != nil {
+		renderError(c, err)
+		return
+	}
+	if err := resolveDuplicate(ctx, pair, duplicateMerged); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, pair)
+}
+
+// rejectDuplicate records that the pair is two distinct transactions, so
+// it is not flagged again. Rejecting a merged pair shows both again.
+func rejectDuplicate(c *gin.Context) {
+	ctx := c.Request.Context()
+	pair, ok := findDuplicatePair(c)
+	if !ok {
+		return
+	}
+
+	if pair.Status == duplicateMerged {
+		if err := unmergeDuplicate(ctx, pair); err != nil {
+			renderError(c, err)
+			return
+		}
+	}
+	if err := resolveDuplicate(ctx, pair, duplicateRejected); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, pair)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/plaid/plaid-go/plaid"
+)
+
+func TestNameSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"SQ *BLUE BOTTLE", "Blue Bottle Coffee", 1},
+		{"Blue Bottle Coffee", "SQ *BLUE BOTTLE", 1},
+		{"NETFLIX.COM", "Netflix", 1},
+		{"Blue Bottle Coffee", "Philz Coffee", 0.5},
+		{"Uber", "Lyft", 0},
+		{"", "Lyft", 0},
+	}
+	for _, tt := range tests {
+		if got := nameSimilarity(tt.a, tt.b); !approxEqual(got, tt.want) {
+			t.Errorf("nameSimilarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDaysApart(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+		ok   bool
+	}{
+		{"2024-03-01", "2024-03-04", 3, true},
+		{"2024-03-04", "2024-03-01", 3, true},
+		{"2024-02-28", "2024-03-01", 2, true},
+		{"2024-03-01", "", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := daysApart(tt.a, tt.b)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("daysApart(%q, %q) = %d, %v, want %d, %v", tt.a, tt.b, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMatchDuplicate(t *testing.T) {
+	masks := map[string]string{"acc1": "1234", "acc2": "1234", "acc3": "9999"}
+	tx := func(item, account, name, date string, amount float32, currency string) *storedTransaction {
+		return &storedTransaction{
+			Transaction: plaid.Transaction{AccountId: account, Name: name, Date: date, Amount: amount},
+			ItemID:      item,
+			Currency:    currency,
+		}
+	}
+	original := tx("item1", "acc1", "Blue Bottle Coffee", "2024-03-01", 4.5, "USD")
+
+	tests := []struct {
+		name  string
+		other *storedTransaction
+		days  int
+		match bool
+	}{
+		{"same charge through another item", tx("item2", "acc2", "SQ *BLUE BOTTLE", "2024-03-03", 4.5, "USD"), 2, true},
+		{"same item", tx("item1", "acc1", "Blue Bottle Coffee", "2024-03-01", 4.5, "USD"), 0, false},
+		{"other amount", tx("item2", "acc2", "Blue Bottle Coffee", "2024-03-01", 5, "USD"), 0, false},
+		{"other currency", tx("item2", "acc2", "Blue Bottle Coffee", "2024-03-01", 4.5, "EUR"), 0, false},
+		{"other card", tx("item2", "acc3", "Blue Bottle Coffee", "2024-03-01", 4.5, "USD"), 0, false},
+		{"outside the date window", tx("item2", "acc2", "Blue Bottle Coffee", "2024-03-05", 4.5, "USD"), 0, false},
+		{"dissimilar names", tx("item2", "acc2", "Starbucks", "2024-03-01", 4.5, "USD"), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			days, _, ok := matchDuplicate(original, tt.other, masks)
+			if ok != tt.match {
+				t.Fatalf("match = %v, want %v", ok, tt.match)
+			}
+			if ok && days != tt.days {
+				t.Errorf("days apart = %d, want %d", days, tt.days)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+)
+
+// STARTUP_MODE decides what happens when a dependency is unavailable at
+// startup: "degrade" (default) starts anyway and reports not ready, while
+// "fail-fast" exits.
+var STARTUP_MODE = ""
+
+// PLAID_HEALTH_CACHE_TTL is how long a Plaid reachability result is reused,
+// so that frequent readiness probes do not turn into a stream of API calls.
+var PLAID_HEALTH_CACHE_TTL = time.Minute
+
+const readinessTimeout = 5 * time.Second
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+var readinessChecks []readinessCheck
+
+// registerReadinessCheck adds a dependency check to /readyz and to the
+// startup check.
+func registerReadinessCheck(name string, check func(ctx context.Context) error) {
+	readinessChecks = append(readinessChecks, readinessCheck{name: name, check: check})
+}
+
+func initHealth() {
+	STARTUP_MODE = strings.ToLower(os.Getenv("STARTUP_MODE"))
+	switch STARTUP_MODE {
+	case "":
+		STARTUP_MODE = "degrade"
+	case "degrade", "fail-fast":
+	default:
+		log.Fatalf("Unknown STARTUP_MODE %q", STARTUP_MODE)
+	}
+
+	if ttl := os.Getenv("PLAID_HEALTH_CACHE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Invalid PLAID_HEALTH_CACHE_TTL %q: %v", ttl, err)
+		}
+		PLAID_HEALTH_CACHE_TTL = d
+	}
+
+	registerReadinessCheck("mongodb", pingMongo)
+	registerReadinessCheck("plaid", cachedCheck(PLAID_HEALTH_CACHE_TTL, pingPlaid))
+}
+
+// checkStartup runs the readiness checks once and, in fail-fast mode, stops
+// the process if any of them fails.
+func checkStartup() {
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+
+	failed := false
+	for name, result := range runReadinessChecks(ctx) {
+		if result.err != nil {
+			log.Printf("Dependency %s is not available: %v\n", name, result.err)
+			failed = true
+		}
+	}
+
+	if failed && STARTUP_MODE == "fail-fast" {
+		log.Fatal("Dependencies are not available and STARTUP_MODE is fail-fast")
+	}
+	if failed {
+		log.Println("Starting in degraded mode")
+	}
+}
+
+// pingPlaid calls a cheap endpoint that needs no item to confirm Plaid is
+// reachable and accepts our credentials.
+func pingPlaid(ctx context.Context) error {
+	_, _, err := client.PlaidApi.CategoriesGet(ctx).Body(map[string]interface{}{}).Execute()
+	return err
+}
+
+// cachedCheck reuses the last result of check until ttl has passed.
+func cachedCheck(ttl time.Duration, check func(ctx context.Context) error) func(ctx context.Context) error {
+	var mu sync.Mutex
+	var checkedAt time.Time
+	var lastErr error
+
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !checkedAt.IsZero() && time.Since(checkedAt) < ttl {
+			return lastErr
+		}
+
+		lastErr = check(ctx)
+		checkedAt = time.Now()
+		return lastErr
+	}
+}
+
+type checkResult struct {
+	err      error
+	duration time.Duration
+}
+
+func runReadinessChecks(ctx context.Context) map[string]checkResult {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]checkResult, len(readinessChecks))
+
+	for _, rc := range readinessChecks {
+		wg.Add(1)
+		go func(rc readinessCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := rc.check(ctx)
+
+			mu.Lock()
+			results[rc.name] = checkResult{err: err, duration: time.Since(start)}
+			mu.Unlock()
+		}(rc)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// healthz reports that the process is up and serving requests.
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz reports whether every dependency is usable, with one entry per check.
+func readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	status := http.StatusOK
+	checks := gin.H{}
+
+	for name, result := range runReadinessChecks(ctx) {
+		check := gin.H{
+			"status":      "ok",
+			"duration_ms": result.duration.Milliseconds(),
+		}
+		if result.err != nil {
+			status = http.StatusServiceUnavailable
+			check["status"] = "failed"
+			check["error"] = describeCheckError(result.err)
+		}
+		checks[name] = check
+	}
+
+	overall := "ok"
+	if status != http.StatusOK {
+		overall = "unavailable"
+	}
+
+	c.JSON(status, gin.H{
+		"status": overall,
+		"checks": checks,
+	})
+}
+
+func describeCheckError(err error) string {
+	if plaidError, perr := plaid.ToPlaidError(err); perr == nil {
+		return plaidError.ErrorCode + ": " + plaidError.ErrorMessage
+	}
+	return err.Error()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSchedulerAlive(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		lastRun time.Time
+		lastErr error
+		ok      bool
+	}{
+		{"not run yet", time.Time{}, nil, true},
+		{"ran recently", now.Add(-time.Minute), nil, true},
+		{"last run failed", now.Add(-time.Minute), errors.New("plaid unavailable"), true},
+		{"stuck", now.Add(-3 * time.Minute), nil, false},
+	}
+
+	saved := jobs
+	defer func() { jobs = saved }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs = []*job{{name: "test", interval: time.Minute, lastRun: tt.lastRun, lastErr: tt.lastErr}}
+			if err := schedulerAlive(context.Background()); (err == nil) != tt.ok {
+				t.Errorf("schedulerAlive() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	saved := readinessChecks
+	defer func() { readinessChecks = saved }()
+
+	tests := []struct {
+		name   string
+		errs   map[string]error
+		status int
+	}{
+		{"all ok", map[string]error{"mongodb": nil, "plaid": nil}, http.StatusOK},
+		{"one failed", map[string]error{"mongodb": nil, "plaid": errors.New("timeout")}, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readinessChecks = nil
+			for name, err := range tt.errs {
+				err := err
+				registerReadinessCheck(name, func(ctx context.Context) error { return err })
+			}
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/readyz", nil)
+			readyz(c)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
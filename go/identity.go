@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Identity data returned by /identity/get is kept per account in the
+// identities collection. Match checks compare caller-supplied details with
+// the stored owners and every check is recorded in identity_match_checks.
+// Match checks are an audit trail and are kept when their item is removed.
+
+type identityAddress struct {
+	Street     string `bson:"street" json:"street"`
+	City       string `bson:"city" json:"city"`
+	Region     string `bson:"region,omitempty" json:"region,omitempty"`
+	PostalCode string `bson:"postal_code,omitempty" json:"postal_code,omitempty"`
+	Country    string `bson:"country,omitempty" json:"country,omitempty"`
+	Primary    bool   `bson:"primary" json:"primary"`
+}
+
+type identityContact struct {
+	Data    string `bson:"data" json:"data"`
+	Type    string `bson:"type,omitempty" json:"type,omitempty"`
+	Primary bool   `bson:"primary" json:"primary"`
+}
+
+type identityOwner struct {
+	Names        []string          `bson:"names" json:"names"`
+	Emails       []identityContact `bson:"emails" json:"emails"`
+	PhoneNumbers []identityContact `bson:"phone_numbers" json:"phone_numbers"`
+	Addresses    []identityAddress `bson:"addresses" json:"addresses"`
+}
+
+type storedIdentity struct {
+	AccountID string          `bson:"_id" json:"account_id"`
+	UserID    string          `bson:"user_id" json:"-"`
+	ItemID    string          `bson:"item_id" json:"item_id"`
+	Name      string          `bson:"name" json:"name"`
+	Mask      string          `bson:"mask,omitempty" json:"mask,omitempty"`
+	Owners    []identityOwner `bson:"owners" json:"owners"`
+	UpdatedAt time.Time       `bson:"updated_at" json:"updated_at"`
+}
+
+// identityMatchRequest holds the details to compare. At least one of them
+// must be given.
+type identityMatchRequest struct {
+	AccountID string           `bson:"account_id,omitempty" json:"account_id,omitempty"`
+	Name      string           `bson:"name,omitempty" json:"name,omitempty"`
+	Email     string           `bson:"email,omitempty" json:"email,omitempty"`
+	Phone     string           `bson:"phone,omitempty" json:"phone,omitempty"`
+	Address   *identityAddress `bson:"address,omitempty" json:"address,omitempty"`
+}
+
+// identityScores are match scores from 0 to 100. A field is omitted when it
+// was not supplied.
+type identityScores struct {
+	Name    *int `bson:"name,omitempty" json:"name,omitempty"`
+	Email   *int `bson:"email,omitempty" json:"email,omitempty"`
+	Phone   *int `bson:"phone,omitempty" json:"phone,omitempty"`
+	Address *int `bson:"address,omitempty" json:"address,omitempty"`
+	Overall int  `bson:"overall" json:"overall"`
+}
+
+type identityAccountMatch struct {
+	AccountID string         `bson:"account_id" json:"account_id"`
+	Scores    identityScores `bson:"scores" json:"scores"`
+	Matched   bool           `bson:"matched" json:"matched"`
+}
+
+// identityMatchCheck is the audit record of one match check. The supplied
+// details are recorded normalized, as they were compared.
+type identityMatchCheck struct {
+	ID        primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	UserID    string                 `bson:"user_id" json:"-"`
+	ItemID    string                 `bson:"item_id" json:"item_id"`
+	Method    string                 `bson:"method" json:"method"`
+	Input     identityMatchRequest   `bson:"input" json:"input"`
+	Threshold int                    `bson:"threshold" json:"threshold"`
+	Accounts  []identityAccountMatch `bson:"accounts" json:"accounts"`
+	Matched   bool                   `bson:"matched" json:"matched"`
+	CreatedAt time.Time              `bson:"created_at" json:"created_at"`
+}
+
+// IDENTITY_MATCH_THRESHOLD is the overall score from which an account counts
+// as a match.
+var IDENTITY_MATCH_THRESHOLD = 70
+
+func initIdentity() {
+	if v := os.Getenv("IDENTITY_MATCH_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			log.Fatalf("Invalid IDENTITY_MATCH_THRESHOLD %q: must be between 0 and 100", v)
+		}
+		IDENTITY_MATCH_THRESHOLD = n
+	}
+}
+
+func toIdentityOwner(o plaid.Owner) identityOwner {
+	owner := identityOwner{
+		Names:        o.Names,
+		Emails:       make([]identityContact, 0, len(o.Emails)),
+		PhoneNumbers: make([]identityContact, 0, len(o.PhoneNumbers)),
+		Addresses:    make([]identityAddress, 0, len(o.Addresses)),
+	}
+	for _, e := range o.Emails {
+		owner.Emails = append(owner.Emails, identityContact{Data: e.Data, Type: e.Type, Primary: e.Primary})
+	}
+	for _, p := range o.PhoneNumbers {
+		owner.PhoneNumbers = append(owner.PhoneNumbers, identityContact{Data: p.Data, Type: p.Type, Primary: p.Primary})
+	}
+	for _, a := range o.Addresses {
+		owner.Addresses = append(owner.Addresses, identityAddress{
+			Street:     a.Data.Street,
+			City:       a.Data.City,
+			Region:     a.Data.GetRegion(),
+			PostalCode: a.Data.GetPostalCode(),
+			Country:    a.Data.GetCountry(),
+			Primary:    a.GetPrimary(),
+		})
+	}
+	return owner
+}
+
+// saveIdentities replaces the stored identity data of the item.
+func saveIdentities(ctx context.Context, it *storedItem, accounts []plaid.AccountIdentity) ([]storedIdentity, error) {
+	now := time.Now().UTC()
+	identities := make([]storedIdentity, 0, len(accounts))
+	for _, a := range accounts {
+		owners := make([]identityOwner, 0, len(a.Owners))
+		for _, o := range a.Owners {
+			owners = append(owners, toIdentityOwner(o))
+		}
+		identities = append(identities, storedIdentity{
+			AccountID: a.AccountId,
+			UserID:    it.UserID,
+			ItemID:    it.ItemID,
+			Name:      a.Name,
+			Mask:      a.GetMask(),
+			Owners:    owners,
+			UpdatedAt: now,
+		})
+	}
+
+	filter := bson.M{"user_id": it.UserID, "item_id": it.ItemID}
+	if _, err := collection("identities").DeleteMany(ctx, filter); err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return identities, nil
+	}
+	docs := make([]interface{}, 0, len(identities))
+	for _, id := range identities {
+		docs = append(docs, id)
+	}
+	if _, err := collection("identities").InsertMany(ctx, docs); err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+// fetchIdentities gets the item's identity data from Plaid and stores it.
+func fetchIdentities(ctx context.Context, it *storedItem) ([]plaid.AccountIdentity, error) {
+	identityGetResp, _, err := client.PlaidApi.IdentityGet(ctx).IdentityGetRequest(
+		*plaid.NewIdentityGetRequest(it.AccessToken),
+	).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := identityGetResp.GetAccounts()
+	if _, err := saveIdentities(ctx, it, accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func findIdentities(ctx context.Context, filter bson.M) ([]storedIdentity, error) {
+	curr, err := collection("identities").Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	all := make([]storedIdentity, 0)
+	if err := curr.All(ctx, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// addressAbbreviations maps address words to their USPS abbreviations so
+// that "123 North Main Street" and "123 N. Main St" compare equal.
+var addressAbbreviations = map[string]string{
+	"north": "n", "south": "s", "east": "e", "west": "w",
+	"northeast": "ne", "northwest": "nw", "southeast": "se", "southwest": "sw",
+	"street": "st", "avenue": "ave", "av": "ave", "road": "rd", "drive": "dr",
+	"boulevard": "blvd", "lane": "ln", "court": "ct", "place": "pl",
+	"terrace": "ter", "circle": "cir", "highway": "hwy", "parkway": "pkwy",
+	"square": "sq", "trail": "trl", "way": "wy", "expressway": "expy",
+	"freeway": "fwy", "alley": "aly", "center": "ctr", "heights": "hts",
+	"mount": "mt", "point": "pt", "route": "rte", "turnpike": "tpke",
+	"apartment": "apt", "suite": "ste", "building": "bldg", "floor": "fl",
+	"room": "rm", "unit": "unit", "number": "", "no": "",
+}
+
+// nameAffixes are dropped from names before comparing them.
+var nameAffixes = map[string]bool{
+	"mr": true, "mrs": true, "ms": true, "miss": true, "dr": true, "prof": true,
+	"jr": true, "sr": true, "ii": true, "iii": true, "iv": true,
+}
+
+// normalizeTokens lowercases s, turns punctuation into spaces except for
+// apostrophes, which are dropped so that "O'Brien" stays one word, and
+// splits it into words.
+func normalizeTokens(s string) []string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case r == '\'' || r == '’':
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Fields(b.String())
+}
+
+func normalizeName(s string) []string {
+	var tokens []string
+	for _, t := range normalizeTokens(s) {
+		if !nameAffixes[t] {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func normalizeStreet(s string) []string {
+	var tokens []string
+	for _, t := range normalizeTokens(s) {
+		if abbr, ok := addressAbbreviations[t]; ok {
+			t = abbr
+		}
+		if t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func normalizeEmail(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// normalizePhone keeps the digits of a phone number, dropping a leading
+// US country code.
+func normalizePhone(s string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+	if len(digits) == 11 && digits[0] == '1' {
+		digits = digits[1:]
+	}
+	return digits
+}
+
+// normalizePostalCode compares US ZIP+4 codes on their first five digits.
+func normalizePostalCode(s string) string {
+	s = strings.Join(normalizeTokens(s), "")
+	if len(s) == 9 && strings.Trim(s, "0123456789") == "" {
+		s = s[:5]
+	}
+	return s
+}
+
+// tokenScore is the share of words two values have in common, from 0 to
+// 100, regardless of order. A single letter matches a word it is the
+// initial of, so "J Smith" scores well against "John Smith".
+func tokenScore(a, b []string) int {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	used := make([]bool, len(b))
+	var common float64
+	for _, x := range a {
+		best, at := 0.0, -1
+		for i, y := range b {
+			if used[i] {
+				continue
+			}
+			switch {
+			case x == y:
+				best, at = 1, i
+			case (len(x) == 1 && strings.HasPrefix(y, x)) || (len(y) == 1 && strings.HasPrefix(x, y)):
+				if best < 0.5 {
+					best, at = 0.5, i
+				}
+			}
+			if best == 1 {
+				break
+			}
+		}
+		if at >= 0 {
+			used[at] = true
+			common += best
+		}
+	}
+	return int(200*common/float64(len(a)+len(b)) + 0.5)
+}
+
+func exactScore(a, b string) int {
+	if a != "" && a == b {
+		return 100
+	}
+	return 0
+}
+
+// addressScore weighs the street at half of the score and the city, region,
+// postal code and country at the rest. Parts the caller left out are not
+// counted, and neither is the country when the stored address has none.
+func addressScore(in, stored *identityAddress) int {
+	var total, weight float64
+	add := func(score, w float64) {
+		total += score * w
+		weight += w
+	}
+	add(float64(tokenScore(normalizeStreet(in.Street), normalizeStreet(stored.Street))), 50)
+	if in.City != "" {
+		add(float64(exactScore(strings.Join(normalizeTokens(in.City), " "), strings.Join(normalizeTokens(stored.City), " "))), 20)
+	}
+	if in.Region != "" {
+		add(float64(exactScore(strings.Join(normalizeTokens(in.Region), ""), strings.Join(normalizeTokens(stored.Region), ""))), 10)
+	}
+	if in.PostalCode != "" {
+		add(float64(exactScore(normalizePostalCode(in.PostalCode), normalizePostalCode(stored.PostalCode))), 20)
+	}
+	if in.Country != "" && stored.Country != "" {
+		add(float64(exactScore(strings.ToUpper(strings.TrimSpace(in.Country)), strings.ToUpper(strings.TrimSpace(stored.Country)))), 10)
+	}
+	return int(total/weight + 0.5)
+}
+
+// scoreIdentity scores the request against every owner of the account,
+// keeping the best score of each field. The overall score is the average
+// of the supplied fields.
+func scoreIdentity(req *identityMatchRequest, id *storedIdentity) identityScores {
+	best := func(score int, into **int) {
+		if *into == nil || score > **into {
+			*into = &score
+		}
+	}
+
+	var s identityScores
+	for _, o := range id.Owners {
+		if req.Name != "" {
+			best(0, &s.Name)
+			for _, n := range o.Names {
+				best(tokenScore(normalizeName(req.Name), normalizeName(n)), &s.Name)
+			}
+		}
+		if req.Email != "" {
+			best(0, &s.Email)
+			for _, e := range o.Emails {
+				best(exactScore(normalizeEmail(req.Email), normalizeEmail(e.Data)), &s.Email)
+			}
+		}
+		if req.Phone != "" {
+			best(0, &s.Phone)
+			for _, p := range o.PhoneNumbers {
+				best(exactScore(normalizePhone(req.Phone), normalizePhone(p.Data)), &s.Phone)
+			}
+		}
+		if req.Address != nil {
+			best(0, &s.Address)
+			for i := range o.Addresses {
+				best(addressScore(req.Address, &o.Addresses[i]), &s.Address)
+			}
+		}
+	}
+
+	var sum, n int
+	for _, f := range []*int{s.Name, s.Email, s.Phone, s.Address} {
+		if f != nil {
+			sum += *f
+			n++
+		}
+	}
+	if n > 0 {
+		s.Overall = (sum + n/2) / n
+	}
+	return s
+}
+
+// normalize trims the request and checks that it has something to compare.
+func (r *identityMatchRequest) normalize() error {
+	r.AccountID = strings.TrimSpace(r.AccountID)
+	r.Name = strings.Join(strings.Fields(r.Name), " ")
+	r.Email = normalizeEmail(r.Email)
+	r.Phone = normalizePhone(r.Phone)
+	if a := r.Address; a != nil {
+		a.Street = strings.Join(normalizeStreet(a.Street), " ")
+		a.City = strings.Join(normalizeTokens(a.City), " ")
+		a.Region = strings.Join(normalizeTokens(a.Region), "")
+		a.PostalCode = normalizePostalCode(a.PostalCode)
+		a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+		a.Primary = false
+		if a.Street == "" {
+			return invalidf("address.street is required when an address is given")
+		}
+	}
+	if r.Name == "" && r.Email == "" && r.Phone == "" && r.Address == nil {
+		return invalidf("at least one of name, email, phone or address is required")
+	}
+	return nil
+}
+
+func identity(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := requireItem(c)
+	if !ok {
+		return
+	}
+
+	accounts, err := fetchIdentities(ctx, it)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"identity": accounts,
+	})
+}
+
+// identityMatch scores the supplied details against the stored owners of
+// the item's accounts, or of one account. Identity data is fetched from
+// Plaid first when none is stored for the item.
+func identityMatch(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := requireItem(c)
+	if !ok {
+		return
+	}
+
+	var req identityMatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.normalize(); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	filter := bson.M{"user_id": it.UserID, "item_id": it.ItemID}
+	identities, err := findIdentities(ctx, filter)
+	if err == nil && len(identities) == 0 {
+		if _, err = fetchIdentities(ctx, it); err == nil {
+			identities, err = findIdentities(ctx, filter)
+		}
+	}
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	check := identityMatchCheck{
+		UserID:    it.UserID,
+		ItemID:    it.ItemID,
+		Method:    currentPrincipal(c).Method,
+		Input:     req,
+		Threshold: IDENTITY_MATCH_THRESHOLD,
+		Accounts:  make([]identityAccountMatch, 0, len(identities)),
+		CreatedAt: time.Now().UTC(),
+	}
+	for i := range identities {
+		id := &identities[i]
+		if req.AccountID != "" && id.AccountID != req.AccountID {
+			continue
+		}
+		scores := scoreIdentity(&req, id)
+		m := identityAccountMatch{
+			AccountID: id.AccountID,
+			Scores:    scores,
+			Matched:   scores.Overall >= IDENTITY_MATCH_THRESHOLD,
+		}
+		check.Matched = check.Matched || m.Matched
+		check.Accounts = append(check.Accounts, m)
+	}
+	if req.AccountID != "" && len(check.Accounts) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+		return
+	}
+
+	res, err := collection("identity_match_checks").InsertOne(ctx, check)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	check.ID = res.InsertedID.(primitive.ObjectID)
+
+	c.JSON(http.StatusOK, check)
+}
+
+// listIdentityMatchChecks returns the caller's match checks, most recent
+// first, optionally for one item.
+func listIdentityMatchChecks(c *gin.Context) {
+	ctx := c.Request.Context()
+	filter := bson.M{"user_id": currentPrincipal(c).Subject}
+	if id := c.Query("item_id"); id != "" {
+		filter["item_id"] = id
+	}
+
+	curr, err := collection("identity_match_checks").Find(ctx, filter,
+		options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(500),
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	checks := make([]identityMatchCheck, 0)
+	if err := curr.All(ctx, &checks); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"checks": checks})
+}
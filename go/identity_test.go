@@ -0,0 +1,128 @@
+package main
+
+import "testing"
+
+func TestTokenScoreNames(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"John Smith", "John Smith", 100},
+		{"Smith John", "John Smith", 100},
+		{"Smith, John", "John Smith", 100},
+		{"Mr. John Smith Jr.", "John Smith", 100},
+		{"J Smith", "John Smith", 75},
+		{"J. Smith", "John Smith", 75},
+		{"John Smith", "John Michael Smith", 80},
+		{"O'Brien", "Obrien", 100},
+		{"Jane Doe", "John Smith", 0},
+		{"", "John Smith", 0},
+	}
+	for _, tt := range tests {
+		if got := tokenScore(normalizeName(tt.a), normalizeName(tt.b)); got != tt.want {
+			t.Errorf("tokenScore(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeStreet(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"123 North Main Street", "123 N. Main St"},
+		{"500 Fifth Avenue, Suite 10", "500 fifth ave ste 10"},
+		{"1 Infinite Loop Apartment No 5", "1 Infinite Loop Apt 5"},
+	}
+	for _, tt := range tests {
+		if got := tokenScore(normalizeStreet(tt.a), normalizeStreet(tt.b)); got != 100 {
+			t.Errorf("street %q against %q scores %d, want 100", tt.a, tt.b, got)
+		}
+	}
+}
+
+func TestNormalizeContacts(t *testing.T) {
+	phones := []struct{ in, want string }{
+		{"+1 (415) 555-0100", "4155550100"},
+		{"415.555.0100", "4155550100"},
+		{"44 20 7946 0018", "442079460018"},
+	}
+	for _, tt := range phones {
+		if got := normalizePhone(tt.in); got != tt.want {
+			t.Errorf("normalizePhone(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	codes := []struct{ in, want string }{
+		{"94107-1234", "94107"},
+		{"94107", "94107"},
+		{"SW1A 1AA", "sw1a1aa"},
+	}
+	for _, tt := range codes {
+		if got := normalizePostalCode(tt.in); got != tt.want {
+			t.Errorf("normalizePostalCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAddressScore(t *testing.T) {
+	stored := identityAddress{Street: "123 North Main Street", City: "San Francisco", Region: "CA", PostalCode: "94107-1234", Country: "US"}
+
+	tests := []struct {
+		name   string
+		in     identityAddress
+		stored identityAddress
+		want   int
+	}{
+		{"all fields", identityAddress{Street: "123 N Main St", City: "san francisco", Region: "ca", PostalCode: "94107", Country: "us"}, stored, 100},
+		{"street only", identityAddress{Street: "123 N Main St"}, stored, 100},
+		{"wrong city", identityAddress{Street: "123 N Main St", City: "Oakland"}, stored, 71},
+		{"wrong country", identityAddress{Street: "123 N Main St", Country: "CA"}, stored, 83},
+		{"stored without country", identityAddress{Street: "123 N Main St", Country: "CA"}, identityAddress{Street: "123 Main St"}, 86},
+		{"other street", identityAddress{Street: "9 Elm Rd", PostalCode: "94107"}, stored, 29},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addressScore(&tt.in, &tt.stored); got != tt.want {
+				t.Errorf("addressScore = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScoreIdentity(t *testing.T) {
+	id := storedIdentity{Owners: []identityOwner{
+		{
+			Names:        []string{"Alberta Bobbeth Charleson"},
+			Emails:       []identityContact{{Data: "accountholder0@example.com"}},
+			PhoneNumbers: []identityContact{{Data: "1112223333"}},
+		},
+		{
+			Names: []string{"John Smith"},
+		},
+	}}
+
+	tests := []struct {
+		name    string
+		req     identityMatchRequest
+		overall int
+		email   bool
+	}{
+		{"name of the second owner", identityMatchRequest{Name: "Smith John"}, 100, false},
+		{"name and email", identityMatchRequest{Name: "Alberta Charleson", Email: "AccountHolder0@example.com"}, 90, true},
+		{"wrong phone", identityMatchRequest{Phone: "(111) 222-4444"}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.req.normalize(); err != nil {
+				t.Fatal(err)
+			}
+			s := scoreIdentity(&tt.req, &id)
+			if s.Overall != tt.overall {
+				t.Errorf("overall = %d, want %d", s.Overall, tt.overall)
+			}
+			if (s.Email != nil) != tt.email {
+				t.Errorf("email scored = %v, want %v", s.Email != nil, tt.email)
+			}
+		})
+	}
+}
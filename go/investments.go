@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Investment data is kept in three collections. securities holds one
+// document per security_id, shared by all users. investment_transactions
+// holds every transaction fetched by a backfill. holdings_snapshots holds
+// one document per account, security and day, so position history and cost
+// basis can be queried without calling Plaid.
+
+type storedSecurity struct {
+	SecurityID       string    `bson:"_id" json:"security_id"`
+	Name             string    `bson:"name,omitempty" json:"name,omitempty"`
+	TickerSymbol     string    `bson:"ticker_symbol,omitempty" json:"ticker_symbol,omitempty"`
+	Type             string    `bson:"type,omitempty" json:"type,omitempty"`
+	ISIN             string    `bson:"isin,omitempty" json:"isin,omitempty"`
+	CUSIP            string    `bson:"cusip,omitempty" json:"cusip,omitempty"`
+	IsCashEquivalent bool      `bson:"is_cash_equivalent" json:"is_cash_equivalent"`
+	ClosePrice       *float64  `bson:"close_price,omitempty" json:"close_price,omitempty"`
+	ClosePriceAsOf   string    `bson:"close_price_as_of,omitempty" json:"close_price_as_of,omitempty"`
+	IsoCurrencyCode  string    `bson:"iso_currency_code,omitempty" json:"iso_currency_code,omitempty"`
+	UpdatedAt        time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+type storedInvestmentTransaction struct {
+	InvestmentTransactionID string   `bson:"_id" json:"investment_transaction_id"`
+	UserID                  string   `bson:"user_id" json:"-"`
+	ItemID                  string   `bson:"item_id" json:"item_id"`
+	AccountID               string   `bson:"account_id" json:"account_id"`
+	SecurityID              string   `bson:"security_id,omitempty" json:"security_id,omitempty"`
+	Date                    string   `bson:"date" json:"date"`
+	Name                    string   `bson:"name" json:"name"`
+	Quantity                float64  `bson:"quantity" json:"quantity"`
+	Amount                  float64  `bson:"amount" json:"amount"`
+	Price                   float64  `bson:"price" json:"price"`
+	Fees                    *float64 `bson:"fees,omitempty" json:"fees,omitempty"`
+	Type                    string   `bson:"type" json:"type"`
+	Subtype                 string   `bson:"subtype" json:"subtype"`
+	IsoCurrencyCode         string   `bson:"iso_currency_code,omitempty" json:"iso_currency_code,omitempty"`
+}
+
+// holdingSnapshot is one position of an account on a day. An investment
+// account without positions gets a single snapshot with no security, so
+// that its latest snapshot shows it empty rather than holding whatever it
+// held before.
+type holdingSnapshot struct {
+	UserID               string    `bson:"user_id" json:"-"`
+	ItemID               string    `bson:"item_id" json:"item_id"`
+	AccountID            string    `bson:"account_id" json:"account_id"`
+	SecurityID           string    `bson:"security_id" json:"security_id"`
+	Date                 string    `bson:"date" json:"date"`
+	Quantity             float64   `bson:"quantity" json:"quantity"`
+	InstitutionPrice     float64   `bson:"institution_price" json:"institution_price"`
+	InstitutionPriceAsOf string    `bson:"institution_price_as_of,omitempty" json:"institution_price_as_of,omitempty"`
+	InstitutionValue     float64   `bson:"institution_value" json:"institution_value"`
+	CostBasis            *float64  `bson:"cost_basis,omitempty" json:"cost_basis,omitempty"`
+	IsoCurrencyCode      string    `bson:"iso_currency_code,omitempty" json:"iso_currency_code,omitempty"`
+	TakenAt              time.Time `bson:"taken_at" json:"taken_at"`
+}
+
+// HOLDINGS_SNAPSHOT_INTERVAL is how often the holdings of every item are
+// snapshotted.
+var HOLDINGS_SNAPSHOT_INTERVAL = 24 * time.Hour
+
+// Plaid returns at most 500 investment transactions per call and keeps 24
+// months of history.
+const (
+	investmentTransactionsPageSize = 500
+	maxInvestmentsHistory          = 2 * 365 * 24 * time.Hour
+)
+
+// investmentsNotSupported are the Plaid error codes for items without
+// investment accounts, which the snapshot job skips.
+var investmentsNotSupported = []string{
+	"PRODUCTS_NOT_SUPPORTED", "NO_INVESTMENT_ACCOUNTS", "PRODUCT_NOT_ENABLED",
+}
+
+func initInvestments() {
+	if v := os.Getenv("HOLDINGS_SNAPSHOT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid HOLDINGS_SNAPSHOT_INTERVAL %q: %v", v, err)
+		}
+		HOLDINGS_SNAPSHOT_INTERVAL = d
+	}
+
+	registerJob("holdings-snapshot", HOLDINGS_SNAPSHOT_INTERVAL, snapshotAllHoldings)
+}
+
+// toFloat64 widens a Plaid amount without the binary noise of a plain
+// conversion, so 1.34 stays 1.34.
+func toFloat64(f float32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'f', -1, 32), 64)
+	return v
+}
+
+func optionalFloat64(f *float32, ok bool) *float64 {
+	if !ok || f == nil {
+		return nil
+	}
+	v := toFloat64(*f)
+	return &v
+}
+
+// saveSecurities upserts the securities, keeping one document per
+// security_id.
+func saveSecurities(ctx context.Context, securities []plaid.Security) error {
+	if len(securities) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	models := make([]mongo.WriteModel, 0, len(securities))
+	for _, s := range securities {
+		sec := storedSecurity{
+			SecurityID:       s.SecurityId,
+			Name:             s.GetName(),
+			TickerSymbol:     s.GetTickerSymbol(),
+			Type:             s.GetType(),
+			ISIN:             s.GetIsin(),
+			CUSIP:            s.GetCusip(),
+			IsCashEquivalent: s.GetIsCashEquivalent(),
+			ClosePrice:       optionalFloat64(s.GetClosePriceOk()),
+			ClosePriceAsOf:   s.GetClosePriceAsOf(),
+			IsoCurrencyCode:  s.GetIsoCurrencyCode(),
+			UpdatedAt:        now,
+		}
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": sec.SecurityID}).
+			SetReplacement(sec).
+			SetUpsert(true))
+	}
+
+	_, err := collection("securities").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func saveInvestmentTransactions(ctx context.Context, it *storedItem, transactions []plaid.InvestmentTransaction) error {
+	if len(transactions) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(transactions))
+	for _, t := range transactions {
+		st := storedInvestmentTransaction{
+			InvestmentTransactionID: t.InvestmentTransactionId,
+			UserID:                  it.UserID,
+			ItemID:                  it.ItemID,
+			AccountID:               t.AccountId,
+			SecurityID:              t.GetSecurityId(),
+			Date:                    t.Date,
+			Name:                    t.Name,
+			Quantity:                toFloat64(t.Quantity),
+			Amount:                  toFloat64(t.Amount),
+			Price:                   toFloat64(t.Price),
+			Fees:                    optionalFloat64(t.GetFeesOk()),
+			Type:                    t.Type,
+			Subtype:                 t.Subtype,
+			IsoCurrencyCode:         t.GetIsoCurrencyCode(),
+		}
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": st.InvestmentTransactionID}).
+			SetReplacement(st).
+			SetUpsert(true))
+	}
+
+	_, err := collection("investment_transactions").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// fetchInvestmentTransactions pages through /investments/transactions/get
+// until total_investment_transactions have been fetched, storing each page.
+// It returns the transactions together with the accounts and securities
+// they refer to.
+func fetchInvestmentTransactions(ctx context.Context, it *storedItem, startDate, endDate string) (*plaid.InvestmentsTransactionsGetResponse, error) {
+	var all *plaid.InvestmentsTransactionsGetResponse
+	seen := map[string]bool{}
+
+	for page := 0; all == nil || int32(len(all.InvestmentTransactions)) < all.TotalInvestmentTransactions; page++ {
+		opts := plaid.NewInvestmentsTransactionsGetRequestOptions()
+		opts.SetCount(investmentTransactionsPageSize)
+		if all != nil {
+			opts.SetOffset(int32(len(all.InvestmentTransactions)))
+		}
+		request := plaid.NewInvestmentsTransactionsGetRequest(it.AccessToken, startDate, endDate)
+		request.SetOptions(*opts)
+
+		resp, _, err := client.PlaidApi.InvestmentsTransactionsGet(withPlaidPage(ctx, page)).InvestmentsTransactionsGetRequest(*request).Execute()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := saveSecurities(ctx, resp.Securities); err != nil {
+			return nil, err
+		}
+		if err := saveInvestmentTransactions(ctx, it, resp.InvestmentTransactions); err != nil {
+			return nil, err
+		}
+
+		if all == nil {
+			all = &resp
+			for _, s := range resp.Securities {
+				seen[s.SecurityId] = true
+			}
+		} else {
+			all.InvestmentTransactions = append(all.InvestmentTransactions, resp.InvestmentTransactions...)
+			all.TotalInvestmentTransactions = resp.TotalInvestmentTransactions
+			for _, s := range resp.Securities {
+				if !seen[s.SecurityId] {
+					seen[s.SecurityId] = true
+					all.Securities = append(all.Securities, s)
+				}
+			}
+		}
+
+		// Guard against the total shrinking between pages.
+		if len(resp.InvestmentTransactions) == 0 {
+			break
+		}
+	}
+
+	return all, nil
+}
+
+// saveHoldingsSnapshot records today's holdings of the item. Taking another
+// snapshot on the same day replaces the earlier one.
+func saveHoldingsSnapshot(ctx context.Context, it *storedItem, resp *plaid.InvestmentsHoldingsGetResponse) error {
+	if err := saveSecurities(ctx, resp.Securities); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("2006-01-02")
+	models := make([]mongo.WriteModel, 0, len(resp.Holdings))
+	held := map[string]bool{}
+	for _, h := range resp.Holdings {
+		held[h.AccountId] = true
+		snap := holdingSnapshot{
+			UserID:               it.UserID,
+			ItemID:               it.ItemID,
+			AccountID:            h.AccountId,
+			SecurityID:           h.SecurityId,
+			Date:                 date,
+			Quantity:             toFloat64(h.Quantity),
+			InstitutionPrice:     toFloat64(h.InstitutionPrice),
+			InstitutionPriceAsOf: h.GetInstitutionPriceAsOf(),
+			InstitutionValue:     toFloat64(h.InstitutionValue),
+			CostBasis:            optionalFloat64(h.GetCostBasisOk()),
+			IsoCurrencyCode:      h.GetIsoCurrencyCode(),
+			TakenAt:              now,
+		}
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"account_id": snap.AccountID, "security_id": snap.SecurityID, "date": snap.Date}).
+			SetReplacement(snap).
+			SetUpsert(true))
+	}
+	for _, a := range resp.Accounts {
+		if a.Type != plaid.ACCOUNTTYPE_INVESTMENT || held[a.AccountId] {
+			continue
+		}
+		snap := holdingSnapshot{
+			UserID:    it.UserID,
+			ItemID:    it.ItemID,
+			AccountID: a.AccountId,
+			Date:      date,
+			TakenAt:   now,
+		}
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"account_id": snap.AccountID, "security_id": "", "date": snap.Date}).
+			SetReplacement(snap).
+			SetUpsert(true))
+	}
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, err := collection("holdings_snapshots").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func snapshotHoldings(ctx context.Context, it *storedItem) (*plaid.InvestmentsHoldingsGetResponse, error) {
+	holdingsGetResp, _, err := client.PlaidApi.InvestmentsHoldingsGet(ctx).InvestmentsHoldingsGetRequest(
+		*plaid.NewInvestmentsHoldingsGetRequest(it.AccessToken),
+	).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveHoldingsSnapshot(ctx, it, &holdingsGetResp); err != nil {
+		return nil, err
+	}
+	return &holdingsGetResp, nil
+}
+
+// snapshotAllHoldings snapshots the holdings of every healthy item. Items
+// without investment accounts are skipped.
+func snapshotAllHoldings(ctx context.Context) error {
+	curr, err := collection("items").Find(ctx, bson.M{"status": itemStatusHealthy})
+	if err != nil {
+		return err
+	}
+
+	var items []storedItem
+	if err := curr.All(ctx, &items); err != nil {
+		return err
+	}
+
+	for i := range items {
+		it := &items[i]
+		_, err := snapshotHoldings(ctx, it)
+		if err == nil {
+			continue
+		}
+		if plaidErr, perr := plaid.ToPlaidError(err); perr == nil {
+			if itemExists(investmentsNotSupported, plaidErr.ErrorCode) {
+				continue
+			}
+			if status, ok := itemErrorStatuses[plaidErr.ErrorCode]; ok {
+				if err := setItemStatus(ctx, it.ItemID, status, plaidErr.ErrorCode); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		log.Printf("Error snapshotting holdings of item %s: %v\n", it.ItemID, err)
+	}
+	return nil
+}
+
+// dateRange reads the start_date and end_date parameters, defaulting to the
+// given number of days up to today.
+func dateRange(c *gin.Context, defaultDays int) (string, string, error) {
+	startDate := c.Query("start_date")
+	if startDate == "" {
+		startDate = c.PostForm("start_date")
+	}
+	endDate := c.Query("end_date")
+	if endDate == "" {
+		endDate = c.PostForm("end_date")
+	}
+
+	now := time.Now().Local()
+	if endDate == "" {
+		endDate = now.Format("2006-01-02")
+	}
+	if startDate == "" {
+		startDate = now.AddDate(0, 0, -defaultDays).Format("2006-01-02")
+	}
+
+	start, err := time.Parse("2006-01-02", startDate)
+	if err != nil {
+		return "", "", invalidf("start_date must be a date such as 2021-01-31")
+	}
+	end, err := time.Parse("2006-01-02", endDate)
+	if err != nil {
+		return "", "", invalidf("end_date must be a date such as 2021-01-31")
+	}
+	if end.Before(start) {
+		return "", "", invalidf("end_date must not be before start_date")
+	}
+	return startDate, endDate, nil
+}
+
+func investmentTransactions(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := requireItem(c)
+	if !ok {
+		return
+	}
+
+	startDate, endDate, err := dateRange(c, 30)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	invTxResp, err := fetchInvestmentTransactions(ctx, it, startDate, endDate)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"investment_transactions": invTxResp,
+	})
+}
+
+// backfillInvestments fetches and stores the item's investment transactions
+// for any range within Plaid's 24 months of history, along with a holdings
+// snapshot.
+func backfillInvestments(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := requireItem(c)
+	if !ok {
+		return
+	}
+
+	startDate, endDate, err := dateRange(c, 365)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	if start, _ := time.Parse("2006-01-02", startDate); time.Since(start) > maxInvestmentsHistory {
+		renderError(c, invalidf("start_date must be within the last 24 months"))
+		return
+	}
+
+	invTxResp, err := fetchInvestmentTransactions(ctx, it, startDate, endDate)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	holdingsResp, err := snapshotHoldings(ctx, it)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"item_id":                 it.ItemID,
+		"start_date":              startDate,
+		"end_date":                endDate,
+		"investment_transactions": len(invTxResp.InvestmentTransactions),
+		"securities":              len(invTxResp.Securities),
+		"holdings":                len(holdingsResp.Holdings),
+	})
+}
+
+func holdings(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := requireItem(c)
+	if !ok {
+		return
+	}
+
+	holdingsGetResp, err := snapshotHoldings(ctx, it)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"holdings": holdingsGetResp,
+	})
+}
+
+// listInvestmentTransactions returns stored investment transactions, filtered
+// by date range, account and security.
+func listInvestmentTransactions(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	startDate, endDate, err := dateRange(c, 365)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	filter := bson.M{
+		"user_id": currentPrincipal(c).Subject,
+		"date":    bson.M{"$gte": startDate, "$lte": endDate},
+	}
+	if id := c.Query("account_id"); id != "" {
+		filter["account_id"] = id
+	}
+	if id := c.Query("security_id"); id != "" {
+		filter["security_id"] = id
+	}
+
+	curr, err := collection("investment_transactions").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "date", Value: -1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	all := make([]storedInvestmentTransaction, 0)
+	if err := curr.All(ctx, &all); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"investment_transactions": all})
+}
+
+func findSecurity(ctx context.Context, securityID string) (*storedSecurity, error) {
+	var sec storedSecurity
+	err := collection("securities").FindOne(ctx, bson.M{"_id": securityID}).Decode(&sec)
+	if err != nil {
+		return nil, err
+	}
+	return &sec, nil
+}
+
+// positionHistory returns the daily snapshots of one security, per account,
+// within the date range.
+func positionHistory(c *gin.Context) {
+	ctx := c.Request.Context()
+	securityID := c.Param("security_id")
+
+	startDate, endDate, err := dateRange(c, 365)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	sec, err := findSecurity(ctx, securityID)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "security not found"})
+		return
+	}
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	filter := bson.M{
+		"user_id":     currentPrincipal(c).Subject,
+		"security_id": securityID,
+		"date":        bson.M{"$gte": startDate, "$lte": endDate},
+	}
+	if id := c.Query("account_id"); id != "" {
+		filter["account_id"] = id
+	}
+
+	curr, err := collection("holdings_snapshots").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "date", Value: 1}, {Key: "account_id", Value: 1}}),
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	history := make([]holdingSnapshot, 0)
+	if err := curr.All(ctx, &history); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"security": sec,
+		"history":  history,
+	})
+}
+
+// costBasisPosition is a security's position across all of a user's
+// accounts on one day.
+type costBasisPosition struct {
+	Security         *storedSecurity `json:"security"`
+	Date             string          `json:"date"`
+	Quantity         float64         `json:"quantity"`
+	InstitutionValue float64         `json:"institution_value"`
+	CostBasis        *float64        `json:"cost_basis"`
+	UnrealizedGain   *float64        `json:"unrealized_gain"`
+	IsoCurrencyCode  string          `json:"iso_currency_code,omitempty"`
+	Accounts         []string        `json:"accounts"`
+}
+
+// latestSnapshots returns the user's holdings from the most recent snapshot
+// of every account taken on or before the date. Accounts are taken one by
+// one, so that an item whose latest snapshot failed still counts with its
+// previous one.
+func latestSnapshots(ctx context.Context, userID, date string) ([]holdingSnapshot, error) {
+	curr, err := collection("holdings_snapshots").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID, "date": bson.M{"$lte": date}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$account_id", "date": bson.M{"$max": "$date"}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var latest []struct {
+		AccountID string `bson:"_id"`
+		Date      string `bson:"date"`
+	}
+	if err := curr.All(ctx, &latest); err != nil {
+		return nil, err
+	}
+	if len(latest) == 0 {
+		return nil, nil
+	}
+
+	or := make(bson.A, 0, len(latest))
+	for _, l := range latest {
+		or = append(or, bson.M{"account_id": l.AccountID, "date": l.Date})
+	}
+	curr, err = collection("holdings_snapshots").Find(ctx, bson.M{"user_id": userID, "$or": or})
+	if err != nil {
+		return nil, err
+	}
+	var snaps []holdingSnapshot
+	if err := curr.All(ctx, &snaps); err != nil {
+		return nil, err
+	}
+	return snaps, nil
+}
+
+// costBasis returns the cost basis and unrealized gain per security from
+// the latest snapshot on or before the as_of date. The cost basis is only
+// reported when every account holding the security reports one.
+func costBasis(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	asOf := c.Query("as_of")
+	if asOf == "" {
+		asOf = time.Now().Local().Format("2006-01-02")
+	}
+	if _, err := time.Parse("2006-01-02", asOf); err != nil {
+		renderError(c, invalidf("as_of must be a date such as 2021-01-31"))
+		return
+	}
+
+	snaps, err := latestSnapshots(ctx, currentPrincipal(c).Subject, asOf)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	bySecurity := map[string]*costBasisPosition{}
+	positions := make([]*costBasisPosition, 0)
+	for _, s := range snaps {
+		if s.SecurityID == "" {
+			continue
+		}
+		p, ok := bySecurity[s.SecurityID]
+		if !ok {
+			sec, err := findSecurity(ctx, s.SecurityID)
+			if err != nil && err != mongo.ErrNoDocuments {
+				renderError(c, err)
+				return
+			}
+			if sec == nil {
+				sec = &storedSecurity{SecurityID: s.SecurityID}
+			}
+			zero := 0.0
+			p = &costBasisPosition{
+				Security:        sec,
+				Date:            s.Date,
+				CostBasis:       &zero,
+				IsoCurrencyCode: s.IsoCurrencyCode,
+			}
+			bySecurity[s.SecurityID] = p
+			positions = append(positions, p)
+		}
+
+		p.Quantity += s.Quantity
+		p.InstitutionValue += s.InstitutionValue
+		p.Accounts = append(p.Accounts, s.AccountID)
+		if p.CostBasis != nil && s.CostBasis != nil {
+			*p.CostBasis += *s.CostBasis
+		} else {
+			p.CostBasis = nil
+		}
+	}
+
+	for _, p := range positions {
+		if p.CostBasis != nil {
+			gain := p.InstitutionValue - *p.CostBasis
+			p.UnrealizedGain = &gain
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"as_of":     asOf,
+		"positions": positions,
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Item statuses. Every status other than healthy means the user has to go
+// through Link update mode before the item works again.
+const (
+	itemStatusHealthy           = "healthy"
+	itemStatusLoginRequired     = "login_required"
+	itemStatusPendingExpiration = "pending_expiration"
+	itemStatusPermissionRevoked = "permission_revoked"
+	itemStatusError             = "error"
+)
+
+// itemErrorStatuses maps the Plaid error codes that can only be fixed by the
+// user re-authenticating to the item status they put the item in.
+var itemErrorStatuses = map[string]string{
+	"ITEM_LOGIN_REQUIRED":      itemStatusLoginRequired,
+	"INVALID_CREDENTIALS":      itemStatusLoginRequired,
+	"INVALID_MFA":              itemStatusLoginRequired,
+	"INVALID_UPDATED_USERNAME": itemStatusLoginRequired,
+	"ITEM_LOCKED":              itemStatusLoginRequired,
+	"USER_SETUP_REQUIRED":      itemStatusLoginRequired,
+}
+
+func initItemHealth() {
+	registerWebhookHandler("ITEM", handleItemWebhook)
+}
+
+func setItemStatus(ctx context.Context, itemID, status, reason string) error {
+	update := bson.M{
+		"$set": bson.M{
+			"status":            status,
+			"status_updated_at": time.Now().UTC(),
+		},
+	}
+	if reason != "" {
+		update["$set"].(bson.M)["status_reason"] = reason
+	} else {
+		update["$unset"] = bson.M{"status_reason": ""}
+	}
+
+	_, err := collection("items").UpdateOne(ctx, bson.M{"_id": itemID}, update)
+	return err
+}
+
+// recordItemError flags the request's item when a Plaid call failed with an
+// error that needs the user to re-authenticate.
+func recordItemError(c *gin.Context, errorCode string) {
+	status, ok := itemErrorStatuses[errorCode]
+	if !ok {
+		return
+	}
+	v, ok := c.Get(itemKey)
+	if !ok {
+		return
+	}
+	it := v.(*storedItem)
+	if it.Status == status && it.StatusReason == errorCode {
+		return
+	}
+
+	if err := setItemStatus(c.Request.Context(), it.ItemID, status, errorCode); err != nil {
+		log.Println("Error updating item status", err)
+	}
+}
+
+func handleItemWebhook(ctx context.Context, wh *webhook) error {
+	switch wh.WebhookCode {
+	case "ERROR":
+		if wh.Error == nil {
+			return nil
+		}
+		status, ok := itemErrorStatuses[wh.Error.ErrorCode]
+		if !ok {
+			status = itemStatusError
+		}
+		return setItemStatus(ctx, wh.ItemID, status, wh.Error.ErrorCode)
+	case "PENDING_EXPIRATION":
+		return setItemStatus(ctx, wh.ItemID, itemStatusPendingExpiration, wh.WebhookCode)
+	case "USER_PERMISSION_REVOKED":
+		return setItemStatus(ctx, wh.ItemID, itemStatusPermissionRevoked, wh.WebhookCode)
+	case "LOGIN_REPAIRED":
+		return setItemStatus(ctx, wh.ItemID, itemStatusHealthy, "")
+	}
+	return nil
+}
+
+// createUpdateLinkToken creates a link token that opens Link in update mode
+// for the item, so the user can re-authenticate it.
+func createUpdateLinkToken(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := ownedItem(c)
+	if !ok {
+		return
+	}
+
+	opts := linkTokenOptions{AccessToken: it.AccessToken}
+	if err := opts.validate(); err != nil {
+		renderError(c, err)
+		return
+	}
+	linkToken, err := linkTokenCreate(ctx, it.UserID, &opts)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"link_token": linkToken,
+		"item_id":    it.ItemID,
+		"status":     it.Status,
+	})
+}
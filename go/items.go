@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// storedItem is a Plaid item linked by a user, together with the access
+// token needed to call Plaid on its behalf.
+type storedItem struct {
+	ItemID        string    `bson:"_id" json:"item_id"`
+	UserID        string    `bson:"user_id" json:"user_id"`
+	AccessToken   string    `bson:"access_token" json:"-"`
+	InstitutionID string    `bson:"institution_id,omitempty" json:"institution_id,omitempty"`
+	Webhook       string    `bson:"webhook,omitempty" json:"webhook,omitempty"`
+	CreatedAt     time.Time `bson:"created_at" json:"created_at"`
+
+	Status          string     `bson:"status" json:"status"`
+	StatusReason    string     `bson:"status_reason,omitempty" json:"status_reason,omitempty"`
+	StatusUpdatedAt *time.Time `bson:"status_updated_at,omitempty" json:"status_updated_at,omitempty"`
+}
+
+// ITEM_REMOVAL_POLICY decides what happens to the stored data of a removed
+// item: "purge" (default) deletes it, "archive" moves it to archive_*
+// collections.
+var ITEM_REMOVAL_POLICY = ""
+
+// itemDataCollections are the collections holding per-item data, cleaned up
+// when an item is removed. Transfers are left out: they are the ledger of
+// money already moved and hold the idempotency keys, so they outlive the
+// item like identity_match_checks.
+var itemDataCollections = []string{
+	"accounts", "transactions", "investment_transactions", "holdings_snapshots", "liabilities",
+	"identities", "account_numbers", "balance_snapshots", "superseded_transactions",
+}
+
+// itemAlreadyRemoved are the Plaid error codes /item/remove returns for an
+// item Plaid no longer knows, whose local data is still cleaned up.
+var itemAlreadyRemoved = []string{"ITEM_NOT_FOUND", "INVALID_ACCESS_TOKEN"}
+
+func initItems() {
+	ITEM_REMOVAL_POLICY = strings.ToLower(os.Getenv("ITEM_REMOVAL_POLICY"))
+	if ITEM_REMOVAL_POLICY == "" {
+		ITEM_REMOVAL_POLICY = "purge"
+	}
+	if ITEM_REMOVAL_POLICY != "purge" && ITEM_REMOVAL_POLICY != "archive" {
+		log.Fatalf("Unknown ITEM_REMOVAL_POLICY %q", ITEM_REMOVAL_POLICY)
+	}
+}
+
+var errNoItem = errors.New("no linked item, link an account first")
+
+const itemKey = "item"
+
+// saveItem stores a freshly exchanged item. Exchanging the public token of
+// an existing item, as after Link update mode, marks it healthy again.
+func saveItem(ctx context.Context, it *storedItem) error {
+	now := time.Now().UTC()
+	_, err := collection("items").UpdateOne(ctx,
+		bson.M{"_id": it.ItemID},
+		bson.M{
+			"$set": bson.M{
+				"user_id":           it.UserID,
+				"access_token":      it.AccessToken,
+				"status":            itemStatusHealthy,
+				"status_updated_at": now,
+			},
+			"$unset":       bson.M{"status_reason": ""},
+			"$setOnInsert": bson.M{"created_at": it.CreatedAt},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// findItem returns the item with the given ID if it belongs to userID.
+func findItem(ctx context.Context, userID, itemID string) (*storedItem, error) {
+	var it storedItem
+	err := collection("items").FindOne(ctx, bson.M{"_id": itemID, "user_id": userID}).Decode(&it)
+	if err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+// latestItem returns the item userID linked most recently.
+func latestItem(ctx context.Context, userID string) (*storedItem, error) {
+	var it storedItem
+	err := collection("items").FindOne(ctx,
+		bson.M{"user_id": userID},
+		options.FindOne().SetSort(bson.M{"created_at": -1}),
+	).Decode(&it)
+	if err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+func listItems(ctx context.Context, userID string) ([]storedItem, error) {
+	curr, err := collection("items").Find(ctx,
+		bson.M{"user_id": userID},
+		options.Find().SetSort(bson.M{"created_at": -1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]storedItem, 0)
+	if err := curr.All(ctx, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// resolveItem picks the caller's item named by the item_id parameter, or
+// their most recently linked item when none is given.
+func resolveItem(c *gin.Context) (*storedItem, error) {
+	ctx := c.Request.Context()
+	userID := currentPrincipal(c).Subject
+
+	id := c.Query("item_id")
+	if id == "" {
+		id = c.PostForm("item_id")
+	}
+
+	var it *storedItem
+	var err error
+	if id != "" {
+		it, err = findItem(ctx, userID, id)
+	} else {
+		it, err = latestItem(ctx, userID)
+	}
+	if err == mongo.ErrNoDocuments {
+		return nil, errNoItem
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.Set(itemKey, it)
+	return it, nil
+}
+
+// requireItem resolves the caller's item and renders an error response when
+// there is none. Handlers return immediately when ok is false.
+func requireItem(c *gin.Context) (it *storedItem, ok bool) {
+	it, err := resolveItem(c)
+	if err == errNoItem {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		renderError(c, err)
+		return nil, false
+	}
+	return it, true
+}
+
+// ownedItem loads the caller's item named by the :id path parameter and
+// renders a 404 when it does not exist.
+func ownedItem(c *gin.Context) (*storedItem, bool) {
+	it, err := findItem(c.Request.Context(), currentPrincipal(c).Subject, c.Param("id"))
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
+		return nil, false
+	}
+	if err != nil {
+		renderError(c, err)
+		return nil, false
+	}
+
+	c.Set(itemKey, it)
+	return it, true
+}
+
+func getItems(c *gin.Context) {
+	all, err := listItems(c.Request.Context(), currentPrincipal(c).Subject)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": all})
+}
+
+// removeItem invalidates the item's access token at Plaid and then purges
+// or archives everything stored for it.
+func removeItem(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := ownedItem(c)
+	if !ok {
+		return
+	}
+
+	_, _, err := client.PlaidApi.ItemRemove(ctx).ItemRemoveRequest(
+		*plaid.NewItemRemoveRequest(it.AccessToken),
+	).Execute()
+	if err != nil {
+		plaidErr, perr := plaid.ToPlaidError(err)
+		if perr != nil || !itemExists(itemAlreadyRemoved, plaidErr.ErrorCode) {
+			renderError(c, err)
+			return
+		}
+		log.Printf("Item %s was already removed at Plaid (%s)\n", it.ItemID, plaidErr.ErrorCode)
+	}
+
+	if err := deleteItemData(ctx, it); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"item_id": it.ItemID,
+		"removed": true,
+		"policy":  ITEM_REMOVAL_POLICY,
+	})
+}
+
+func deleteItemData(ctx context.Context, it *storedItem) error {
+	filter := bson.M{"user_id": it.UserID, "item_id": it.ItemID}
+
+	if err := releaseItemDuplicates(ctx, it); err != nil {
+		return err
+	}
+	for _, name := range itemDataCollections {
+		if ITEM_REMOVAL_POLICY == "archive" {
+			if err := archiveDocuments(ctx, name, filter); err != nil {
+				return err
+			}
+		}
+		if _, err := collection(name).DeleteMany(ctx, filter); err != nil {
+			return err
+		}
+	}
+
+	if ITEM_REMOVAL_POLICY == "archive" {
+		// The access token is useless once removed at Plaid and is not kept.
+		archived := *it
+		archived.AccessToken = ""
+		if _, err := collection("archive_items").InsertOne(ctx, bson.M{
+			"item":       archived,
+			"removed_at": time.Now().UTC(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	_, err := collection("items").DeleteOne(ctx, bson.M{"_id": it.ItemID})
+	return err
+}
+
+// archiveDocuments copies the matching documents of a collection to its
+// archive_ counterpart.
+func archiveDocuments(ctx context.Context, name string, filter bson.M) error {
+	curr, err := collection(name).Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	var docs []interface{}
+	if err := curr.All(ctx, &docs); err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+
+	_, err = collection("archive_"+name).InsertMany(ctx, docs)
+	return err
+}
+
+type updateWebhookRequest struct {
+	Webhook string `json:"webhook" binding:"required,url"`
+}
+
+func updateItemWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := ownedItem(c)
+	if !ok {
+		return
+	}
+
+	var req updateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, _, err := client.PlaidApi.ItemWebhookUpdate(ctx).ItemWebhookUpdateRequest(
+		*plaid.NewItemWebhookUpdateRequest(it.AccessToken, req.Webhook),
+	).Execute()
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	if _, err := collection("items").UpdateOne(ctx,
+		bson.M{"_id": it.ItemID},
+		bson.M{"$set": bson.M{"webhook": req.Webhook}},
+	); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"item": resp.GetItem()})
+}
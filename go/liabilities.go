@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Liability types, as grouped by /liabilities/get.
+const (
+	liabilityCredit   = "credit"
+	liabilityMortgage = "mortgage"
+	liabilityStudent  = "student"
+)
+
+// storedLiability is one liability account. The fields used for projections
+// are normalized across liability types; Details keeps everything Plaid
+// returned for the account.
+type storedLiability struct {
+	AccountID          string    `bson:"_id" json:"account_id"`
+	UserID             string    `bson:"user_id" json:"-"`
+	ItemID             string    `bson:"item_id" json:"item_id"`
+	Type               string    `bson:"type" json:"type"`
+	Name               string    `bson:"name" json:"name"`
+	Balance            float64   `bson:"balance" json:"balance"`
+	IsoCurrencyCode    string    `bson:"iso_currency_code,omitempty" json:"iso_currency_code,omitempty"`
+	InterestRate       float64   `bson:"interest_rate" json:"interest_rate"`
+	MinimumPayment     float64   `bson:"minimum_payment" json:"minimum_payment"`
+	NextPaymentDueDate string    `bson:"next_payment_due_date,omitempty" json:"next_payment_due_date,omitempty"`
+	LastPaymentAmount  float64   `bson:"last_payment_amount" json:"last_payment_amount"`
+	LastPaymentDate    string    `bson:"last_payment_date,omitempty" json:"last_payment_date,omitempty"`
+	IsOverdue          bool      `bson:"is_overdue" json:"is_overdue"`
+	MaturityDate       string    `bson:"maturity_date,omitempty" json:"maturity_date,omitempty"`
+	Details            bson.M    `bson:"details" json:"details"`
+	UpdatedAt          time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// Projections stop after 50 years; a debt not repaid by then is reported as
+// never paid off.
+const maxProjectionMonths = 600
+
+// toDocument converts a Plaid response object to a document through its JSON
+// encoding, which knows how to handle the client's nullable fields.
+func toDocument(v interface{}) (bson.M, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// creditCardRate picks the purchase APR of a credit card, or the highest
+// APR when there is none.
+func creditCardRate(aprs []plaid.APR) float64 {
+	var rate float64
+	for _, a := range aprs {
+		if a.AprType == "purchase_apr" {
+			return toFloat64(a.AprPercentage)
+		}
+		rate = math.Max(rate, toFloat64(a.AprPercentage))
+	}
+	return rate
+}
+
+func optionalValue(f *float32, ok bool) float64 {
+	if v := optionalFloat64(f, ok); v != nil {
+		return *v
+	}
+	return 0
+}
+
+// saveLiabilities replaces the stored liabilities of the item.
+func saveLiabilities(ctx context.Context, it *storedItem, resp *plaid.LiabilitiesGetResponse) ([]storedLiability, error) {
+	accounts := map[string]plaid.AccountBase{}
+	for _, a := range resp.Accounts {
+		accounts[a.AccountId] = a
+	}
+
+	now := time.Now().UTC()
+	var liabilities []storedLiability
+	add := func(accountID, kind string, details interface{}, fill func(l *storedLiability)) error {
+		doc, err := toDocument(details)
+		if err != nil {
+			return err
+		}
+		a := accounts[accountID]
+		l := storedLiability{
+			AccountID:       accountID,
+			UserID:          it.UserID,
+			ItemID:          it.ItemID,
+			Type:            kind,
+			Name:            a.Name,
+			Balance:         optionalValue(a.Balances.GetCurrentOk()),
+			IsoCurrencyCode: a.Balances.GetIsoCurrencyCode(),
+			Details:         doc,
+			UpdatedAt:       now,
+		}
+		fill(&l)
+		liabilities = append(liabilities, l)
+		return nil
+	}
+
+	for _, cc := range resp.Liabilities.Credit {
+		cc := cc
+		err := add(cc.GetAccountId(), liabilityCredit, cc, func(l *storedLiability) {
+			l.InterestRate = creditCardRate(cc.Aprs)
+			l.MinimumPayment = toFloat64(cc.MinimumPaymentAmount)
+			l.NextPaymentDueDate = cc.GetNextPaymentDueDate()
+			l.LastPaymentAmount = toFloat64(cc.LastPaymentAmount)
+			l.LastPaymentDate = cc.LastPaymentDate
+			l.IsOverdue = cc.GetIsOverdue()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range resp.Liabilities.Mortgage {
+		m := m
+		err := add(m.AccountId, liabilityMortgage, m, func(l *storedLiability) {
+			l.InterestRate = optionalValue(m.InterestRate.GetPercentageOk())
+			l.MinimumPayment = optionalValue(m.GetNextMonthlyPaymentOk())
+			l.NextPaymentDueDate = m.GetNextPaymentDueDate()
+			l.LastPaymentAmount = optionalValue(m.GetLastPaymentAmountOk())
+			l.LastPaymentDate = m.GetLastPaymentDate()
+			l.IsOverdue = optionalValue(m.GetPastDueAmountOk()) > 0
+			l.MaturityDate = m.GetMaturityDate()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range resp.Liabilities.Student {
+		s := s
+		err := add(s.GetAccountId(), liabilityStudent, s, func(l *storedLiability) {
+			l.InterestRate = toFloat64(s.InterestRatePercentage)
+			l.MinimumPayment = optionalValue(s.GetMinimumPaymentAmountOk())
+			l.NextPaymentDueDate = s.GetNextPaymentDueDate()
+			l.LastPaymentAmount = optionalValue(s.GetLastPaymentAmountOk())
+			l.LastPaymentDate = s.GetLastPaymentDate()
+			l.IsOverdue = s.GetIsOverdue()
+			l.MaturityDate = s.GetExpectedPayoffDate()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter := bson.M{"user_id": it.UserID, "item_id": it.ItemID}
+	if _, err := collection("liabilities").DeleteMany(ctx, filter); err != nil {
+		return nil, err
+	}
+	if len(liabilities) == 0 {
+		return liabilities, nil
+	}
+	docs := make([]interface{}, 0, len(liabilities))
+	for _, l := range liabilities {
+		docs = append(docs, l)
+	}
+	if _, err := collection("liabilities").InsertMany(ctx, docs); err != nil {
+		return nil, err
+	}
+	return liabilities, nil
+}
+
+func liabilities(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := requireItem(c)
+	if !ok {
+		return
+	}
+
+	liabilitiesGetResp, _, err := client.PlaidApi.LiabilitiesGet(ctx).LiabilitiesGetRequest(
+		*plaid.NewLiabilitiesGetRequest(it.AccessToken),
+	).Execute()
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	if _, err := saveLiabilities(ctx, it, &liabilitiesGetResp); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"liabilities": liabilitiesGetResp,
+	})
+}
+
+func findLiabilities(ctx context.Context, filter bson.M) ([]storedLiability, error) {
+	curr, err := collection("liabilities").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "type", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	all := make([]storedLiability, 0)
+	if err := curr.All(ctx, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// localToday is today's local date at midnight UTC, comparable with parsed
+// due dates.
+func localToday() time.Time {
+	now := time.Now().Local()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// addMonths is the date n months after t on t's day of the month, or on
+// the last day of the month when it is shorter, so that a due date on the
+// 31st stays at the end of the month rather than drifting.
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, 0, 0, 0, 0, t.Location())
+	day := t.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return time.Date(first.Year(), first.Month(), day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// nextDueDate is the liability's next payment due date on or after today.
+// A stored due date that has passed is rolled forward a month at a time,
+// and projected reports whether that happened.
+func (l *storedLiability) nextDueDate(today time.Time) (due time.Time, projected bool, ok bool) {
+	stored, err := time.Parse("2006-01-02", l.NextPaymentDueDate)
+	if err != nil {
+		return time.Time{}, false, false
+	}
+	due = stored
+	for n := 1; due.Before(today); n++ {
+		due = addMonths(stored, n)
+		projected = true
+	}
+	return due, projected, true
+}
+
+type amortizationRow struct {
+	Date      string  `json:"date"`
+	Payment   float64 `json:"payment"`
+	Interest  float64 `json:"interest"`
+	Principal float64 `json:"principal"`
+	Balance   float64 `json:"balance"`
+}
+
+type payoffProjection struct {
+	AccountID      string            `json:"account_id"`
+	Type           string            `json:"type"`
+	Name           string            `json:"name"`
+	Balance        float64           `json:"balance"`
+	InterestRate   float64           `json:"interest_rate"`
+	MonthlyPayment float64           `json:"monthly_payment"`
+	PaysOff        bool              `json:"pays_off"`
+	Months         int               `json:"months,omitempty"`
+	PayoffDate     string            `json:"payoff_date,omitempty"`
+	TotalInterest  float64           `json:"total_interest"`
+	TotalPaid      float64           `json:"total_paid"`
+	Schedule       []amortizationRow `json:"schedule,omitempty"`
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// project amortizes the balance with monthly compounding at the liability's
+// interest rate, paying the minimum payment plus extra every month from the
+// next due date on. A payment that does not cover the first month's
+// interest never pays the debt off.
+func (l *storedLiability) project(today time.Time, extra float64, withSchedule bool) payoffProjection {
+	p := payoffProjection{
+		AccountID:      l.AccountID,
+		Type:           l.Type,
+		Name:           l.Name,
+		Balance:        l.Balance,
+		InterestRate:   l.InterestRate,
+		MonthlyPayment: roundCents(l.MinimumPayment + extra),
+	}
+
+	first, _, ok := l.nextDueDate(today)
+	if !ok {
+		first = addMonths(today, 1)
+	}
+	due := first
+
+	rate := l.InterestRate / 100 / 12
+	balance := l.Balance
+	if balance <= 0 {
+		p.PaysOff = true
+		return p
+	}
+	if p.MonthlyPayment <= roundCents(balance*rate) {
+		return p
+	}
+
+	for month := 0; month < maxProjectionMonths && balance > 0; month++ {
+		interest := roundCents(balance * rate)
+		payment := math.Min(p.MonthlyPayment, roundCents(balance+interest))
+		principal := roundCents(payment - interest)
+		balance = roundCents(balance - principal)
+
+		p.Months++
+		p.TotalInterest += interest
+		p.TotalPaid += payment
+		p.PayoffDate = due.Format("2006-01-02")
+		if withSchedule {
+			p.Schedule = append(p.Schedule, amortizationRow{
+				Date:      p.PayoffDate,
+				Payment:   payment,
+				Interest:  interest,
+				Principal: principal,
+				Balance:   balance,
+			})
+		}
+		due = addMonths(first, month+1)
+	}
+
+	p.PaysOff = balance <= 0
+	if !p.PaysOff {
+		p.PayoffDate = ""
+	}
+	p.TotalInterest = roundCents(p.TotalInterest)
+	p.TotalPaid = roundCents(p.TotalPaid)
+	return p
+}
+
+func extraPayment(c *gin.Context) (float64, error) {
+	v := c.Query("extra_payment")
+	if v == "" {
+		return 0, nil
+	}
+	extra, err := strconv.ParseFloat(v, 64)
+	if err != nil || extra < 0 {
+		return 0, invalidf("extra_payment must be a non-negative amount")
+	}
+	return extra, nil
+}
+
+// liabilityProjections projects the payoff of every stored liability,
+// optionally paying extra_payment on top of each minimum payment.
+func liabilityProjections(c *gin.Context) {
+	extra, err := extraPayment(c)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	filter := bson.M{"user_id": currentPrincipal(c).Subject}
+	if id := c.Query("item_id"); id != "" {
+		filter["item_id"] = id
+	}
+	all, err := findLiabilities(c.Request.Context(), filter)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	today := localToday()
+	projections := make([]payoffProjection, 0, len(all))
+	for i := range all {
+		projections = append(projections, all[i].project(today, extra, false))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"projections": projections})
+}
+
+// liabilitySchedule returns the full amortization schedule of one
+// liability.
+func liabilitySchedule(c *gin.Context) {
+	extra, err := extraPayment(c)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	var l storedLiability
+	err = collection("liabilities").FindOne(c.Request.Context(), bson.M{
+		"_id":     c.Param("account_id"),
+		"user_id": currentPrincipal(c).Subject,
+	}).Decode(&l)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "liability not found"})
+		return
+	}
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"liability":  l,
+		"projection": l.project(localToday(), extra, true),
+	})
+}
+
+type upcomingPayment struct {
+	AccountID       string  `json:"account_id"`
+	Type            string  `json:"type"`
+	Name            string  `json:"name"`
+	DueDate         string  `json:"due_date"`
+	MinimumPayment  float64 `json:"minimum_payment"`
+	IsoCurrencyCode string  `json:"iso_currency_code,omitempty"`
+	IsOverdue       bool    `json:"is_overdue"`
+	Projected       bool    `json:"projected"`
+}
+
+// upcomingLiabilityPayments lists minimum payments due within the next days
+// (30 by default), soonest first.
+func upcomingLiabilityPayments(c *gin.Context) {
+	days := 30
+	if v := c.Query("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 366 {
+			renderError(c, invalidf("days must be between 1 and 366"))
+			return
+		}
+		days = n
+	}
+
+	all, err := findLiabilities(c.Request.Context(), bson.M{"user_id": currentPrincipal(c).Subject})
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	today := localToday()
+	until := today.AddDate(0, 0, days)
+
+	upcoming := make([]upcomingPayment, 0)
+	for i := range all {
+		l := &all[i]
+		due, projected, ok := l.nextDueDate(today)
+		if !ok || due.After(until) {
+			continue
+		}
+		upcoming = append(upcoming, upcomingPayment{
+			AccountID:       l.AccountID,
+			Type:            l.Type,
+			Name:            l.Name,
+			DueDate:         due.Format("2006-01-02"),
+			MinimumPayment:  l.MinimumPayment,
+			IsoCurrencyCode: l.IsoCurrencyCode,
+			IsOverdue:       l.IsOverdue,
+			Projected:       projected,
+		})
+	}
+	sort.Slice(upcoming, func(i, j int) bool { return upcoming[i].DueDate < upcoming[j].DueDate })
+
+	c.JSON(http.StatusOK, gin.H{
+		"days":     days,
+		"payments": upcoming,
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddMonths(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+
+	tests := []struct {
+		from string
+		n    int
+		want string
+	}{
+		{"2024-01-31", 1, "2024-02-29"},
+		{"2024-01-31", 2, "2024-03-31"},
+		{"2024-01-31", 3, "2024-04-30"},
+		{"2023-01-31", 1, "2023-02-28"},
+		{"2024-01-15", 1, "2024-02-15"},
+		{"2024-11-30", 3, "2025-02-28"},
+		{"2024-12-31", 12, "2025-12-31"},
+	}
+	for _, tt := range tests {
+		if got := addMonths(day(tt.from), tt.n).Format("2006-01-02"); got != tt.want {
+			t.Errorf("addMonths(%s, %d) = %s, want %s", tt.from, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestNextDueDate(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+
+	tests := []struct {
+		stored    string
+		today     string
+		want      string
+		projected bool
+		ok        bool
+	}{
+		{"2024-01-31", "2024-01-20", "2024-01-31", false, true},
+		{"2024-01-31", "2024-01-31", "2024-01-31", false, true},
+		{"2024-01-31", "2024-02-10", "2024-02-29", true, true},
+		// Not Mar 29: each month rolls from the original day.
+		{"2024-01-31", "2024-03-01", "2024-03-31", true, true},
+		{"", "2024-03-01", "", false, false},
+	}
+	for _, tt := range tests {
+		l := storedLiability{NextPaymentDueDate: tt.stored}
+		due, projected, ok := l.nextDueDate(day(tt.today))
+		if ok != tt.ok {
+			t.Fatalf("nextDueDate(%q) ok = %v, want %v", tt.stored, ok, tt.ok)
+		}
+		if !ok {
+			continue
+		}
+		if got := due.Format("2006-01-02"); got != tt.want || projected != tt.projected {
+			t.Errorf("nextDueDate(%q) on %s = %s, %v, want %s, %v", tt.stored, tt.today, got, projected, tt.want, tt.projected)
+		}
+	}
+}
+
+func TestProject(t *testing.T) {
+	today, _ := time.Parse("2006-01-02", "2024-01-20")
+
+	tests := []struct {
+		name      string
+		liability storedLiability
+		extra     float64
+		paysOff   bool
+		months    int
+		payoff    string
+	}{
+		{
+			name:      "payment does not cover interest",
+			liability: storedLiability{Balance: 10000, InterestRate: 24, MinimumPayment: 150, NextPaymentDueDate: "2024-01-31"},
+			paysOff:   false,
+		},
+		{
+			name:      "payment equal to interest",
+			liability: storedLiability{Balance: 10000, InterestRate: 24, MinimumPayment: 200, NextPaymentDueDate: "2024-01-31"},
+			paysOff:   false,
+		},
+		{
+			name:      "extra payment covers interest",
+			liability: storedLiability{Balance: 10000, InterestRate: 24, MinimumPayment: 150, NextPaymentDueDate: "2024-01-31"},
+			extra:     9900,
+			paysOff:   true,
+			months:    2,
+			payoff:    "2024-02-29",
+		},
+		{
+			name:      "no interest, month-end due dates",
+			liability: storedLiability{Balance: 300, MinimumPayment: 100, NextPaymentDueDate: "2024-01-31"},
+			paysOff:   true,
+			months:    3,
+			payoff:    "2024-03-31",
+		},
+		{
+			name:      "nothing owed",
+			liability: storedLiability{Balance: 0, MinimumPayment: 100},
+			paysOff:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.liability.project(today, tt.extra, true)
+			if p.PaysOff != tt.paysOff {
+				t.Fatalf("pays off = %v, want %v", p.PaysOff, tt.paysOff)
+			}
+			if p.Months != tt.months {
+				t.Errorf("months = %d, want %d", p.Months, tt.months)
+			}
+			if p.PayoffDate != tt.payoff {
+				t.Errorf("payoff date = %q, want %q", p.PayoffDate, tt.payoff)
+			}
+			if !tt.paysOff && len(p.Schedule) != 0 {
+				t.Errorf("schedule has %d rows, want none", len(p.Schedule))
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+
+	plaid "github.com/plaid/plaid-go/plaid"
+)
+
+// Link token settings. Callers of /api/create_link_token may pick products,
+// countries, languages, account subtypes, webhooks and redirect URIs, but
+// only from these allow-lists.
+var (
+	LINK_CLIENT_NAME                 = ""
+	PLAID_WEBHOOK                    = ""
+	LINK_ALLOWED_PRODUCTS            []string
+	LINK_ALLOWED_COUNTRY_CODES       []string
+	LINK_ALLOWED_LANGUAGES           []string
+	LINK_ALLOWED_DEPOSITORY_SUBTYPES []string
+	LINK_ALLOWED_CREDIT_SUBTYPES     []string
+	LINK_ALLOWED_WEBHOOKS            []string
+	LINK_ALLOWED_REDIRECT_URIS       []string
+)
+
+func initLinkToken() {
+	LINK_CLIENT_NAME = os.Getenv("LINK_CLIENT_NAME")
+	if LINK_CLIENT_NAME == "" {
+		LINK_CLIENT_NAME = "Plaid Quickstart"
+	}
+	PLAID_WEBHOOK = os.Getenv("PLAID_WEBHOOK")
+
+	LINK_ALLOWED_PRODUCTS = envList("LINK_ALLOWED_PRODUCTS", PLAID_PRODUCTS)
+	LINK_ALLOWED_COUNTRY_CODES = envList("LINK_ALLOWED_COUNTRY_CODES", PLAID_COUNTRY_CODES)
+	LINK_ALLOWED_LANGUAGES = envList("LINK_ALLOWED_LANGUAGES", "en")
+	LINK_ALLOWED_DEPOSITORY_SUBTYPES = envList("LINK_ALLOWED_DEPOSITORY_SUBTYPES",
+		"checking,savings,hsa,cd,money market,paypal,prepaid,cash management,ebt")
+	LINK_ALLOWED_CREDIT_SUBTYPES = envList("LINK_ALLOWED_CREDIT_SUBTYPES", "credit card,paypal")
+	LINK_ALLOWED_WEBHOOKS = envList("LINK_ALLOWED_WEBHOOKS", PLAID_WEBHOOK)
+	LINK_ALLOWED_REDIRECT_URIS = envList("LINK_ALLOWED_REDIRECT_URIS", PLAID_REDIRECT_URI)
+
+	// Link tokens default to these, so each needs at least one entry.
+	for name, list := range map[string][]string{
+		"PLAID_PRODUCTS":         splitList(PLAID_PRODUCTS),
+		"PLAID_COUNTRY_CODES":    splitList(PLAID_COUNTRY_CODES),
+		"LINK_ALLOWED_LANGUAGES": LINK_ALLOWED_LANGUAGES,
+	} {
+		if len(list) == 0 {
+			log.Fatalf("%s must list at least one value", name)
+		}
+	}
+}
+
+// envList reads a comma-separated list from the environment.
+func envList(name, def string) []string {
+	v := os.Getenv(name)
+	if v == "" {
+		v = def
+	}
+	return splitList(v)
+}
+
+// splitList splits a comma-separated list, trimming its entries and
+// dropping empty ones.
+func splitList(v string) []string {
+	return trimList(strings.Split(v, ","))
+}
+
+func trimList(values []string) []string {
+	var list []string
+	for _, s := range values {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// productEnabled tells whether product is one of PLAID_PRODUCTS.
+func productEnabled(product string) bool {
+	for _, p := range splitList(PLAID_PRODUCTS) {
+		if p == product {
+			return true
+		}
+	}
+	return false
+}
+
+// linkTokenOptions is the body accepted by /api/create_link_token. Fields
+// left empty fall back to the server configuration. Optional products are
+// not offered: the plaid-go version this server is built with has no
+// optional_products field on /link/token/create.
+type linkTokenOptions struct {
+	Products       []string        `json:"products"`
+	CountryCodes   []string        `json:"country_codes"`
+	Language       string          `json:"language"`
+	AccountFilters *accountFilters `json:"account_filters"`
+	Webhook        string          `json:"webhook"`
+	RedirectURI    string          `json:"redirect_uri"`
+
+	// AccessToken starts Link in update mode for an existing item.
+	AccessToken       string                                         `json:"-"`
+	PaymentInitiation *plaid.LinkTokenCreateRequestPaymentInitiation `json:"-"`
+}
+
+// accountFilters lists the account subtypes Link offers, per account type.
+type accountFilters struct {
+	Depository []string `json:"depository"`
+	Credit     []string `json:"credit"`
+}
+
+// validate fills in defaults and checks every choice against the
+// allow-lists.
+func (o *linkTokenOptions) validate() error {
+	o.Products = trimList(o.Products)
+	o.CountryCodes = trimList(o.CountryCodes)
+	o.Language = strings.TrimSpace(o.Language)
+	if len(o.Products) == 0 {
+		o.Products = splitList(PLAID_PRODUCTS)
+	}
+	if len(o.CountryCodes) == 0 {
+		o.CountryCodes = splitList(PLAID_COUNTRY_CODES)
+	}
+	if o.Language == "" {
+		o.Language = LINK_ALLOWED_LANGUAGES[0]
+	}
+	if o.Webhook == "" {
+		o.Webhook = PLAID_WEBHOOK
+	}
+	if o.RedirectURI == "" {
+		o.RedirectURI = PLAID_REDIRECT_URI
+	}
+
+	if err := checkAllowed("product", o.Products, LINK_ALLOWED_PRODUCTS); err != nil {
+		return err
+	}
+	if err := checkAllowed("country code", o.CountryCodes, LINK_ALLOWED_COUNTRY_CODES); err != nil {
+		return err
+	}
+	if err := checkAllowed("language", []string{o.Language}, LINK_ALLOWED_LANGUAGES); err != nil {
+		return err
+	}
+	if o.AccountFilters != nil {
+		if err := checkAllowed("depository subtype", o.AccountFilters.Depository, LINK_ALLOWED_DEPOSITORY_SUBTYPES); err != nil {
+			return err
+		}
+		if err := checkAllowed("credit subtype", o.AccountFilters.Credit, LINK_ALLOWED_CREDIT_SUBTYPES); err != nil {
+			return err
+		}
+	}
+	if o.Webhook != "" {
+		if err := checkAllowed("webhook", []string{o.Webhook}, LINK_ALLOWED_WEBHOOKS); err != nil {
+			return err
+		}
+	}
+	if o.RedirectURI != "" {
+		if err := checkAllowed("redirect URI", []string{o.RedirectURI}, LINK_ALLOWED_REDIRECT_URIS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkAllowed(what string, values, allowed []string) error {
+	for _, v := range values {
+		if !itemExists(allowed, v) {
+			return invalidf("%s %q is not allowed", what, v)
+		}
+	}
+	return nil
+}
+
+func convertAccountSubtypes(subtypes []string) []plaid.AccountSubtype {
+	converted := []plaid.AccountSubtype{}
+	for _, s := range subtypes {
+		converted = append(converted, plaid.AccountSubtype(s))
+	}
+	return converted
+}
+
+// linkTokenCreate creates a link token for userID using the specified
+// options, which must have been validated.
+func linkTokenCreate(ctx context.Context, userID string, opts *linkTokenOptions) (string, error) {
+	user := plaid.LinkTokenCreateRequestUser{
+		ClientUserId: userID,
+	}
+
+	request := plaid.NewLinkTokenCreateRequest(
+		LINK_CLIENT_NAME,
+		opts.Language,
+		convertCountryCodes(opts.CountryCodes),
+		user,
+	)
+
+	// Link update mode is started with the item's access token and must not
+	// request products.
+	if opts.AccessToken != "" {
+		request.SetAccessToken(opts.AccessToken)
+	} else {
+		request.SetProducts(convertProducts(opts.Products))
+	}
+
+	if opts.RedirectURI != "" {
+		request.SetRedirectUri(opts.RedirectURI)
+	}
+
+	if opts.Webhook != "" {
+		request.SetWebhook(opts.Webhook)
+	}
+
+	if f := opts.AccountFilters; f != nil && (len(f.Depository) > 0 || len(f.Credit) > 0) {
+		filters := plaid.LinkTokenAccountFilters{}
+		if len(f.Depository) > 0 {
+			filters.SetDepository(*plaid.NewDepositoryFilter(convertAccountSubtypes(f.Depository)))
+		}
+		if len(f.Credit) > 0 {
+			filters.SetCredit(*plaid.NewCreditFilter(convertAccountSubtypes(f.Credit)))
+		}
+		request.SetAccountFilters(filters)
+	}
+
+	if opts.PaymentInitiation != nil {
+		request.SetPaymentInitiation(*opts.PaymentInitiation)
+	}
+
+	linkTokenCreateResp, _, err := client.PlaidApi.LinkTokenCreate(ctx).LinkTokenCreateRequest(*request).Execute()
+
+	if err != nil {
+		return "", err
+	}
+
+	return linkTokenCreateResp.GetLinkToken(), nil
+}
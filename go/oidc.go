@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	// OIDC_ISSUER is the expected "iss" claim. When OIDC_JWKS_FILE is not set
+	// the signing keys are discovered from the issuer's metadata.
+	OIDC_ISSUER = ""
+	// OIDC_AUDIENCE is the expected "aud" claim, if set.
+	OIDC_AUDIENCE = ""
+	// OIDC_JWKS_FILE is a local JSON Web Key Set used instead of discovery.
+	OIDC_JWKS_FILE = ""
+)
+
+// jwksRefreshInterval limits how often an unknown key id triggers a refetch of
+// the issuer's key set.
+const jwksRefreshInterval = time.Minute
+
+var jwtMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+type jwks struct {
+	mu        sync.RWMutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+	load      func(ctx context.Context) ([]byte, error)
+}
+
+var oidcKeys *jwks
+
+func initOIDC() error {
+	OIDC_ISSUER = os.Getenv("OIDC_ISSUER")
+	OIDC_AUDIENCE = os.Getenv("OIDC_AUDIENCE")
+	OIDC_JWKS_FILE = os.Getenv("OIDC_JWKS_FILE")
+
+	if OIDC_ISSUER == "" && OIDC_JWKS_FILE == "" {
+		return errors.New("AUTH_MODE oidc needs OIDC_ISSUER or OIDC_JWKS_FILE")
+	}
+
+	oidcKeys = &jwks{keys: map[string]interface{}{}}
+	if OIDC_JWKS_FILE != "" {
+		oidcKeys.load = func(context.Context) ([]byte, error) {
+			return ioutil.ReadFile(OIDC_JWKS_FILE)
+		}
+	} else {
+		oidcKeys.load = fetchIssuerJWKS
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return oidcKeys.refresh(ctx)
+}
+
+// fetchIssuerJWKS follows the issuer's OpenID configuration to its key set.
+func fetchIssuerJWKS(ctx context.Context) ([]byte, error) {
+	discovery := strings.TrimSuffix(OIDC_ISSUER, "/") + "/.well-known/openid-configuration"
+	body, err := httpGet(ctx, discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		return nil, err
+	}
+	if metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("no jwks_uri in %s", discovery)
+	}
+
+	return httpGet(ctx, metadata.JWKSURI)
+}
+
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (k *jwks) refresh(ctx context.Context) error {
+	body, err := k.load(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(body)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.fetchedAt = time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+// key returns the verification key for kid, refetching the key set once per
+// jwksRefreshInterval to pick up rotated keys.
+func (k *jwks) key(ctx context.Context, kid string) (interface{}, error) {
+	k.mu.RLock()
+	key, ok := k.keys[kid]
+	stale := time.Since(k.fetchedAt) > jwksRefreshInterval
+	k.mu.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+	if stale {
+		if err := k.refresh(ctx); err != nil {
+			return nil, err
+		}
+		k.mu.RLock()
+		key, ok = k.keys[kid]
+		k.mu.RUnlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJWKS(body []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", jwk.Kid, err)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey decodes RSA and EC keys; other key types are skipped.
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func authenticateBearerToken(c *gin.Context) (*principal, error) {
+	token := bearerToken(c)
+	if token == "" || !isJWT(token) {
+		return nil, nil
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return oidcKeys.key(c.Request.Context(), kid)
+	}, jwt.WithValidMethods(jwtMethods))
+	if err != nil {
+		return nil, errUnauthenticated
+	}
+
+	// MapClaims only checks exp when it is present; a token without one
+	// would never expire.
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errUnauthenticated
+	}
+	if OIDC_ISSUER != "" && !claims.VerifyIssuer(OIDC_ISSUER, true) {
+		return nil, errUnauthenticated
+	}
+	if OIDC_AUDIENCE != "" && !claims.VerifyAudience(OIDC_AUDIENCE, true) {
+		return nil, errUnauthenticated
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errUnauthenticated
+	}
+
+	return &principal{Subject: subject, Scopes: tokenScopes(claims), Method: "oidc"}, nil
+}
+
+// tokenScopes reads the space-separated "scope" claim or the "scp" list used
+// by some providers. The wildcard scope is reserved for ADMIN_API_KEY and is
+// never taken from a token.
+func tokenScopes(claims jwt.MapClaims) []string {
+	var raw []string
+	if s, ok := claims["scope"].(string); ok {
+		raw = strings.Fields(s)
+	} else if list, ok := claims["scp"].([]interface{}); ok {
+		for _, v := range list {
+			if s, ok := v.(string); ok {
+				raw = append(raw, s)
+			}
+		}
+	}
+
+	var scopes []string
+	for _, s := range raw {
+		if s != scopeAll {
+			scopes = append(scopes, s)
+		}
+	}
+	return scopes
+}
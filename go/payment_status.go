@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Payment statuses reported by Plaid.
+const (
+	paymentStatusInputNeeded       = "PAYMENT_STATUS_INPUT_NEEDED"
+	paymentStatusAuthorising       = "PAYMENT_STATUS_AUTHORISING"
+	paymentStatusProcessing        = "PAYMENT_STATUS_PROCESSING"
+	paymentStatusInitiated         = "PAYMENT_STATUS_INITIATED"
+	paymentStatusEstablished       = "PAYMENT_STATUS_ESTABLISHED"
+	paymentStatusExecuted          = "PAYMENT_STATUS_EXECUTED"
+	paymentStatusCompleted         = "PAYMENT_STATUS_COMPLETED"
+	paymentStatusRejected          = "PAYMENT_STATUS_REJECTED"
+	paymentStatusFailed            = "PAYMENT_STATUS_FAILED"
+	paymentStatusBlocked           = "PAYMENT_STATUS_BLOCKED"
+	paymentStatusInsufficientFunds = "PAYMENT_STATUS_INSUFFICIENT_FUNDS"
+	paymentStatusCancelled         = "PAYMENT_STATUS_CANCELLED"
+	paymentStatusUnknown           = "PAYMENT_STATUS_UNKNOWN"
+)
+
+// paymentTransitions lists, for each status, the statuses a payment may move
+// to next. Statuses without an entry are terminal.
+var paymentTransitions = map[string][]string{
+	paymentStatusInputNeeded: {
+		paymentStatusAuthorising, paymentStatusProcessing, paymentStatusInitiated,
+		paymentStatusEstablished, paymentStatusExecuted, paymentStatusCompleted, paymentStatusRejected,
+		paymentStatusFailed, paymentStatusBlocked, paymentStatusInsufficientFunds,
+		paymentStatusCancelled, paymentStatusUnknown,
+	},
+	paymentStatusAuthorising: {
+		paymentStatusInputNeeded, paymentStatusProcessing, paymentStatusInitiated,
+		paymentStatusEstablished, paymentStatusExecuted, paymentStatusCompleted, paymentStatusRejected,
+		paymentStatusFailed, paymentStatusBlocked, paymentStatusInsufficientFunds,
+		paymentStatusCancelled, paymentStatusUnknown,
+	},
+	paymentStatusProcessing: {
+		paymentStatusInitiated, paymentStatusExecuted, paymentStatusCompleted,
+		paymentStatusRejected, paymentStatusFailed, paymentStatusBlocked,
+		paymentStatusInsufficientFunds, paymentStatusUnknown,
+	},
+	paymentStatusInitiated: {
+		paymentStatusExecuted, paymentStatusCompleted, paymentStatusRejected,
+		paymentStatusFailed, paymentStatusBlocked, paymentStatusInsufficientFunds,
+		paymentStatusUnknown,
+	},
+	// A standing order stays established until it is cancelled or fails.
+	paymentStatusEstablished: {
+		paymentStatusCancelled, paymentStatusFailed, paymentStatusUnknown,
+	},
+	paymentStatusExecuted: {
+		paymentStatusCompleted, paymentStatusFailed,
+	},
+	paymentStatusUnknown: {
+		paymentStatusInputNeeded, paymentStatusAuthorising, paymentStatusProcessing,
+		paymentStatusInitiated, paymentStatusEstablished, paymentStatusExecuted,
+		paymentStatusCompleted, paymentStatusRejected, paymentStatusFailed,
+		paymentStatusBlocked, paymentStatusInsufficientFunds, paymentStatusCancelled,
+	},
+}
+
+func isTerminalPaymentStatus(status string) bool {
+	_, ok := paymentTransitions[status]
+	return !ok
+}
+
+func canTransitionPayment(from, to string) bool {
+	return itemExists(paymentTransitions[from], to)
+}
+
+// authoritativePaymentSources are the sources that read the status from
+// Plaid's /payment_initiation/payment/get. Their status is applied even
+// when the state machine has no edge to it, as webhooks may have been missed
+// or delivered out of order.
+var authoritativePaymentSources = []string{"poll", "get"}
+
+// PAYMENT_POLL_INTERVAL is how often payments not yet in a terminal status
+// are refreshed from Plaid, in case a webhook was missed.
+var PAYMENT_POLL_INTERVAL = 5 * time.Minute
+
+// PAYMENT_NOTIFY_URL receives a POST with the payment when it reaches a
+// terminal status.
+var PAYMENT_NOTIFY_URL = ""
+
+// paymentNotifiers are called once a payment reaches a terminal status.
+var paymentNotifiers []func(ctx context.Context, p *storedPayment)
+
+func initPaymentStatus() {
+	if v := os.Getenv("PAYMENT_POLL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid PAYMENT_POLL_INTERVAL %q: %v", v, err)
+		}
+		PAYMENT_POLL_INTERVAL = d
+	}
+
+	PAYMENT_NOTIFY_URL = os.Getenv("PAYMENT_NOTIFY_URL")
+	paymentNotifiers = append(paymentNotifiers, logPaymentOutcome)
+	if PAYMENT_NOTIFY_URL != "" {
+		paymentNotifiers = append(paymentNotifiers, postPaymentOutcome)
+	}
+
+	registerWebhookHandler("PAYMENT_INITIATION", handlePaymentWebhook)
+	registerJob("payment-status-poll", PAYMENT_POLL_INTERVAL, pollPaymentStatuses)
+}
+
+// transitionPayment moves a payment to a new status if the state machine
+// allows it or the status was read from Plaid, recording the change in its
+// history. It reports whether the status changed.
+func transitionPayment(ctx context.Context, paymentID, to, source string) (bool, error) {
+	var p storedPayment
+	if err := collection("payments").FindOne(ctx, bson.M{"_id": paymentID}).Decode(&p); err != nil {
+		return false, err
+	}
+
+	if p.Status == to {
+		return false, nil
+	}
+	outOfOrder := !canTransitionPayment(p.Status, to)
+	if outOfOrder {
+		if !itemExists(authoritativePaymentSources, source) {
+			log.Printf("Ignoring payment %s transition %s -> %s from %s\n", paymentID, p.Status, to, source)
+			return false, nil
+		}
+		log.Printf("Applying out-of-order payment %s transition %s -> %s from %s\n", paymentID, p.Status, to, source)
+	}
+
+	now := time.Now().UTC()
+	res, err := collection("payments").UpdateOne(ctx,
+		// Matching on the old status makes concurrent updates from a webhook
+		// and the poller apply only once.
+		bson.M{"_id": paymentID, "status": p.Status},
+		bson.M{
+			"$set": bson.M{"status": to, "updated_at": now},
+			"$push": bson.M{"status_history": paymentStatusChange{
+				From:       p.Status,
+				Status:     to,
+				At:         now,
+				Source:     source,
+				OutOfOrder: outOfOrder,
+			}},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	if res.ModifiedCount == 0 {
+		return false, nil
+	}
+
+	p.Status = to
+	p.UpdatedAt = now
+	if isTerminalPaymentStatus(to) {
+		for _, notify := range paymentNotifiers {
+			notify(ctx, &p)
+		}
+	}
+	return true, nil
+}
+
+type paymentStatusWebhook struct {
+	PaymentID        string `json:"payment_id"`
+	NewPaymentStatus string `json:"new_payment_status"`
+	OldPaymentStatus string `json:"old_payment_status"`
+}
+
+func handlePaymentWebhook(ctx context.Context, wh *webhook) error {
+	if wh.WebhookCode != "PAYMENT_STATUS_UPDATE" {
+		return nil
+	}
+
+	var body paymentStatusWebhook
+	if err := json.Unmarshal(wh.Body, &body); err != nil {
+		return err
+	}
+
+	_, err := transitionPayment(ctx, body.PaymentID, body.NewPaymentStatus, "webhook")
+	if err == mongo.ErrNoDocuments {
+		log.Printf("Webhook for unknown payment %s\n", body.PaymentID)
+		return nil
+	}
+	return err
+}
+
+// polledPaymentStatuses are the in-flight statuses the poller refreshes.
+// Executed payments and established standing orders are settled and only
+// change through webhooks.
+var polledPaymentStatuses = []string{
+	paymentStatusInputNeeded, paymentStatusAuthorising, paymentStatusProcessing,
+	paymentStatusInitiated, paymentStatusUnknown,
+}
+
+// pollPaymentStatuses refreshes in-flight payments that have not changed for
+// a poll interval.
+func pollPaymentStatuses(ctx context.Context) error {
+	curr, err := collection("payments").Find(ctx, bson.M{
+		"status":     bson.M{"$in": polledPaymentStatuses},
+		"updated_at": bson.M{"$lt": time.Now().Add(-PAYMENT_POLL_INTERVAL)},
+	})
+	if err != nil {
+		return err
+	}
+
+	var pending []storedPayment
+	if err := curr.All(ctx, &pending); err != nil {
+		return err
+	}
+
+	for _, p := range pending {
+		resp, _, err := client.PlaidApi.PaymentInitiationPaymentGet(ctx).PaymentInitiationPaymentGetRequest(
+			*plaid.NewPaymentInitiationPaymentGetRequest(p.PaymentID),
+		).Execute()
+		if err != nil {
+			log.Printf("Error polling payment %s: %v\n", p.PaymentID, err)
+			continue
+		}
+		if _, err := transitionPayment(ctx, p.PaymentID, resp.GetStatus(), "poll"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func logPaymentOutcome(ctx context.Context, p *storedPayment) {
+	log.Printf("Payment %s reached %s\n", p.PaymentID, p.Status)
+}
+
+// postPaymentOutcome sends the payment to PAYMENT_NOTIFY_URL.
+func postPaymentOutcome(ctx context.Context, p *storedPayment) {
+	body, err := json.Marshal(map[string]interface{}{"payment": p})
+	if err != nil {
+		log.Println("Error encoding payment notification", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, PAYMENT_NOTIFY_URL, bytes.NewReader(body))
+	if err != nil {
+		log.Println("Error creating payment notification", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Println("Error sending payment notification", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		log.Println("Payment notification rejected:", resp.Status)
+	}
+}
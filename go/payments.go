@@ -0,0 +1,605 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// This functionality is only relevant for the UK and EU Payment Initiation
+// product. Recipients and payments are created at Plaid with the caller's
+// details and kept in the payment_recipients and payments collections.
+
+type recipientBACS struct {
+	Account  string `bson:"account" json:"account"`
+	SortCode string `bson:"sort_code" json:"sort_code"`
+}
+
+type recipientAddress struct {
+	Street     []string `bson:"street" json:"street"`
+	City       string   `bson:"city" json:"city"`
+	PostalCode string   `bson:"postal_code" json:"postal_code"`
+	Country    string   `bson:"country" json:"country"`
+}
+
+type paymentRecipient struct {
+	RecipientID string            `bson:"_id" json:"recipient_id"`
+	UserID      string            `bson:"user_id" json:"-"`
+	Name        string            `bson:"name" json:"name"`
+	IBAN        string            `bson:"iban,omitempty" json:"iban,omitempty"`
+	BACS        *recipientBACS    `bson:"bacs,omitempty" json:"bacs,omitempty"`
+	Address     *recipientAddress `bson:"address,omitempty" json:"address,omitempty"`
+	Fingerprint string            `bson:"fingerprint" json:"-"`
+	CreatedAt   time.Time         `bson:"created_at" json:"created_at"`
+}
+
+type paymentSchedule struct {
+	Interval             string `bson:"interval" json:"interval"`
+	IntervalExecutionDay int32  `bson:"interval_execution_day" json:"interval_execution_day"`
+	StartDate            string `bson:"start_date" json:"start_date"`
+	EndDate              string `bson:"end_date,omitempty" json:"end_date,omitempty"`
+}
+
+type paymentStatusChange struct {
+	From   string    `bson:"from,omitempty" json:"from,omitempty"`
+	Status string    `bson:"status" json:"status"`
+	At     time.Time `bson:"at" json:"at"`
+	Source string    `bson:"source" json:"source"`
+
+	// OutOfOrder is set when Plaid reported a status the state machine has
+	// no edge to from the previous one.
+	OutOfOrder bool `bson:"out_of_order,omitempty" json:"out_of_order,omitempty"`
+}
+
+type storedPayment struct {
+	PaymentID     string                `bson:"_id" json:"payment_id"`
+	UserID        string                `bson:"user_id" json:"-"`
+	RecipientID   string                `bson:"recipient_id" json:"recipient_id"`
+	Reference     string                `bson:"reference" json:"reference"`
+	Amount        float64               `bson:"amount" json:"amount"`
+	Currency      string                `bson:"currency" json:"currency"`
+	Schedule      *paymentSchedule      `bson:"schedule,omitempty" json:"schedule,omitempty"`
+	Status        string                `bson:"status" json:"status"`
+	StatusHistory []paymentStatusChange `bson:"status_history" json:"status_history"`
+	CreatedAt     time.Time             `bson:"created_at" json:"created_at"`
+	UpdatedAt     time.Time             `bson:"updated_at" json:"updated_at"`
+}
+
+var (
+	countryCodeRe = regexp.MustCompile(`^[A-Z]{2}$`)
+	ibanRe        = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+	bacsAccountRe = regexp.MustCompile(`^[0-9]{8}$`)
+	sortCodeRe    = regexp.MustCompile(`^[0-9]{6}$`)
+	referenceRe   = regexp.MustCompile(`^[A-Za-z0-9 ]{6,18}$`)
+	isoDateRe     = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+)
+
+var paymentCurrencies = []string{"GBP", "EUR"}
+
+type createRecipientRequest struct {
+	Name    string            `json:"name"`
+	IBAN    string            `json:"iban"`
+	BACS    *recipientBACS    `json:"bacs"`
+	Address *recipientAddress `json:"address"`
+}
+
+// normalize strips the formatting people add to account numbers and checks
+// the request.
+func (r *createRecipientRequest) normalize() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return invalidf("name is required")
+	}
+
+	if (r.IBAN == "") == (r.BACS == nil) {
+		return invalidf("exactly one of iban or bacs is required")
+	}
+	if r.IBAN != "" {
+		r.IBAN = strings.ToUpper(strings.Replace(r.IBAN, " ", "", -1))
+		if !validIBAN(r.IBAN) {
+			return invalidf("iban %q is not valid", r.IBAN)
+		}
+	}
+	if r.BACS != nil {
+		r.BACS.Account = stripSeparators(r.BACS.Account)
+		r.BACS.SortCode = stripSeparators(r.BACS.SortCode)
+		if !bacsAccountRe.MatchString(r.BACS.Account) {
+			return invalidf("bacs account must be 8 digits")
+		}
+		if !sortCodeRe.MatchString(r.BACS.SortCode) {
+			return invalidf("bacs sort_code must be 6 digits")
+		}
+		if r.Address == nil {
+			return invalidf("address is required for bacs recipients")
+		}
+	}
+
+	if a := r.Address; a != nil {
+		var street []string
+		for _, line := range a.Street {
+			if line = strings.TrimSpace(line); line != "" {
+				street = append(street, line)
+			}
+		}
+		a.Street = street
+		a.City = strings.TrimSpace(a.City)
+		a.PostalCode = strings.ToUpper(strings.TrimSpace(a.PostalCode))
+		a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+
+		if len(a.Street) == 0 || len(a.Street) > 2 {
+			return invalidf("address street must have one or two lines")
+		}
+		for _, line := range a.Street {
+			if len(line) > 70 {
+				return invalidf("address street lines must be at most 70 characters")
+			}
+		}
+		if a.City == "" || len(a.City) > 35 {
+			return invalidf("address city must be 1 to 35 characters")
+		}
+		if a.PostalCode == "" {
+			return invalidf("address postal_code is required")
+		}
+		if !countryCodeRe.MatchString(a.Country) {
+			return invalidf("address country must be an ISO 3166-1 alpha-2 code")
+		}
+	}
+	return nil
+}
+
+// fingerprint identifies a recipient by its name and account so that a
+// repeated request reuses the recipient already created at Plaid.
+func (r *createRecipientRequest) fingerprint() string {
+	account := r.IBAN
+	if r.BACS != nil {
+		account = r.BACS.SortCode + "/" + r.BACS.Account
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(r.Name) + "|" + account))
+	return hex.EncodeToString(sum[:])
+}
+
+func stripSeparators(s string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(s)
+}
+
+// validIBAN checks the format and the ISO 7064 mod 97 check digits.
+func validIBAN(iban string) bool {
+	if !ibanRe.MatchString(iban) {
+		return false
+	}
+
+	rearranged := iban[4:] + iban[:4]
+	var digits strings.Builder
+	for _, r := range rearranged {
+		if r >= 'A' && r <= 'Z' {
+			digits.WriteString(strconv.Itoa(int(r-'A') + 10))
+		} else {
+			digits.WriteRune(r)
+		}
+	}
+
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	if !ok {
+		return false
+	}
+	return new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+func createPaymentRecipient(c *gin.Context) {
+	var req createRecipientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recipient, reused, err := findOrCreateRecipient(c.Request.Context(), currentPrincipal(c).Subject, &req)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	status := http.StatusCreated
+	if reused {
+		status = http.StatusOK
+	}
+	c.JSON(status, gin.H{"recipient": recipient, "reused": reused})
+}
+
+// findOrCreateRecipient returns the caller's recipient with the same name
+// and account, creating it at Plaid when there is none. It reports whether
+// an existing recipient was reused.
+func findOrCreateRecipient(ctx context.Context, userID string, req *createRecipientRequest) (*paymentRecipient, bool, error) {
+	if err := req.normalize(); err != nil {
+		return nil, false, err
+	}
+
+	var existing paymentRecipient
+	err := collection("payment_recipients").FindOne(ctx, bson.M{
+		"user_id":     userID,
+		"fingerprint": req.fingerprint(),
+	}).Decode(&existing)
+	if err == nil {
+		return &existing, true, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, false, err
+	}
+
+	paymentRecipientRequest := plaid.NewPaymentInitiationRecipientCreateRequest(req.Name)
+	if req.IBAN != "" {
+		paymentRecipientRequest.SetIban(req.IBAN)
+	}
+	if req.BACS != nil {
+		bacs := plaid.NewRecipientBACSNullable()
+		bacs.SetAccount(req.BACS.Account)
+		bacs.SetSortCode(req.BACS.SortCode)
+		paymentRecipientRequest.SetBacs(*bacs)
+	}
+	if a := req.Address; a != nil {
+		paymentRecipientRequest.SetAddress(*plaid.NewPaymentInitiationAddress(a.Street, a.City, a.PostalCode, a.Country))
+	}
+
+	paymentRecipientCreateResp, _, err := client.PlaidApi.PaymentInitiationRecipientCreate(ctx).PaymentInitiationRecipientCreateRequest(*paymentRecipientRequest).Execute()
+	if err != nil {
+		return nil, false, err
+	}
+
+	recipient := paymentRecipient{
+		RecipientID: paymentRecipientCreateResp.GetRecipientId(),
+		UserID:      userID,
+		Name:        req.Name,
+		IBAN:        req.IBAN,
+		BACS:        req.BACS,
+		Address:     req.Address,
+		Fingerprint: req.fingerprint(),
+		CreatedAt:   time.Now().UTC(),
+	}
+	if _, err := collection("payment_recipients").InsertOne(ctx, recipient); err != nil {
+		return nil, false, err
+	}
+	return &recipient, false, nil
+}
+
+func listPaymentRecipients(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	curr, err := collection("payment_recipients").Find(ctx,
+		bson.M{"user_id": currentPrincipal(c).Subject},
+		options.Find().SetSort(bson.M{"created_at": -1}),
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	all := make([]paymentRecipient, 0)
+	if err := curr.All(ctx, &all); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recipients": all})
+}
+
+type createPaymentRequest struct {
+	RecipientID string           `json:"recipient_id"`
+	Amount      float64          `json:"amount"`
+	Currency    string           `json:"currency"`
+	Reference   string           `json:"reference"`
+	Schedule    *paymentSchedule `json:"schedule"`
+}
+
+func (r *createPaymentRequest) normalize() error {
+	r.Currency = strings.ToUpper(r.Currency)
+	r.Reference = strings.TrimSpace(r.Reference)
+
+	if r.RecipientID == "" {
+		return invalidf("recipient_id is required")
+	}
+	if r.Amount <= 0 {
+		return invalidf("amount must be positive")
+	}
+	if cents := r.Amount * 100; math.Abs(cents-math.Round(cents)) > 1e-6 {
+		return invalidf("amount must have at most 2 decimals")
+	}
+	// plaid-go sends amounts as float32, which above about 131,072 cannot
+	// hold every cent.
+	if math.Round(float64(float32(r.Amount))*100) != math.Round(r.Amount*100) {
+		return invalidf("amount %.2f cannot be sent exactly", r.Amount)
+	}
+	if !itemExists(paymentCurrencies, r.Currency) {
+		return invalidf("currency must be one of %s", strings.Join(paymentCurrencies, ", "))
+	}
+	if !referenceRe.MatchString(r.Reference) {
+		return invalidf("reference must be 6 to 18 letters, digits or spaces")
+	}
+
+	if s := r.Schedule; s != nil {
+		s.Interval = strings.ToUpper(s.Interval)
+		switch plaid.PaymentScheduleInterval(s.Interval) {
+		case plaid.PAYMENTSCHEDULEINTERVAL_WEEKLY:
+			if s.IntervalExecutionDay < 1 || s.IntervalExecutionDay > 7 {
+				return invalidf("weekly schedules need an interval_execution_day from 1 (Monday) to 7")
+			}
+		case plaid.PAYMENTSCHEDULEINTERVAL_MONTHLY:
+			if s.IntervalExecutionDay < 1 || s.IntervalExecutionDay > 28 {
+				return invalidf("monthly schedules need an interval_execution_day from 1 to 28")
+			}
+		default:
+			return invalidf("schedule interval must be WEEKLY or MONTHLY")
+		}
+		if !isoDateRe.MatchString(s.StartDate) {
+			return invalidf("schedule start_date must be YYYY-MM-DD")
+		}
+		if s.EndDate != "" && (!isoDateRe.MatchString(s.EndDate) || s.EndDate < s.StartDate) {
+			return invalidf("schedule end_date must be YYYY-MM-DD and not before start_date")
+		}
+	}
+	return nil
+}
+
+// createPayment creates a payment to one of the caller's recipients and
+// stores it with its initial status.
+func createPayment(ctx context.Context, userID string, req *createPaymentRequest) (*storedPayment, error) {
+	if err := req.normalize(); err != nil {
+		return nil, err
+	}
+
+	err := collection("payment_recipients").FindOne(ctx, bson.M{
+		"_id":     req.RecipientID,
+		"user_id": userID,
+	}).Err()
+	if err == mongo.ErrNoDocuments {
+		return nil, invalidf("unknown recipient_id %q", req.RecipientID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	paymentCreateRequest := plaid.NewPaymentInitiationPaymentCreateRequest(
+		req.RecipientID,
+		req.Reference,
+		*plaid.NewPaymentAmount(req.Currency, float32(req.Amount)),
+	)
+	if s := req.Schedule; s != nil {
+		schedule := plaid.NewExternalPaymentScheduleRequest(
+			plaid.PaymentScheduleInterval(s.Interval),
+			s.IntervalExecutionDay,
+			s.StartDate,
+		)
+		if s.EndDate != "" {
+			schedule.SetEndDate(s.EndDate)
+		}
+		paymentCreateRequest.SetSchedule(*schedule)
+	}
+
+	paymentCreateResp, _, err := client.PlaidApi.PaymentInitiationPaymentCreate(ctx).PaymentInitiationPaymentCreateRequest(*paymentCreateRequest).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	payment := storedPayment{
+		PaymentID:   paymentCreateResp.GetPaymentId(),
+		UserID:      userID,
+		RecipientID: req.RecipientID,
+		Reference:   req.Reference,
+		Amount:      req.Amount,
+		Currency:    req.Currency,
+		Schedule:    req.Schedule,
+		Status:      paymentCreateResp.GetStatus(),
+		StatusHistory: []paymentStatusChange{
+			{Status: paymentCreateResp.GetStatus(), At: now, Source: "create"},
+		},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if _, err := collection("payments").InsertOne(ctx, payment); err != nil {
+		return nil, err
+	}
+
+	return &payment, nil
+}
+
+func findPayment(ctx context.Context, userID, paymentID string) (*storedPayment, error) {
+	var p storedPayment
+	err := collection("payments").FindOne(ctx, bson.M{"_id": paymentID, "user_id": userID}).Decode(&p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func latestPayment(ctx context.Context, userID string) (*storedPayment, error) {
+	var p storedPayment
+	err := collection("payments").FindOne(ctx,
+		bson.M{"user_id": userID},
+		options.FindOne().SetSort(bson.M{"created_at": -1}),
+	).Decode(&p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func postPayment(c *gin.Context) {
+	var req createPaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payment, err := createPayment(c.Request.Context(), currentPrincipal(c).Subject, &req)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"payment": payment})
+}
+
+func listPayments(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	curr, err := collection("payments").Find(ctx,
+		bson.M{"user_id": currentPrincipal(c).Subject},
+		options.Find().SetSort(bson.M{"created_at": -1}),
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	all := make([]storedPayment, 0)
+	if err := curr.All(ctx, &all); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payments": all})
+}
+
+func getPayment(c *gin.Context) {
+	payment, err := findPayment(c.Request.Context(), currentPrincipal(c).Subject, c.Param("id"))
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "payment not found"})
+		return
+	}
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payment": payment})
+}
+
+type paymentLinkTokenRequest struct {
+	PaymentID string `json:"payment_id"`
+	createPaymentRequest
+}
+
+// defaultPaymentRecipient and defaultPayment are the sandbox recipient and
+// payment created when a payment link token is requested without a body, as
+// the bundled frontend does.
+var defaultPaymentRecipient = createRecipientRequest{
+	Name: "Harry Potter",
+	IBAN: "GB33BUKB20201555555555",
+	Address: &recipientAddress{
+		Street:     []string{"4 Privet Drive"},
+		City:       "Little Whinging",
+		PostalCode: "11111",
+		Country:    "GB",
+	},
+}
+
+var defaultPayment = createPaymentRequest{
+	Amount:    1.34,
+	Currency:  "GBP",
+	Reference: "paymentRef",
+}
+
+// Creates a link token configured for payment initiation. The body either
+// names an existing payment_id of the caller or describes a new payment,
+// which is created first. Without a body a sandbox payment to a default
+// recipient is created. The payment information is associated with the
+// link token, and will not have to be passed in again when we initialize
+// Plaid Link.
+func createLinkTokenForPayment(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := currentPrincipal(c).Subject
+
+	var req paymentLinkTokenRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		recipientReq := defaultPaymentRecipient
+		addr := *recipientReq.Address
+		recipientReq.Address = &addr
+		recipient, _, err := findOrCreateRecipient(ctx, userID, &recipientReq)
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		req.createPaymentRequest = defaultPayment
+		req.RecipientID = recipient.RecipientID
+	}
+
+	var payment *storedPayment
+	var err error
+	if req.PaymentID != "" {
+		payment, err = findPayment(ctx, userID, req.PaymentID)
+		if err == mongo.ErrNoDocuments {
+			err = invalidf("unknown payment_id %q", req.PaymentID)
+		}
+	} else {
+		payment, err = createPayment(ctx, userID, &req.createPaymentRequest)
+	}
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	opts := linkTokenOptions{PaymentInitiation: plaid.NewLinkTokenCreateRequestPaymentInitiation(payment.PaymentID)}
+	if err := opts.validate(); err != nil {
+		renderError(c, err)
+		return
+	}
+	linkToken, err := linkTokenCreate(ctx, userID, &opts)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"link_token": linkToken,
+		"payment_id": payment.PaymentID,
+	})
+}
+
+// Retrieve the caller's most recent payment as currently known to Plaid.
+func payment(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	stored, err := latestPayment(ctx, currentPrincipal(c).Subject)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no payment created yet"})
+		return
+	}
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	paymentGetResp, _, err := client.PlaidApi.PaymentInitiationPaymentGet(ctx).PaymentInitiationPaymentGetRequest(
+		*plaid.NewPaymentInitiationPaymentGetRequest(stored.PaymentID),
+	).Execute()
+
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	if _, err := transitionPayment(ctx, stored.PaymentID, paymentGetResp.GetStatus(), "get"); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"payment": paymentGetResp,
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestValidIBAN(t *testing.T) {
+	tests := []struct {
+		iban string
+		want bool
+	}{
+		{"GB33BUKB20201555555555", true},
+		{"DE89370400440532013000", true},
+		{"GB34BUKB20201555555555", false},
+		{"DE89370400440532013001", false},
+		{"gb33bukb20201555555555", false},
+		{"GB33 BUKB 2020 1555 5555 55", false},
+		{"GB33", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validIBAN(tt.iban); got != tt.want {
+			t.Errorf("validIBAN(%q) = %v, want %v", tt.iban, got, tt.want)
+		}
+	}
+}
+
+func TestCreateRecipientRequestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		iban string
+		want string
+		ok   bool
+	}{
+		{"formatted", "GB33BUKB20201555555555", "GB33BUKB20201555555555", true},
+		{"lowercase", "gb33bukb20201555555555", "GB33BUKB20201555555555", true},
+		{"spaced", "GB33 BUKB 2020 1555 5555 55", "GB33BUKB20201555555555", true},
+		{"bad checksum", "GB34 BUKB 2020 1555 5555 55", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := createRecipientRequest{Name: "Harry Potter", IBAN: tt.iban}
+			err := r.normalize()
+			if (err == nil) != tt.ok {
+				t.Fatalf("normalize() = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && r.IBAN != tt.want {
+				t.Errorf("iban = %q, want %q", r.IBAN, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreatePaymentRequestNormalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount float64
+		ok     bool
+	}{
+		{"whole", 10, true},
+		{"cents", 1.34, true},
+		{"large but exact", 100000.01, true},
+		{"zero", 0, false},
+		{"negative", -5, false},
+		{"sub-cent", 1.345, false},
+		{"not exact as float32", 131072.01, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := createPaymentRequest{RecipientID: "recipient", Amount: tt.amount, Currency: "gbp", Reference: "paymentRef"}
+			if err := r.normalize(); (err == nil) != tt.ok {
+				t.Errorf("normalize() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
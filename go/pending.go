@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// When a pending transaction posts, Plaid returns the posted transaction
+// with a new ID and the pending one's ID in pending_transaction_id, and
+// stops returning the pending one. On ingest the posted transaction records
+// the pending amount it replaces, and the pending row is moved out of the
+// transactions collection into superseded_transactions so that it is never
+// counted next to its posted successor. Pending rows Plaid no longer
+// returns without a successor, such as released authorizations, are moved
+// there as expired.
+
+// Reasons a pending transaction is superseded.
+const (
+	supersededPosted  = "posted"
+	supersededExpired = "expired"
+)
+
+// pendingReconciliation links a posted transaction to its pending
+// predecessor. AmountDrift is the posted amount minus the pending amount,
+// such as a tip added to a restaurant charge.
+type pendingReconciliation struct {
+	PendingTransactionID string    `bson:"pending_transaction_id" json:"pending_transaction_id"`
+	PendingAmount        float64   `bson:"pending_amount" json:"pending_amount"`
+	PendingDate          string    `bson:"pending_date" json:"pending_date"`
+	AmountDrift          float64   `bson:"amount_drift" json:"amount_drift"`
+	ReconciledAt         time.Time `bson:"reconciled_at" json:"reconciled_at"`
+}
+
+type supersededTransaction struct {
+	Transaction  storedTransaction `bson:",inline"`
+	Reason       string            `bson:"superseded_reason"`
+	SupersededBy string            `bson:"superseded_by,omitempty"`
+	SupersededAt time.Time         `bson:"superseded_at"`
+}
+
+// findPendingPredecessors returns the stored pending transactions with the
+// given IDs, still current or already superseded, by transaction ID.
+func findPendingPredecessors(ctx context.Context, userID string, ids []string) (map[string]*storedTransaction, error) {
+	found := map[string]*storedTransaction{}
+	if len(ids) == 0 {
+		return found, nil
+	}
+
+	filter := bson.M{"user_id": userID, "transactionid": bson.M{"$in": ids}}
+	for _, name := range []string{"superseded_transactions", "transactions"} {
+		curr, err := collection(name).Find(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		var docs []storedTransaction
+		if err := curr.All(ctx, &docs); err != nil {
+			return nil, err
+		}
+		for i := range docs {
+			found[docs[i].TransactionId] = &docs[i]
+		}
+	}
+	return found, nil
+}
+
+// linkPendingPredecessors records on every posted transaction the pending
+// transaction it replaces.
+func linkPendingPredecessors(ctx context.Context, userID string, transactions []storedTransaction) error {
+	var ids []string
+	for i := range transactions {
+		if id := transactions[i].PendingTransactionID; id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	pending, err := findPendingPredecessors(ctx, userID, ids)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for i := range transactions {
+		t := &transactions[i]
+		p, ok := pending[t.PendingTransactionID]
+		if !ok {
+			continue
+		}
+		t.Reconciliation = &pendingReconciliation{
+			PendingTransactionID: p.TransactionId,
+			PendingAmount:        toFloat64(p.Amount),
+			PendingDate:          p.Date,
+			AmountDrift:          roundCents(toFloat64(t.Amount) - toFloat64(p.Amount)),
+			ReconciledAt:         now,
+		}
+	}
+	return nil
+}
+
+// supersedeTransactions moves the stored transactions matching filter to
+// superseded_transactions. supersededBy maps a pending transaction ID to its
+// posted successor. Copies are upserted by transaction ID, so a move whose
+// delete failed is simply repeated by the next save. It returns how many
+// were moved.
+func supersedeTransactions(ctx context.Context, filter bson.M, reason string, supersededBy map[string]string) (int, error) {
+	curr, err := collection("transactions").Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	var docs []storedTransaction
+	if err := curr.All(ctx, &docs); err != nil {
+		return 0, err
+	}
+	if len(docs) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now().UTC()
+	models := make([]mongo.WriteModel, 0, len(docs))
+	ids := make([]primitive.ObjectID, 0, len(docs))
+	for _, d := range docs {
+		ids = append(ids, d.ID)
+		// The copy gets its own _id.
+		d.ID = primitive.NilObjectID
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"user_id": d.UserID, "transactionid": d.TransactionId}).
+			SetReplacement(supersededTransaction{
+				Transaction:  d,
+				Reason:       reason,
+				SupersededBy: supersededBy[d.TransactionId],
+				SupersededAt: now,
+			}).
+			SetUpsert(true))
+	}
+	if _, err := collection("superseded_transactions").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		return 0, err
+	}
+	if _, err := collection("transactions").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+// pendingSuccessors maps the pending transactions the saved batch names as
+// predecessors to the posted transactions replacing them, and returns the
+// IDs of the batch and its earliest date.
+func pendingSuccessors(saved []storedTransaction) (supersededBy map[string]string, ids []string, earliest string) {
+	supersededBy = map[string]string{}
+	ids = make([]string, 0, len(saved))
+	for i := range saved {
+		t := &saved[i]
+		ids = append(ids, t.TransactionId)
+		if t.PendingTransactionID != "" {
+			supersededBy[t.PendingTransactionID] = t.TransactionId
+		}
+		if earliest == "" || t.Date < earliest {
+			earliest = t.Date
+		}
+	}
+	return supersededBy, ids, earliest
+}
+
+// supersedePending moves out the item's pending transactions that the saved
+// batch replaces: those a posted transaction names as its predecessor, and
+// those dated within the batch that Plaid no longer returns.
+func supersedePending(ctx context.Context, it *storedItem, saved []storedTransaction) (posted, expired int, err error) {
+	if len(saved) == 0 {
+		return 0, 0, nil
+	}
+
+	supersededBy, ids, earliest := pendingSuccessors(saved)
+	if len(supersededBy) > 0 {
+		predecessors := make([]string, 0, len(supersededBy))
+		for id := range supersededBy {
+			predecessors = append(predecessors, id)
+		}
+		posted, err = supersedeTransactions(ctx,
+			bson.M{"user_id": it.UserID, "pending": true, "transactionid": bson.M{"$in": predecessors}},
+			supersededPosted, supersededBy,
+		)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	expired, err = supersedeTransactions(ctx,
+		bson.M{
+			"user_id":       it.UserID,
+			"item_id":       it.ItemID,
+			"pending":       true,
+			"date":          bson.M{"$gte": earliest},
+			"transactionid": bson.M{"$nin": ids},
+		},
+		supersededExpired, nil,
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	return posted, expired, nil
+}
+
+type reconciledTransaction struct {
+	TransactionID  string                 `json:"transaction_id"`
+	ItemID         string                 `json:"item_id"`
+	AccountID      string                 `json:"account_id"`
+	Name           string                 `json:"name"`
+	Date           string                 `json:"date"`
+	Amount         float64                `json:"amount"`
+	Currency       string                 `json:"currency"`
+	Reconciliation *pendingReconciliation `json:"reconciliation"`
+}
+
+// transactionReconciliation lists the caller's posted transactions that
+// replaced a pending one in the date range, only those whose amount drifted
+// unless all is true.
+func transactionReconciliation(c *gin.Context) {
+	ctx := c.Request.Context()
+	startDate, endDate, err := dateRange(c, 30)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	filter := bson.M{
+		"user_id":        currentPrincipal(c).Subject,
+		"date":           bson.M{"$gte": startDate, "$lte": endDate},
+		"reconciliation": bson.M{"$exists": true},
+	}
+	if id := c.Query("item_id"); id != "" {
+		filter["item_id"] = id
+	}
+	if strings.ToLower(c.Query("all")) != "true" {
+		filter["reconciliation.amount_drift"] = bson.M{"$ne": 0}
+	}
+
+	curr, err := collection("transactions").Find(ctx, filter, options.Find().SetSort(bson.M{"date": -1}))
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	var docs []storedTransaction
+	if err := curr.All(ctx, &docs); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	reconciled := make([]reconciledTransaction, 0, len(docs))
+	for _, d := range docs {
+		reconciled = append(reconciled, reconciledTransaction{
+			TransactionID:  d.TransactionId,
+			ItemID:         d.ItemID,
+			AccountID:      d.AccountId,
+			Name:           d.Name,
+			Date:           d.Date,
+			Amount:         toFloat64(d.Amount),
+			Currency:       d.Currency,
+			Reconciliation: d.Reconciliation,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"start_date":   startDate,
+		"end_date":     endDate,
+		"transactions": reconciled,
+	})
+}
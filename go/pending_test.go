@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/plaid/plaid-go/plaid"
+)
+
+func TestPendingSuccessors(t *testing.T) {
+	tx := func(id, date, pendingID string) storedTransaction {
+		return storedTransaction{
+			Transaction:          plaid.Transaction{TransactionId: id, Date: date},
+			PendingTransactionID: pendingID,
+		}
+	}
+
+	tests := []struct {
+		name         string
+		saved        []storedTransaction
+		supersededBy map[string]string
+		earliest     string
+	}{
+		{
+			name:         "posted with and without predecessors",
+			saved:        []storedTransaction{tx("p1", "2024-03-05", "pend1"), tx("p2", "2024-03-02", ""), tx("p3", "2024-03-04", "pend3")},
+			supersededBy: map[string]string{"pend1": "p1", "pend3": "p3"},
+			earliest:     "2024-03-02",
+		},
+		{
+			name:         "pending only",
+			saved:        []storedTransaction{tx("pend1", "2024-03-05", ""), tx("pend2", "2024-03-06", "")},
+			supersededBy: map[string]string{},
+			earliest:     "2024-03-05",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			supersededBy, ids, earliest := pendingSuccessors(tt.saved)
+			if len(ids) != len(tt.saved) {
+				t.Errorf("got %d IDs, want %d", len(ids), len(tt.saved))
+			}
+			if earliest != tt.earliest {
+				t.Errorf("earliest = %q, want %q", earliest, tt.earliest)
+			}
+			if len(supersededBy) != len(tt.supersededBy) {
+				t.Fatalf("superseded by = %v, want %v", supersededBy, tt.supersededBy)
+			}
+			for pending, posted := range tt.supersededBy {
+				if supersededBy[pending] != posted {
+					t.Errorf("%s superseded by %q, want %q", pending, supersededBy[pending], posted)
+				}
+			}
+		})
+	}
+}
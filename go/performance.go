@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Portfolio analytics are computed from the stored holdings snapshots and
+// investment transactions, so they only cover what has been backfilled and
+// snapshotted. Values are summed as reported, so an account is assumed to
+// hold a single currency.
+
+// externalFlowSubtypes are the investment transaction subtypes that move
+// money into or out of an account, as opposed to activity inside it.
+var externalFlowSubtypes = []string{
+	"contribution", "deposit", "withdrawal", "distribution", "transfer",
+}
+
+var dividendSubtypes = []string{
+	"dividend", "qualified dividend", "non-qualified dividend",
+	"long-term capital gain", "short-term capital gain", "interest",
+}
+
+// cashFlow is money entering (positive) or leaving (negative) an account.
+type cashFlow struct {
+	Date   string
+	Amount float64
+}
+
+type returnSummary struct {
+	AccountID  string  `json:"account_id,omitempty"`
+	StartDate  string  `json:"start_date"`
+	EndDate    string  `json:"end_date"`
+	StartValue float64 `json:"start_value"`
+	EndValue   float64 `json:"end_value"`
+	NetFlows   float64 `json:"net_flows"`
+
+	// TimeWeightedReturn chains the returns between snapshots, removing the
+	// effect of deposits and withdrawals.
+	TimeWeightedReturn *float64 `json:"time_weighted_return"`
+	// MoneyWeightedReturn is the internal rate of return over the period,
+	// and MoneyWeightedAnnual the same rate annualized.
+	MoneyWeightedReturn *float64 `json:"money_weighted_return"`
+	MoneyWeightedAnnual *float64 `json:"money_weighted_return_annualized"`
+}
+
+type securityGain struct {
+	SecurityID string   `json:"security_id"`
+	Name       string   `json:"name,omitempty"`
+	Realized   float64  `json:"realized"`
+	Unrealized *float64 `json:"unrealized"`
+}
+
+type allocationShare struct {
+	Type   string  `json:"type"`
+	Value  float64 `json:"value"`
+	Weight float64 `json:"weight"`
+}
+
+type dividendTotal struct {
+	Key             string  `json:"key"`
+	IsoCurrencyCode string  `json:"iso_currency_code,omitempty"`
+	Amount          float64 `json:"amount"`
+}
+
+// computeReturns works out the returns of a series of daily values given
+// the external cash flows. Flows are assumed to happen at the end of the
+// day they are dated.
+func computeReturns(dates []string, values map[string]float64, flows []cashFlow) returnSummary {
+	var s returnSummary
+	if len(dates) == 0 {
+		return s
+	}
+	s.StartDate = dates[0]
+	s.EndDate = dates[len(dates)-1]
+	s.StartValue = values[s.StartDate]
+	s.EndValue = values[s.EndDate]
+
+	// Only flows after the first snapshot and up to the last one change the
+	// value between them.
+	var periodFlows []cashFlow
+	for _, f := range flows {
+		if f.Date > s.StartDate && f.Date <= s.EndDate {
+			periodFlows = append(periodFlows, f)
+			s.NetFlows += f.Amount
+		}
+	}
+
+	twr := 1.0
+	valid := false
+	fi := 0
+	sort.Slice(periodFlows, func(i, j int) bool { return periodFlows[i].Date < periodFlows[j].Date })
+	for i := 1; i < len(dates); i++ {
+		var flow float64
+		for fi < len(periodFlows) && periodFlows[fi].Date <= dates[i] {
+			flow += periodFlows[fi].Amount
+			fi++
+		}
+
+		prev := values[dates[i-1]]
+		if prev == 0 {
+			continue
+		}
+		twr *= (values[dates[i]] - flow) / prev
+		valid = true
+	}
+	if valid {
+		r := twr - 1
+		s.TimeWeightedReturn = &r
+	}
+
+	if annual, ok := xirr(s.StartDate, s.EndDate, s.StartValue, s.EndValue, periodFlows); ok {
+		years := daysBetween(s.StartDate, s.EndDate) / 365
+		period := math.Pow(1+annual, years) - 1
+		s.MoneyWeightedAnnual = &annual
+		s.MoneyWeightedReturn = &period
+	}
+	return s
+}
+
+func daysBetween(from, to string) float64 {
+	a, _ := time.Parse("2006-01-02", from)
+	b, _ := time.Parse("2006-01-02", to)
+	return b.Sub(a).Hours() / 24
+}
+
+// xirr finds the annual rate at which the starting value and the flows grow
+// to the ending value, by bisection.
+func xirr(startDate, endDate string, startValue, endValue float64, flows []cashFlow) (float64, bool) {
+	total := daysBetween(startDate, endDate)
+	if total <= 0 || (startValue == 0 && len(flows) == 0) {
+		return 0, false
+	}
+
+	// npv is the value at the end date of everything invested, less the
+	// ending value. It rises with the rate.
+	npv := func(rate float64) float64 {
+		v := startValue * math.Pow(1+rate, total/365)
+		for _, f := range flows {
+			v += f.Amount * math.Pow(1+rate, daysBetween(f.Date, endDate)/365)
+		}
+		return v - endValue
+	}
+
+	lo, hi := -0.9999, 10.0
+	if npv(lo) > 0 || npv(hi) < 0 {
+		return 0, false
+	}
+	for i := 0; i < 200; i++ {
+		mid := (lo + hi) / 2
+		if npv(mid) > 0 {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return (lo + hi) / 2, true
+}
+
+// flowAmount converts a Plaid investment transaction amount, positive when
+// cash leaves the account, into a flow into the account.
+func flowAmount(t *storedInvestmentTransaction) float64 {
+	return -t.Amount
+}
+
+// averageCost tracks an account's position in one security at average cost.
+type averageCost struct {
+	quantity float64
+	cost     float64
+}
+
+// realizedGains replays buys and sells at average cost and returns the gain
+// of the sells within the range, per security. A sale of more than the
+// known position is priced at the cost basis of the latest earlier
+// snapshot; when there is none the gains are flagged incomplete.
+func realizedGains(txs []storedInvestmentTransaction, snaps []holdingSnapshot, startDate string) (map[string]float64, bool) {
+	positions := map[string]*averageCost{}
+	gains := map[string]float64{}
+	complete := true
+
+	for i := range txs {
+		t := &txs[i]
+		if t.SecurityID == "" {
+			continue
+		}
+		key := t.AccountID + "/" + t.SecurityID
+		p, ok := positions[key]
+		if !ok {
+			p = &averageCost{}
+			positions[key] = p
+		}
+		qty := math.Abs(t.Quantity)
+		if qty == 0 {
+			continue
+		}
+
+		switch t.Type {
+		case "buy":
+			p.quantity += qty
+			p.cost += math.Abs(t.Amount)
+		case "sell":
+			if qty > p.quantity {
+				unitCost, ok := snapshotUnitCost(snaps, t.AccountID, t.SecurityID, t.Date)
+				if !ok {
+					complete = false
+					unitCost = 0
+					if p.quantity > 0 {
+						unitCost = p.cost / p.quantity
+					}
+				}
+				p.cost += (qty - p.quantity) * unitCost
+				p.quantity = qty
+			}
+			unitCost := p.cost / p.quantity
+			if t.Date >= startDate {
+				gains[t.SecurityID] += math.Abs(t.Amount) - unitCost*qty
+			}
+			p.quantity -= qty
+			p.cost -= unitCost * qty
+		}
+	}
+	return gains, complete
+}
+
+// snapshotUnitCost is the cost per unit of the position in the latest
+// snapshot taken before the date.
+func snapshotUnitCost(snaps []holdingSnapshot, accountID, securityID, date string) (float64, bool) {
+	var best *holdingSnapshot
+	for i := range snaps {
+		s := &snaps[i]
+		if s.AccountID != accountID || s.SecurityID != securityID || s.Date >= date {
+			continue
+		}
+		if s.CostBasis == nil || s.Quantity == 0 {
+			continue
+		}
+		if best == nil || s.Date > best.Date {
+			best = s
+		}
+	}
+	if best == nil {
+		return 0, false
+	}
+	return *best.CostBasis / best.Quantity, true
+}
+
+// datesFrom returns the dates, which are sorted, from start on, or nil if
+// there are none.
+func datesFrom(dates []string, start string) []string {
+	i := sort.SearchStrings(dates, start)
+	if i == len(dates) {
+		return nil
+	}
+	return dates[i:]
+}
+
+// overallValues sums the accounts' values on every date in the range that
+// any account was snapshotted. An account not snapshotted on a date counts
+// with its value from its previous snapshot, so that an item that failed to
+// snapshot on a day does not show up as a loss followed by a gain.
+// accountDates holds each account's sorted snapshot dates.
+func overallValues(byAccount map[string]map[string]float64, accountDates map[string][]string, start string) ([]string, map[string]float64) {
+	seen := map[string]bool{}
+	var dates []string
+	for _, ds := range accountDates {
+		for _, d := range datesFrom(ds, start) {
+			if !seen[d] {
+				seen[d] = true
+				dates = append(dates, d)
+			}
+		}
+	}
+	sort.Strings(dates)
+
+	overall := make(map[string]float64, len(dates))
+	for id, ds := range accountDates {
+		i := 0
+		for _, d := range dates {
+			for i < len(ds) && ds[i] <= d {
+				i++
+			}
+			if i > 0 {
+				overall[d] += byAccount[id][ds[i-1]]
+			}
+		}
+	}
+	return dates, overall
+}
+
+func findInvestmentTransactions(ctx context.Context, filter bson.M) ([]storedInvestmentTransaction, error) {
+	curr, err := collection("investment_transactions").Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "date", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var txs []storedInvestmentTransaction
+	if err := curr.All(ctx, &txs); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+func findHoldingSnapshots(ctx context.Context, filter bson.M) ([]holdingSnapshot, error) {
+	curr, err := collection("holdings_snapshots").Find(ctx, filter,
+		options.Find().SetSort(bson.M{"date": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []holdingSnapshot
+	if err := curr.All(ctx, &snaps); err != nil {
+		return nil, err
+	}
+	return snaps, nil
+}
+
+// investmentPerformance reports returns, gains, allocation and dividend
+// income for the caller's investments between start_date and end_date,
+// optionally for a single account.
+func investmentPerformance(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := currentPrincipal(c).Subject
+
+	startDate, endDate, err := dateRange(c, 365)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	filter := bson.M{"user_id": userID}
+	if id := c.Query("account_id"); id != "" {
+		filter["account_id"] = id
+	}
+
+	snapFilter := bson.M{"date": bson.M{"$lte": endDate}}
+	for k, v := range filter {
+		snapFilter[k] = v
+	}
+	allSnaps, err := findHoldingSnapshots(ctx, snapFilter)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	txFilter := bson.M{"date": bson.M{"$lte": endDate}}
+	for k, v := range filter {
+		txFilter[k] = v
+	}
+	txs, err := findInvestmentTransactions(ctx, txFilter)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	// Values per account on the days it was snapshotted, as an item that
+	// failed on a day is not snapshotted then. Snapshots before the range
+	// are kept to carry values into it.
+	byAccount := map[string]map[string]float64{}
+	accountDates := map[string][]string{}
+	for _, s := range allSnaps {
+		if byAccount[s.AccountID] == nil {
+			byAccount[s.AccountID] = map[string]float64{}
+		}
+		if _, ok := byAccount[s.AccountID][s.Date]; !ok {
+			accountDates[s.AccountID] = append(accountDates[s.AccountID], s.Date)
+		}
+		byAccount[s.AccountID][s.Date] += s.InstitutionValue
+	}
+	dates, overall := overallValues(byAccount, accountDates, startDate)
+
+	var overallFlows []cashFlow
+	accountFlows := map[string][]cashFlow{}
+	for i := range txs {
+		t := &txs[i]
+		if t.Type != "transfer" && !(t.Type == "cash" && itemExists(externalFlowSubtypes, t.Subtype)) {
+			continue
+		}
+		f := cashFlow{Date: t.Date, Amount: flowAmount(t)}
+		overallFlows = append(overallFlows, f)
+		accountFlows[t.AccountID] = append(accountFlows[t.AccountID], f)
+	}
+
+	accountIDs := make([]string, 0, len(byAccount))
+	for id := range byAccount {
+		if datesFrom(accountDates[id], startDate) != nil {
+			accountIDs = append(accountIDs, id)
+		}
+	}
+	sort.Strings(accountIDs)
+
+	accounts := make([]returnSummary, 0, len(accountIDs))
+	for _, id := range accountIDs {
+		s := computeReturns(datesFrom(accountDates[id], startDate), byAccount[id], accountFlows[id])
+		s.AccountID = id
+		accounts = append(accounts, s)
+	}
+
+	// Gains, from each account's latest snapshot on or before the end date.
+	var endSnaps []holdingSnapshot
+	for _, s := range allSnaps {
+		ds := accountDates[s.AccountID]
+		if s.SecurityID != "" && s.Date == ds[len(ds)-1] {
+			endSnaps = append(endSnaps, s)
+		}
+	}
+
+	realized, complete := realizedGains(txs, allSnaps, startDate)
+	gains := map[string]*securityGain{}
+	gainFor := func(securityID string) *securityGain {
+		g, ok := gains[securityID]
+		if !ok {
+			g = &securityGain{SecurityID: securityID}
+			gains[securityID] = g
+		}
+		return g
+	}
+	var totalRealized float64
+	for id, r := range realized {
+		gainFor(id).Realized = r
+		totalRealized += r
+	}
+	var totalUnrealized float64
+	for _, s := range endSnaps {
+		if s.CostBasis == nil {
+			continue
+		}
+		g := gainFor(s.SecurityID)
+		u := s.InstitutionValue - *s.CostBasis
+		if g.Unrealized != nil {
+			u += *g.Unrealized
+		}
+		g.Unrealized = &u
+		totalUnrealized += s.InstitutionValue - *s.CostBasis
+	}
+
+	securities := map[string]*storedSecurity{}
+	securityOf := func(id string) *storedSecurity {
+		if sec, ok := securities[id]; ok {
+			return sec
+		}
+		sec, err := findSecurity(ctx, id)
+		if err != nil {
+			sec = &storedSecurity{SecurityID: id}
+		}
+		securities[id] = sec
+		return sec
+	}
+
+	gainList := make([]*securityGain, 0, len(gains))
+	for _, g := range gains {
+		g.Name = securityOf(g.SecurityID).Name
+		gainList = append(gainList, g)
+	}
+	sort.Slice(gainList, func(i, j int) bool { return gainList[i].SecurityID < gainList[j].SecurityID })
+
+	// Allocation by security type, at the end of the range.
+	allocByType := map[string]float64{}
+	var endValue float64
+	for _, s := range endSnaps {
+		sec := securityOf(s.SecurityID)
+		t := sec.Type
+		if sec.IsCashEquivalent {
+			t = "cash"
+		}
+		if t == "" {
+			t = "other"
+		}
+		allocByType[t] += s.InstitutionValue
+		endValue += s.InstitutionValue
+	}
+	allocation := make([]allocationShare, 0, len(allocByType))
+	for t, v := range allocByType {
+		share := allocationShare{Type: t, Value: v}
+		if endValue != 0 {
+			share.Weight = v / endValue
+		}
+		allocation = append(allocation, share)
+	}
+	sort.Slice(allocation, func(i, j int) bool { return allocation[i].Value > allocation[j].Value })
+
+	// Dividend and interest income within the range.
+	dividendsByCurrency := map[string]float64{}
+	dividendsBySecurity := map[[2]string]float64{}
+	dividendsByMonth := map[[2]string]float64{}
+	for i := range txs {
+		t := &txs[i]
+		if t.Date < startDate || t.Type != "cash" || !itemExists(dividendSubtypes, t.Subtype) {
+			continue
+		}
+		income := flowAmount(t)
+		dividendsByCurrency[t.IsoCurrencyCode] += income
+		dividendsBySecurity[[2]string{t.SecurityID, t.IsoCurrencyCode}] += income
+		dividendsByMonth[[2]string{t.Date[:7], t.IsoCurrencyCode}] += income
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"start_date": startDate,
+		"end_date":   endDate,
+		"overall":    computeReturns(dates, overall, overallFlows),
+		"accounts":   accounts,
+		"gains": gin.H{
+			"realized":   totalRealized,
+			"unrealized": totalUnrealized,
+			"complete":   complete,
+			"securities": gainList,
+		},
+		"allocation": allocation,
+		"dividends": gin.H{
+			"total":       dividendTotals(dividendsByCurrency),
+			"by_security": keyedDividendTotals(dividendsBySecurity),
+			"by_month":    keyedDividendTotals(dividendsByMonth),
+		},
+	})
+}
+
+func dividendTotals(byCurrency map[string]float64) []dividendTotal {
+	totals := make([]dividendTotal, 0, len(byCurrency))
+	for cur, amount := range byCurrency {
+		totals = append(totals, dividendTotal{Key: "total", IsoCurrencyCode: cur, Amount: amount})
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].IsoCurrencyCode < totals[j].IsoCurrencyCode })
+	return totals
+}
+
+func keyedDividendTotals(byKey map[[2]string]float64) []dividendTotal {
+	totals := make([]dividendTotal, 0, len(byKey))
+	for k, amount := range byKey {
+		totals = append(totals, dividendTotal{Key: k[0], IsoCurrencyCode: k[1], Amount: amount})
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Key != totals[j].Key {
+			return totals[i].Key < totals[j].Key
+		}
+		return totals[i].IsoCurrencyCode < totals[j].IsoCurrencyCode
+	})
+	return totals
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func floatPtr(f float64) *float64 { return &f }
+
+func approxEqual(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+
+func TestComputeReturns(t *testing.T) {
+	tests := []struct {
+		name     string
+		dates    []string
+		values   map[string]float64
+		flows    []cashFlow
+		netFlows float64
+		twr      *float64
+		mwr      *float64
+	}{
+		{
+			name:   "no flows",
+			dates:  []string{"2023-01-01", "2023-07-02", "2024-01-01"},
+			values: map[string]float64{"2023-01-01": 100, "2023-07-02": 110, "2024-01-01": 121},
+			twr:    floatPtr(0.21),
+			mwr:    floatPtr(0.21),
+		},
+		{
+			name:     "deposit mid-period",
+			dates:    []string{"2023-01-01", "2023-07-02", "2024-01-01"},
+			values:   map[string]float64{"2023-01-01": 100, "2023-07-02": 160, "2024-01-01": 176},
+			flows:    []cashFlow{{Date: "2023-07-02", Amount: 50}},
+			netFlows: 50,
+			twr:      floatPtr(0.21),
+		},
+		{
+			name:   "flow on the start date is outside the period",
+			dates:  []string{"2023-01-01", "2024-01-01"},
+			values: map[string]float64{"2023-01-01": 150, "2024-01-01": 165},
+			flows:  []cashFlow{{Date: "2023-01-01", Amount: 50}},
+			twr:    floatPtr(0.1),
+			mwr:    floatPtr(0.1),
+		},
+		{
+			name:     "empty start value",
+			dates:    []string{"2023-01-01", "2023-02-01", "2023-03-01"},
+			values:   map[string]float64{"2023-01-01": 0, "2023-02-01": 100, "2023-03-01": 110},
+			flows:    []cashFlow{{Date: "2023-02-01", Amount: 100}},
+			netFlows: 100,
+			twr:      floatPtr(0.1),
+		},
+		{
+			name:   "no snapshots",
+			values: map[string]float64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := computeReturns(tt.dates, tt.values, tt.flows)
+			if !approxEqual(s.NetFlows, tt.netFlows) {
+				t.Errorf("net flows = %v, want %v", s.NetFlows, tt.netFlows)
+			}
+			switch {
+			case tt.twr == nil && s.TimeWeightedReturn != nil:
+				t.Errorf("time-weighted return = %v, want none", *s.TimeWeightedReturn)
+			case tt.twr != nil && (s.TimeWeightedReturn == nil || !approxEqual(*s.TimeWeightedReturn, *tt.twr)):
+				t.Errorf("time-weighted return = %v, want %v", s.TimeWeightedReturn, *tt.twr)
+			}
+			if tt.mwr != nil && (s.MoneyWeightedReturn == nil || !approxEqual(*s.MoneyWeightedReturn, *tt.mwr)) {
+				t.Errorf("money-weighted return = %v, want %v", s.MoneyWeightedReturn, *tt.mwr)
+			}
+		})
+	}
+}
+
+func TestXirr(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end string
+		startValue float64
+		endValue   float64
+		flows      []cashFlow
+		ok         bool
+	}{
+		{"no flows", "2023-01-01", "2024-01-01", 100, 121, nil, true},
+		{"deposit mid-period", "2023-01-01", "2024-01-01", 100, 176, []cashFlow{{Date: "2023-07-02", Amount: 50}}, true},
+		{"withdrawal", "2023-01-01", "2024-01-01", 200, 110, []cashFlow{{Date: "2023-04-01", Amount: -100}}, true},
+		{"nothing invested", "2023-01-01", "2024-01-01", 0, 0, nil, false},
+		{"empty period", "2023-01-01", "2023-01-01", 100, 100, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rate, ok := xirr(tt.start, tt.end, tt.startValue, tt.endValue, tt.flows)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			// At the rate found, the start value and the flows grow to the
+			// end value.
+			v := tt.startValue * math.Pow(1+rate, daysBetween(tt.start, tt.end)/365)
+			for _, f := range tt.flows {
+				v += f.Amount * math.Pow(1+rate, daysBetween(f.Date, tt.end)/365)
+			}
+			if math.Abs(v-tt.endValue) > 1e-4 {
+				t.Errorf("rate %v grows to %v, want %v", rate, v, tt.endValue)
+			}
+		})
+	}
+}
+
+func TestRealizedGains(t *testing.T) {
+	buy := func(date string, qty, amount float64) storedInvestmentTransaction {
+		return storedInvestmentTransaction{AccountID: "acc", SecurityID: "sec", Date: date, Type: "buy", Quantity: qty, Amount: amount}
+	}
+	sell := func(date string, qty, amount float64) storedInvestmentTransaction {
+		return storedInvestmentTransaction{AccountID: "acc", SecurityID: "sec", Date: date, Type: "sell", Quantity: -qty, Amount: -amount}
+	}
+
+	tests := []struct {
+		name      string
+		txs       []storedInvestmentTransaction
+		snaps     []holdingSnapshot
+		startDate string
+		gain      float64
+		complete  bool
+	}{
+		{
+			name:      "sell at average cost",
+			txs:       []storedInvestmentTransaction{buy("2023-01-01", 10, 1000), buy("2023-02-01", 10, 1400), sell("2023-03-01", 5, 700)},
+			startDate: "2023-01-01",
+			gain:      100,
+			complete:  true,
+		},
+		{
+			name:      "sell before the range moves the position only",
+			txs:       []storedInvestmentTransaction{buy("2023-01-01", 10, 1000), sell("2023-02-01", 5, 600), sell("2023-07-01", 5, 700)},
+			startDate: "2023-06-01",
+			gain:      200,
+			complete:  true,
+		},
+		{
+			name: "sell larger than the known position priced from a snapshot",
+			txs:  []storedInvestmentTransaction{sell("2023-03-01", 20, 2000)},
+			snaps: []holdingSnapshot{
+				{AccountID: "acc", SecurityID: "sec", Date: "2023-02-01", Quantity: 20, CostBasis: floatPtr(1500)},
+				{AccountID: "acc", SecurityID: "sec", Date: "2023-03-01", Quantity: 0, CostBasis: floatPtr(0)},
+			},
+			startDate: "2023-01-01",
+			gain:      500,
+			complete:  true,
+		},
+		{
+			name:      "sell larger than the known position without a snapshot",
+			txs:       []storedInvestmentTransaction{buy("2023-01-01", 5, 500), sell("2023-03-01", 10, 1200)},
+			startDate: "2023-01-01",
+			gain:      200,
+			complete:  false,
+		},
+		{
+			name:      "no sells",
+			txs:       []storedInvestmentTransaction{buy("2023-01-01", 5, 500)},
+			startDate: "2023-01-01",
+			complete:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gains, complete := realizedGains(tt.txs, tt.snaps, tt.startDate)
+			if !approxEqual(gains["sec"], tt.gain) {
+				t.Errorf("gain = %v, want %v", gains["sec"], tt.gain)
+			}
+			if complete != tt.complete {
+				t.Errorf("complete = %v, want %v", complete, tt.complete)
+			}
+		})
+	}
+}
+
+func TestOverallValues(t *testing.T) {
+	byAccount := map[string]map[string]float64{
+		"a": {"2023-12-31": 50, "2024-01-01": 100, "2024-01-02": 110, "2024-01-03": 120},
+		"b": {"2024-01-01": 200, "2024-01-03": 210},
+		"c": {"2024-01-02": 0},
+	}
+	accountDates := map[string][]string{
+		"a": {"2023-12-31", "2024-01-01", "2024-01-02", "2024-01-03"},
+		"b": {"2024-01-01", "2024-01-03"},
+		"c": {"2024-01-02"},
+	}
+
+	dates, overall := overallValues(byAccount, accountDates, "2024-01-01")
+	want := map[string]float64{
+		"2024-01-01": 300,
+		// b was not snapshotted and counts with its previous value.
+		"2024-01-02": 310,
+		"2024-01-03": 330,
+	}
+	if len(dates) != len(want) {
+		t.Fatalf("dates = %v, want %d dates", dates, len(want))
+	}
+	for i := 1; i < len(dates); i++ {
+		if dates[i-1] >= dates[i] {
+			t.Fatalf("dates = %v, want sorted", dates)
+		}
+	}
+	for d, v := range want {
+		if !approxEqual(overall[d], v) {
+			t.Errorf("value on %s = %v, want %v", d, overall[d], v)
+		}
+	}
+}
+
+func TestDatesFrom(t *testing.T) {
+	dates := []string{"2024-01-01", "2024-01-05", "2024-01-09"}
+	tests := []struct {
+		start string
+		want  int
+	}{
+		{"2023-12-01", 3},
+		{"2024-01-05", 2},
+		{"2024-01-06", 1},
+		{"2024-02-01", 0},
+	}
+	for _, tt := range tests {
+		if got := datesFrom(dates, tt.start); len(got) != tt.want {
+			t.Errorf("datesFrom(%q) = %v, want %d dates", tt.start, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Recurring transactions are detected from stored history. Transactions
+// are grouped by normalized merchant, currency and direction, split into
+// clusters of similar amounts, and a cluster whose dates follow a regular
+// cadence is reported as a recurring stream.
+
+// recurringCadence is a cadence a stream can follow. Intervals between
+// occurrences within [min, max] days count as one period.
+type recurringCadence struct {
+	Name     string
+	Min, Max int
+	Grace    int
+	MinCount int
+	next     func(t time.Time) time.Time
+}
+
+var recurringCadences = []recurringCadence{
+	{"weekly", 6, 8, 3, 3, func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }},
+	{"biweekly", 13, 16, 4, 3, func(t time.Time) time.Time { return t.AddDate(0, 0, 14) }},
+	{"monthly", 27, 33, 7, 3, func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"quarterly", 85, 97, 14, 3, func(t time.Time) time.Time { return t.AddDate(0, 3, 0) }},
+	{"annual", 355, 375, 30, 2, func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+}
+
+// Recurring stream statuses.
+const (
+	recurringActive = "active"
+	recurringMissed = "missed"
+)
+
+// At least this share of the intervals of a stream must fit its cadence,
+// counting an interval of several periods as a missed occurrence.
+const recurringRegularity = 0.75
+
+const (
+	defaultRecurringLookbackDays    = 730
+	defaultRecurringAmountTolerance = 0.2
+)
+
+type recurringStream struct {
+	Merchant           string   `json:"merchant"`
+	Direction          string   `json:"direction"`
+	Currency           string   `json:"currency"`
+	AccountID          string   `json:"account_id"`
+	Cadence            string   `json:"cadence"`
+	Status             string   `json:"status"`
+	Occurrences        int      `json:"occurrences"`
+	MissedOccurrences  int      `json:"missed_occurrences"`
+	FirstDate          string   `json:"first_date"`
+	LastDate           string   `json:"last_date"`
+	AverageAmount      float64  `json:"average_amount"`
+	LastAmount         float64  `json:"last_amount"`
+	PriceChanged       bool     `json:"price_changed"`
+	PreviousAmount     *float64 `json:"previous_amount,omitempty"`
+	PriceChangedOn     string   `json:"price_changed_on,omitempty"`
+	NextExpectedDate   string   `json:"next_expected_date"`
+	NextExpectedAmount float64  `json:"next_expected_amount"`
+	TransactionIDs     []string `json:"transaction_ids"`
+}
+
+var (
+	merchantProcessorRe = regexp.MustCompile(`^\s*(sq|tst|sp|pp|paypal|pypl) ?\*`)
+	merchantNoiseRe     = regexp.MustCompile(`[^a-z ]+`)
+	merchantSuffixRe    = regexp.MustCompile(`\b(com|net|org|inc|llc|ltd|co|corp|www|pos|ach|debit|purchase|payment)\b`)
+)
+
+// normalizeMerchant reduces a merchant or transaction name to the words
+// that stay the same across occurrences, dropping payment processor
+// prefixes such as "SQ *" and digits such as reference numbers and dates.
+func normalizeMerchant(s string) string {
+	s = strings.ToLower(s)
+	s = merchantProcessorRe.ReplaceAllString(s, " ")
+	s = merchantNoiseRe.ReplaceAllString(s, " ")
+	s = merchantSuffixRe.ReplaceAllString(s, " ")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+type recurringOccurrence struct {
+	date   time.Time
+	amount float64
+	t      *storedTransaction
+}
+
+// clusterByAmount splits occurrences into clusters whose amounts are within
+// tolerance of the cluster's smallest amount.
+func clusterByAmount(occs []recurringOccurrence, tolerance float64) [][]recurringOccurrence {
+	sort.Slice(occs, func(i, j int) bool { return occs[i].amount < occs[j].amount })
+	var clusters [][]recurringOccurrence
+	start := 0
+	for i := 1; i <= len(occs); i++ {
+		if i == len(occs) || occs[i].amount > occs[start].amount*(1+tolerance)+0.01 {
+			clusters = append(clusters, occs[start:i])
+			start = i
+		}
+	}
+	return clusters
+}
+
+// detectCadence finds the cadence the dated occurrences follow and how many
+// occurrences are missing between them.
+func detectCadence(occs []recurringOccurrence) (*recurringCadence, int) {
+	for i := range recurringCadences {
+		cad := &recurringCadences[i]
+		if len(occs) < cad.MinCount {
+			continue
+		}
+		regular, missed := 0, 0
+		for j := 1; j < len(occs); j++ {
+			days := int(occs[j].date.Sub(occs[j-1].date).Hours() / 24)
+			periods := int(math.Round(float64(days) / float64(cad.Min+cad.Max) * 2))
+			if periods >= 1 && days >= cad.Min*periods && days <= cad.Max*periods {
+				regular++
+				missed += periods - 1
+			}
+		}
+		if float64(regular) >= recurringRegularity*float64(len(occs)-1) && regular > missed {
+			return cad, missed
+		}
+	}
+	return nil, 0
+}
+
+// detectStream reports the occurrences as a recurring stream when they
+// follow a cadence.
+func detectStream(occs []recurringOccurrence, today time.Time) *recurringStream {
+	// Several transactions on one day, such as a charge and its
+	// adjustment, count as one occurrence.
+	sort.Slice(occs, func(i, j int) bool { return occs[i].date.Before(occs[j].date) })
+	var byDay []recurringOccurrence
+	for _, o := range occs {
+		if n := len(byDay); n > 0 && byDay[n-1].date.Equal(o.date) {
+			byDay[n-1].amount += o.amount
+			continue
+		}
+		byDay = append(byDay, o)
+	}
+
+	cad, missed := detectCadence(byDay)
+	if cad == nil {
+		return nil
+	}
+
+	first, last := byDay[0], byDay[len(byDay)-1]
+	s := &recurringStream{
+		Cadence:           cad.Name,
+		Status:            recurringActive,
+		Occurrences:       len(byDay),
+		MissedOccurrences: missed,
+		FirstDate:         first.date.Format("2006-01-02"),
+		LastDate:          last.date.Format("2006-01-02"),
+		LastAmount:        roundCents(last.amount),
+		AccountID:         last.t.AccountId,
+	}
+
+	var sum float64
+	for _, o := range byDay {
+		sum += o.amount
+	}
+	s.AverageAmount = roundCents(sum / float64(len(byDay)))
+	s.NextExpectedAmount = s.LastAmount
+
+	// The price changed when an earlier occurrence has another amount; the
+	// change took effect after the last one of those.
+	for i := len(byDay) - 2; i >= 0; i-- {
+		prev := roundCents(byDay[i].amount)
+		if math.Abs(prev-s.LastAmount) >= 0.01 {
+			s.PriceChanged = true
+			s.PreviousAmount = &prev
+			s.PriceChangedOn = byDay[i+1].date.Format("2006-01-02")
+			break
+		}
+	}
+
+	// A stream is missed once its next occurrence is overdue by more than
+	// the cadence's grace period; the date reported is the one missed.
+	next := cad.next(last.date)
+	if !next.AddDate(0, 0, cad.Grace).After(today) {
+		s.Status = recurringMissed
+	}
+	s.NextExpectedDate = next.Format("2006-01-02")
+
+	for _, o := range occs {
+		s.TransactionIDs = append(s.TransactionIDs, o.t.TransactionId)
+	}
+	return s
+}
+
+// detectRecurring finds the recurring streams among the transactions.
+func detectRecurring(transactions []storedTransaction, tolerance float64, today time.Time) []*recurringStream {
+	type groupKey struct{ merchant, currency, direction string }
+	groups := map[groupKey][]recurringOccurrence{}
+	for i := range transactions {
+		t := &transactions[i]
+		name := t.Merchant
+		if name == "" {
+			name = t.Name
+		}
+		merchant := normalizeMerchant(name)
+		date, err := time.Parse("2006-01-02", t.Date)
+		if merchant == "" || err != nil || t.Amount == 0 {
+			continue
+		}
+		k := groupKey{merchant, t.Currency, "outflow"}
+		amount := float64(t.Amount)
+		if amount < 0 {
+			k.direction, amount = "inflow", -amount
+		}
+		groups[k] = append(groups[k], recurringOccurrence{date: date, amount: amount, t: t})
+	}
+
+	streams := make([]*recurringStream, 0)
+	for k, occs := range groups {
+		for _, cluster := range clusterByAmount(occs, tolerance) {
+			s := detectStream(cluster, today)
+			if s == nil {
+				continue
+			}
+			s.Merchant, s.Currency, s.Direction = k.merchant, k.currency, k.direction
+			streams = append(streams, s)
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		if streams[i].NextExpectedDate != streams[j].NextExpectedDate {
+			return streams[i].NextExpectedDate < streams[j].NextExpectedDate
+		}
+		return streams[i].Merchant < streams[j].Merchant
+	})
+	return streams
+}
+
+// recurring lists the recurring streams in the caller's posted
+// transactions of the last lookback_days, 730 by default. Amounts within
+// amount_tolerance, 0.2 by default, of each other belong to one stream.
+func recurring(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	lookback := defaultRecurringLookbackDays
+	if v := c.Query("lookback_days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 30 || n > 3660 {
+			renderError(c, invalidf("lookback_days must be between 30 and 3660"))
+			return
+		}
+		lookback = n
+	}
+	tolerance := defaultRecurringAmountTolerance
+	if v := c.Query("amount_tolerance"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			renderError(c, invalidf("amount_tolerance must be between 0 and 1"))
+			return
+		}
+		tolerance = f
+	}
+
+	today := localToday()
+	filter := bson.M{
+		"user_id":      currentPrincipal(c).Subject,
+		"pending":      false,
+		"duplicate_of": bson.M{"$exists": false},
+		"date":         bson.M{"$gte": today.AddDate(0, 0, -lookback).Format("2006-01-02")},
+	}
+	if id := c.Query("item_id"); id != "" {
+		filter["item_id"] = id
+	}
+
+	curr, err := collection("transactions").Find(ctx, filter)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	var transactions []storedTransaction
+	if err := curr.All(ctx, &transactions); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recurring": detectRecurring(transactions, tolerance, today),
+	})
+}
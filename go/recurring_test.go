@@ -0,0 +1,203 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/plaid/plaid-go/plaid"
+)
+
+func TestNormalizeMerchant(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"NETFLIX.COM 12345", "netflix"},
+		{"Spotify USA Inc", "spotify usa"},
+		{"POS DEBIT STARBUCKS #1234", "starbucks"},
+		{"SQ *BLUE BOTTLE", "blue bottle"},
+		{"TST* Sweetgreen 0042", "sweetgreen"},
+		{"PAYPAL *SPOTIFY", "spotify"},
+		{"  ", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeMerchant(tt.in); got != tt.want {
+			t.Errorf("normalizeMerchant(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestClusterByAmount(t *testing.T) {
+	var occs []recurringOccurrence
+	for _, a := range []float64{100, 10.5, 15, 10} {
+		occs = append(occs, recurringOccurrence{amount: a})
+	}
+
+	clusters := clusterByAmount(occs, 0.2)
+	want := [][]float64{{10, 10.5}, {15}, {100}}
+	if len(clusters) != len(want) {
+		t.Fatalf("got %d clusters, want %d", len(clusters), len(want))
+	}
+	for i, c := range clusters {
+		if len(c) != len(want[i]) {
+			t.Fatalf("cluster %d has %d occurrences, want %d", i, len(c), len(want[i]))
+		}
+		for j, o := range c {
+			if o.amount != want[i][j] {
+				t.Errorf("cluster %d occurrence %d = %v, want %v", i, j, o.amount, want[i][j])
+			}
+		}
+	}
+}
+
+func TestDetectRecurring(t *testing.T) {
+	type charge struct {
+		date   string
+		amount float32
+	}
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+
+	tests := []struct {
+		name           string
+		merchant       string
+		charges        []charge
+		today          string
+		cadence        string
+		status         string
+		occurrences    int
+		missed         int
+		next           string
+		priceChanged   bool
+		previousAmount float64
+		changedOn      string
+		nextAmount     float64
+	}{
+		{
+			name:     "monthly with a missed month",
+			merchant: "Gym Membership",
+			charges: []charge{
+				{"2024-01-15", 40}, {"2024-02-15", 40}, {"2024-03-15", 40},
+				{"2024-05-15", 40}, {"2024-06-15", 40},
+			},
+			today:       "2024-06-20",
+			cadence:     "monthly",
+			status:      recurringActive,
+			occurrences: 5,
+			missed:      1,
+			next:        "2024-07-15",
+			nextAmount:  40,
+		},
+		{
+			name:     "biweekly rather than weekly or monthly",
+			merchant: "ACME Payroll",
+			charges: []charge{
+				{"2024-01-05", -2000}, {"2024-01-19", -2000}, {"2024-02-02", -2000},
+				{"2024-02-16", -2000}, {"2024-03-01", -2000}, {"2024-03-15", -2000},
+			},
+			today:       "2024-03-20",
+			cadence:     "biweekly",
+			status:      recurringActive,
+			occurrences: 6,
+			next:        "2024-03-29",
+			nextAmount:  2000,
+		},
+		{
+			name:     "monthly rather than biweekly",
+			merchant: "Netflix.com",
+			charges: []charge{
+				{"2024-01-03", 15.49}, {"2024-02-03", 15.49}, {"2024-03-03", 15.49}, {"2024-04-03", 15.49},
+			},
+			today:       "2024-04-10",
+			cadence:     "monthly",
+			status:      recurringActive,
+			occurrences: 4,
+			next:        "2024-05-03",
+			nextAmount:  15.49,
+		},
+		{
+			name:     "price change within tolerance",
+			merchant: "Netflix.com",
+			charges: []charge{
+				{"2024-01-03", 15.49}, {"2024-02-03", 15.49}, {"2024-03-03", 15.49},
+				{"2024-04-03", 17.99}, {"2024-05-03", 17.99},
+			},
+			today:          "2024-05-10",
+			cadence:        "monthly",
+			status:         recurringActive,
+			occurrences:    5,
+			next:           "2024-06-03",
+			priceChanged:   true,
+			previousAmount: 15.49,
+			changedOn:      "2024-04-03",
+			nextAmount:     17.99,
+		},
+		{
+			name:     "overdue stream is missed",
+			merchant: "Gym Membership",
+			charges: []charge{
+				{"2024-01-15", 40}, {"2024-02-15", 40}, {"2024-03-15", 40},
+			},
+			today:       "2024-05-01",
+			cadence:     "monthly",
+			status:      recurringMissed,
+			occurrences: 3,
+			next:        "2024-04-15",
+			nextAmount:  40,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var txs []storedTransaction
+			for i, c := range tt.charges {
+				txs = append(txs, storedTransaction{
+					Transaction: plaid.Transaction{
+						TransactionId: tt.merchant + string(rune('a'+i)),
+						AccountId:     "acc",
+						Name:          tt.merchant,
+						Date:          c.date,
+						Amount:        c.amount,
+					},
+					Currency: "USD",
+				})
+			}
+
+			streams := detectRecurring(txs, defaultRecurringAmountTolerance, day(tt.today))
+			if len(streams) != 1 {
+				t.Fatalf("got %d streams, want 1", len(streams))
+			}
+			s := streams[0]
+			if s.Cadence != tt.cadence {
+				t.Errorf("cadence = %q, want %q", s.Cadence, tt.cadence)
+			}
+			if s.Status != tt.status {
+				t.Errorf("status = %q, want %q", s.Status, tt.status)
+			}
+			if s.Occurrences != tt.occurrences {
+				t.Errorf("occurrences = %d, want %d", s.Occurrences, tt.occurrences)
+			}
+			if s.MissedOccurrences != tt.missed {
+				t.Errorf("missed occurrences = %d, want %d", s.MissedOccurrences, tt.missed)
+			}
+			if s.NextExpectedDate != tt.next {
+				t.Errorf("next expected date = %q, want %q", s.NextExpectedDate, tt.next)
+			}
+			if !approxEqual(s.NextExpectedAmount, tt.nextAmount) {
+				t.Errorf("next expected amount = %v, want %v", s.NextExpectedAmount, tt.nextAmount)
+			}
+			if s.PriceChanged != tt.priceChanged {
+				t.Fatalf("price changed = %v, want %v", s.PriceChanged, tt.priceChanged)
+			}
+			if tt.priceChanged {
+				if s.PreviousAmount == nil || !approxEqual(*s.PreviousAmount, tt.previousAmount) {
+					t.Errorf("previous amount = %v, want %v", s.PreviousAmount, tt.previousAmount)
+				}
+				if s.PriceChangedOn != tt.changedOn {
+					t.Errorf("price changed on = %q, want %q", s.PriceChangedOn, tt.changedOn)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Spending reports aggregate the stored transactions in MongoDB. Plaid
+// reports money leaving an account as a positive amount, so negative
+// amounts count as income and positive ones as expenses. Amounts in
+// different currencies are never added together.
+
+// spendingGroupKeys are the expressions each report groups by.
+var spendingGroupKeys = map[string]interface{}{
+	// The custom category set by a rule, else Plaid's top-level category.
+	"category": bson.M{"$ifNull": bson.A{
+		"$custom_category",
+		bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$category", 0}}, "Uncategorized"}},
+	}},
+	"merchant": bson.M{"$ifNull": bson.A{"$merchant_name", "$name"}},
+	"account":  "$accountid",
+	"day":      "$date",
+	"week":     weekStartExpr("$date"),
+	"month":    bson.M{"$substrBytes": bson.A{"$date", 0, 7}},
+}
+
+// weekStartExpr is the Monday of the week of a YYYY-MM-DD date field.
+func weekStartExpr(field string) bson.M {
+	date := bson.M{"$dateFromString": bson.M{"dateString": field, "format": "%Y-%m-%d"}}
+	return bson.M{"$dateToString": bson.M{
+		"format": "%Y-%m-%d",
+		"date": bson.M{"$subtract": bson.A{
+			date,
+			bson.M{"$multiply": bson.A{bson.M{"$subtract": bson.A{bson.M{"$isoDayOfWeek": date}, 1}}, 24 * 60 * 60 * 1000}},
+		}},
+	}}
+}
+
+// isPeriodGrouping tells whether groups are periods, which are listed in
+// date order rather than by amount.
+func isPeriodGrouping(groupBy string) bool {
+	return groupBy == "day" || groupBy == "week" || groupBy == "month"
+}
+
+type spendingGroup struct {
+	Key     string  `json:"key"`
+	Income  float64 `json:"income"`
+	Expense float64 `json:"expense"`
+	Net     float64 `json:"net"`
+	Count   int     `json:"count"`
+}
+
+type currencySpending struct {
+	Income  float64          `json:"income"`
+	Expense float64          `json:"expense"`
+	Net     float64          `json:"net"`
+	Count   int              `json:"count"`
+	Groups  []*spendingGroup `json:"groups"`
+}
+
+// spendingReport returns income and expenses grouped by group_by, one of
+// category, merchant, account, day, week or month, separately for every
+// currency. Pending transactions are left out unless include_pending is
+// true. Net is income minus expenses.
+func spendingReport(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	groupBy := c.DefaultQuery("group_by", "category")
+	key, ok := spendingGroupKeys[groupBy]
+	if !ok {
+		renderError(c, invalidf("group_by must be one of category, merchant, account, day, week or month"))
+		return
+	}
+	startDate, endDate, err := dateRange(c, 30)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	match := bson.M{
+		"user_id": currentPrincipal(c).Subject,
+		"date":    bson.M{"$gte": startDate, "$lte": endDate},
+		// Transactions merged into one of another item are counted once.
+		"duplicate_of": bson.M{"$exists": false},
+	}
+	if id := c.Query("item_id"); id != "" {
+		match["item_id"] = id
+	}
+	includePending := strings.ToLower(c.Query("include_pending")) == "true"
+	if !includePending {
+		match["pending"] = false
+	}
+
+	curr, err := collection("transactions").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"currency": bson.M{"$ifNull": bson.A{"$currency", ""}},
+				"key":      key,
+			},
+			"income":  bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$lt": bson.A{"$amount", 0}}, bson.M{"$multiply": bson.A{"$amount", -1}}, 0}}},
+			"expense": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$amount", 0}}, "$amount", 0}}},
+			"count":   bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	var rows []struct {
+		ID struct {
+			Currency string `bson:"currency"`
+			Key      string `bson:"key"`
+		} `bson:"_id"`
+		Income  float64 `bson:"income"`
+		Expense float64 `bson:"expense"`
+		Count   int     `bson:"count"`
+	}
+	if err := curr.All(ctx, &rows); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	currencies := map[string]*currencySpending{}
+	for _, r := range rows {
+		cs, ok := currencies[r.ID.Currency]
+		if !ok {
+			cs = &currencySpending{Groups: []*spendingGroup{}}
+			currencies[r.ID.Currency] = cs
+		}
+		g := &spendingGroup{
+			Key:     r.ID.Key,
+			Income:  roundCents(r.Income),
+			Expense: roundCents(r.Expense),
+			Net:     roundCents(r.Income - r.Expense),
+			Count:   r.Count,
+		}
+		cs.Groups = append(cs.Groups, g)
+		cs.Income += r.Income
+		cs.Expense += r.Expense
+		cs.Count += r.Count
+	}
+	for _, cs := range currencies {
+		cs.Income = roundCents(cs.Income)
+		cs.Expense = roundCents(cs.Expense)
+		cs.Net = roundCents(cs.Income - cs.Expense)
+		groups := cs.Groups
+		sort.Slice(groups, func(i, j int) bool {
+			if isPeriodGrouping(groupBy) || groups[i].Expense == groups[j].Expense {
+				return groups[i].Key < groups[j].Key
+			}
+			return groups[i].Expense > groups[j].Expense
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"group_by":        groupBy,
+		"start_date":      startDate,
+		"end_date":        endDate,
+		"include_pending": includePending,
+		"currencies":      currencies,
+	})
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Categorization rules assign the user's own category and tags to stored
+// transactions. Rules are tried in priority order and the first one whose
+// conditions all hold applies. The category Plaid assigned is never
+// changed; the rule's category is stored next to it in custom_category.
+
+type categoryRule struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID   string             `bson:"user_id" json:"-"`
+	Name     string             `bson:"name" json:"name"`
+	Priority int                `bson:"priority" json:"priority"`
+	Disabled bool               `bson:"disabled" json:"disabled"`
+
+	// Conditions. Empty conditions always hold.
+	NamePattern   string   `bson:"name_pattern,omitempty" json:"name_pattern,omitempty"`
+	MinAmount     *float64 `bson:"min_amount,omitempty" json:"min_amount,omitempty"`
+	MaxAmount     *float64 `bson:"max_amount,omitempty" json:"max_amount,omitempty"`
+	AccountIDs    []string `bson:"account_ids,omitempty" json:"account_ids,omitempty"`
+	PlaidCategory []string `bson:"plaid_category,omitempty" json:"plaid_category,omitempty"`
+
+	// Actions.
+	Category string   `bson:"category" json:"category"`
+	Tags     []string `bson:"tags,omitempty" json:"tags,omitempty"`
+
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+
+	namePattern *regexp.Regexp
+}
+
+// categoryRuleRequest is the body accepted when creating or updating a
+// rule.
+type categoryRuleRequest struct {
+	Name          string   `json:"name" binding:"required"`
+	Priority      int      `json:"priority"`
+	Disabled      bool     `json:"disabled"`
+	NamePattern   string   `json:"name_pattern"`
+	MinAmount     *float64 `json:"min_amount"`
+	MaxAmount     *float64 `json:"max_amount"`
+	AccountIDs    []string `json:"account_ids"`
+	PlaidCategory []string `json:"plaid_category"`
+	Category      string   `json:"category" binding:"required"`
+	Tags          []string `json:"tags"`
+}
+
+func (r *categoryRuleRequest) validate() error {
+	r.Category = strings.TrimSpace(r.Category)
+	if r.Category == "" {
+		return invalidf("category is required")
+	}
+	if r.NamePattern != "" {
+		if _, err := regexp.Compile("(?i)" + r.NamePattern); err != nil {
+			return invalidf("name_pattern is not a valid regular expression: %v", err)
+		}
+	}
+	if r.MinAmount != nil && r.MaxAmount != nil && *r.MinAmount > *r.MaxAmount {
+		return invalidf("min_amount must not be greater than max_amount")
+	}
+	if r.NamePattern == "" && r.MinAmount == nil && r.MaxAmount == nil && len(r.AccountIDs) == 0 && len(r.PlaidCategory) == 0 {
+		return invalidf("at least one of name_pattern, min_amount, max_amount, account_ids or plaid_category is required")
+	}
+	return nil
+}
+
+// compile prepares the rule for matching. Name patterns are matched case
+// insensitively.
+func (r *categoryRule) compile() error {
+	if r.NamePattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile("(?i)" + r.NamePattern)
+	if err != nil {
+		return err
+	}
+	r.namePattern = re
+	return nil
+}
+
+// matches tells whether all of the rule's conditions hold for the
+// transaction. The name pattern is tried against the merchant name and the
+// transaction name; amounts are compared as Plaid reports them, positive for
+// money leaving the account.
+func (r *categoryRule) matches(t *storedTransaction) bool {
+	if r.namePattern != nil && !r.namePattern.MatchString(t.Merchant) && !r.namePattern.MatchString(t.Name) {
+		return false
+	}
+	amount := float64(t.Amount)
+	if r.MinAmount != nil && amount < *r.MinAmount {
+		return false
+	}
+	if r.MaxAmount != nil && amount > *r.MaxAmount {
+		return false
+	}
+	if len(r.AccountIDs) > 0 && !itemExists(r.AccountIDs, t.AccountId) {
+		return false
+	}
+	if len(r.PlaidCategory) > len(t.Category) {
+		return false
+	}
+	for i, c := range r.PlaidCategory {
+		if !strings.EqualFold(c, t.Category[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadCategoryRules returns the user's enabled rules in the order they are
+// tried.
+func loadCategoryRules(ctx context.Context, userID string) ([]categoryRule, error) {
+	curr, err := collection("category_rules").Find(ctx,
+		bson.M{"user_id": userID, "disabled": false},
+		options.Find().SetSort(bson.D{{Key: "priority", Value: 1}, {Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var rules []categoryRule
+	if err := curr.All(ctx, &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// categorize sets the custom category and tags of the transaction from the
+// first matching rule, or clears them when no rule matches. It reports
+// whether anything changed.
+func categorize(rules []categoryRule, t *storedTransaction) bool {
+	var category string
+	var tags []string
+	var ruleID *primitive.ObjectID
+	for i := range rules {
+		if rules[i].matches(t) {
+			category, tags, ruleID = rules[i].Category, rules[i].Tags, &rules[i].ID
+			break
+		}
+	}
+
+	changed := t.CustomCategory != category || strings.Join(t.Tags, "\x00") != strings.Join(tags, "\x00") ||
+		(t.RuleID == nil) != (ruleID == nil) || (ruleID != nil && *t.RuleID != *ruleID)
+	t.CustomCategory, t.Tags, t.RuleID = category, tags, ruleID
+	return changed
+}
+
+// applyCategoryRules re-categorizes the user's stored transactions matching
+// filter and returns how many changed.
+func applyCategoryRules(ctx context.Context, userID string, filter bson.M) (int, error) {
+	rules, err := loadCategoryRules(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	filter["user_id"] = userID
+	curr, err := collection("transactions").Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer curr.Close(ctx)
+
+	var models []mongo.WriteModel
+	for curr.Next(ctx) {
+		var t storedTransaction
+		if err := curr.Decode(&t); err != nil {
+			return 0, err
+		}
+		if !categorize(rules, &t) {
+			continue
+		}
+		update := bson.M{"$set": bson.M{"custom_category": t.CustomCategory, "tags": t.Tags, "rule_id": t.RuleID}}
+		if t.RuleID == nil {
+			update = bson.M{"$unset": bson.M{"custom_category": "", "tags": "", "rule_id": ""}}
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": t.ID}).SetUpdate(update))
+	}
+	if err := curr.Err(); err != nil {
+		return 0, err
+	}
+	if len(models) == 0 {
+		return 0, nil
+	}
+
+	if _, err := collection("transactions").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		return 0, err
+	}
+	return len(models), nil
+}
+
+func (r *categoryRuleRequest) rule() categoryRule {
+	return categoryRule{
+		Name:          strings.TrimSpace(r.Name),
+		Priority:      r.Priority,
+		Disabled:      r.Disabled,
+		NamePattern:   r.NamePattern,
+		MinAmount:     r.MinAmount,
+		MaxAmount:     r.MaxAmount,
+		AccountIDs:    r.AccountIDs,
+		PlaidCategory: r.PlaidCategory,
+		Category:      r.Category,
+		Tags:          r.Tags,
+	}
+}
+
+func bindCategoryRule(c *gin.Context) (*categoryRuleRequest, bool) {
+	var req categoryRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err := req.validate(); err != nil {
+		renderError(c, err)
+		return nil, false
+	}
+	return &req, true
+}
+
+// ruleID parses the :id path parameter and renders a 404 for malformed
+// IDs.
+func ruleID(c *gin.Context) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return id, false
+	}
+	return id, true
+}
+
+func createCategoryRule(c *gin.Context) {
+	req, ok := bindCategoryRule(c)
+	if !ok {
+		return
+	}
+
+	rule := req.rule()
+	rule.UserID = currentPrincipal(c).Subject
+	rule.CreatedAt = time.Now().UTC()
+	rule.UpdatedAt = rule.CreatedAt
+	res, err := collection("category_rules").InsertOne(c.Request.Context(), rule)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	rule.ID = res.InsertedID.(primitive.ObjectID)
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+func listCategoryRules(c *gin.Context) {
+	ctx := c.Request.Context()
+	curr, err := collection("category_rules").Find(ctx,
+		bson.M{"user_id": currentPrincipal(c).Subject},
+		options.Find().SetSort(bson.D{{Key: "priority", Value: 1}, {Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	rules := make([]categoryRule, 0)
+	if err := curr.All(ctx, &rules); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// updateCategoryRule replaces the rule's conditions and actions. Stored
+// transactions are only re-categorized by an apply.
+func updateCategoryRule(c *gin.Context) {
+	id, ok := ruleID(c)
+	if !ok {
+		return
+	}
+	req, ok := bindCategoryRule(c)
+	if !ok {
+		return
+	}
+
+	var rule categoryRule
+	err := collection("category_rules").FindOneAndUpdate(c.Request.Context(),
+		bson.M{"_id": id, "user_id": currentPrincipal(c).Subject},
+		bson.M{"$set": bson.M{
+			"name":           strings.TrimSpace(req.Name),
+			"priority":       req.Priority,
+			"disabled":       req.Disabled,
+			"name_pattern":   req.NamePattern,
+			"min_amount":     req.MinAmount,
+			"max_amount":     req.MaxAmount,
+			"account_ids":    req.AccountIDs,
+			"plaid_category": req.PlaidCategory,
+			"category":       req.Category,
+			"tags":           req.Tags,
+			"updated_at":     time.Now().UTC(),
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&rule)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return
+	}
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// deleteCategoryRule removes the rule. Transactions it categorized keep
+// their category until rules are applied again.
+func deleteCategoryRule(c *gin.Context) {
+	id, ok := ruleID(c)
+	if !ok {
+		return
+	}
+
+	res, err := collection("category_rules").DeleteOne(c.Request.Context(),
+		bson.M{"_id": id, "user_id": currentPrincipal(c).Subject},
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	if res.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// postApplyCategoryRules re-categorizes the caller's stored transactions,
+// or those of one item, with the current rules.
+func postApplyCategoryRules(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Minute)
+	defer cancel()
+
+	filter := bson.M{}
+	if id := c.Query("item_id"); id != "" {
+		filter["item_id"] = id
+	}
+
+	updated, err := applyCategoryRules(ctx, currentPrincipal(c).Subject, filter)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"updated": updated})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func compiledRule(t *testing.T, r categoryRule) categoryRule {
+	t.Helper()
+	if r.ID.IsZero() {
+		r.ID = primitive.NewObjectID()
+	}
+	if err := r.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestCategoryRuleMatches(t *testing.T) {
+	tx := storedTransaction{
+		Transaction: plaid.Transaction{
+			AccountId: "acc",
+			Name:      "SQ *BLUE BOTTLE 1234",
+			Amount:    4.5,
+			Category:  []string{"Food and Drink", "Restaurants", "Coffee Shop"},
+		},
+		Merchant: "Blue Bottle Coffee",
+	}
+
+	tests := []struct {
+		name string
+		rule categoryRule
+		want bool
+	}{
+		{"pattern on merchant", categoryRule{NamePattern: "^blue bottle"}, true},
+		{"pattern on name", categoryRule{NamePattern: `^sq \*`}, true},
+		{"pattern matching neither", categoryRule{NamePattern: "starbucks"}, false},
+		{"within amounts", categoryRule{MinAmount: floatPtr(4.5), MaxAmount: floatPtr(10)}, true},
+		{"below min amount", categoryRule{MinAmount: floatPtr(5)}, false},
+		{"above max amount", categoryRule{MaxAmount: floatPtr(4)}, false},
+		{"account listed", categoryRule{AccountIDs: []string{"other", "acc"}}, true},
+		{"account not listed", categoryRule{AccountIDs: []string{"other"}}, false},
+		{"category prefix", categoryRule{PlaidCategory: []string{"food and drink", "restaurants"}}, true},
+		{"category mismatch", categoryRule{PlaidCategory: []string{"Food and Drink", "Bars"}}, false},
+		{"category deeper than the transaction's", categoryRule{PlaidCategory: []string{"Food and Drink", "Restaurants", "Coffee Shop", "Espresso"}}, false},
+		{"all conditions", categoryRule{NamePattern: "bottle", MaxAmount: floatPtr(10), AccountIDs: []string{"acc"}, PlaidCategory: []string{"Food and Drink"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := compiledRule(t, tt.rule)
+			if got := r.matches(&tx); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCategorize(t *testing.T) {
+	coffee := compiledRule(t, categoryRule{NamePattern: "coffee", Category: "Coffee", Tags: []string{"daily"}})
+	food := compiledRule(t, categoryRule{NamePattern: "bottle", Category: "Food"})
+	newTx := func() storedTransaction {
+		return storedTransaction{Transaction: plaid.Transaction{Name: "Blue Bottle Coffee"}}
+	}
+
+	t.Run("first matching rule applies", func(t *testing.T) {
+		tx := newTx()
+		if !categorize([]categoryRule{coffee, food}, &tx) {
+			t.Error("categorize reported no change")
+		}
+		if tx.CustomCategory != "Coffee" || tx.RuleID == nil || *tx.RuleID != coffee.ID || len(tx.Tags) != 1 {
+			t.Errorf("got category %q, rule %v, tags %v", tx.CustomCategory, tx.RuleID, tx.Tags)
+		}
+	})
+
+	t.Run("same rules again", func(t *testing.T) {
+		tx := newTx()
+		categorize([]categoryRule{coffee, food}, &tx)
+		if categorize([]categoryRule{coffee, food}, &tx) {
+			t.Error("categorize reported a change")
+		}
+	})
+
+	t.Run("rule removed", func(t *testing.T) {
+		tx := newTx()
+		categorize([]categoryRule{coffee}, &tx)
+		if !categorize(nil, &tx) {
+			t.Error("categorize reported no change")
+		}
+		if tx.CustomCategory != "" || tx.RuleID != nil || tx.Tags != nil {
+			t.Errorf("got category %q, rule %v, tags %v, want none", tx.CustomCategory, tx.RuleID, tx.Tags)
+		}
+	})
+
+	t.Run("another rule with the same category", func(t *testing.T) {
+		tx := newTx()
+		categorize([]categoryRule{food}, &tx)
+		other := compiledRule(t, categoryRule{NamePattern: "blue", Category: "Food"})
+		if !categorize([]categoryRule{other}, &tx) {
+			t.Error("categorize reported no change")
+		}
+		if *tx.RuleID != other.ID {
+			t.Errorf("rule = %v, want %v", *tx.RuleID, other.ID)
+		}
+	})
+}
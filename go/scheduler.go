@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// job is a task the scheduler runs at a fixed interval.
+type job struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+
+	mu      sync.Mutex
+	lastRun time.Time
+	lastErr error
+}
+
+var jobs []*job
+
+// registerJob adds a background job. Jobs start when startScheduler is
+// called and each run is bounded by the job's interval.
+func registerJob(name string, interval time.Duration, run func(ctx context.Context) error) {
+	jobs = append(jobs, &job{name: name, interval: interval, run: run})
+}
+
+func startScheduler(ctx context.Context) {
+	for _, j := range jobs {
+		go j.loop(ctx)
+	}
+	registerReadinessCheck("scheduler", schedulerAlive)
+	log.Printf("Scheduler started with %d jobs\n", len(jobs))
+}
+
+func (j *job) loop(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		j.runOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *job) runOnce(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, j.interval)
+	defer cancel()
+
+	ctx, span := tracer.Start(ctx, "job "+j.name)
+	defer span.End()
+
+	err := j.run(ctx)
+
+	j.mu.Lock()
+	failedBefore := j.lastErr != nil
+	j.lastRun = time.Now()
+	j.lastErr = err
+	j.mu.Unlock()
+
+	if err != nil {
+		span.RecordError(err)
+		log.Printf("Job %s failed: %v\n", j.name, err)
+	} else if failedBefore {
+		log.Printf("Job %s recovered\n", j.name)
+	}
+}
+
+// schedulerAlive fails when a job has not completed a run for two of its
+// intervals, which means its goroutine is stuck or gone. A failed run is
+// only logged: a transient Plaid error must not take the server out of
+// rotation.
+func schedulerAlive(ctx context.Context) error {
+	for _, j := range jobs {
+		j.mu.Lock()
+		lastRun := j.lastRun
+		j.mu.Unlock()
+
+		if lastRun.IsZero() {
+			continue
+		}
+		if since := time.Since(lastRun); since > 2*j.interval {
+			return fmt.Errorf("job %s has not run for %s", j.name, since.Round(time.Second))
+		}
+	}
+	return nil
+}
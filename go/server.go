@@ -1,13 +1,9 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/base64"
 	"encoding/csv"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -18,6 +14,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	plaid "github.com/plaid/plaid-go/plaid"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 var (
@@ -49,10 +46,6 @@ func init() {
 	PLAID_CLIENT_ID = os.Getenv("PLAID_CLIENT_ID")
 	PLAID_SECRET = os.Getenv("PLAID_SECRET")
 
-	if PLAID_CLIENT_ID == "" || PLAID_SECRET == "" {
-		log.Fatal("Error: PLAID_SECRET or PLAID_CLIENT_ID is not set. Did you copy .env.example to .env and fill it out?")
-	}
-
 	PLAID_ENV = os.Getenv("PLAID_ENV")
 	PLAID_PRODUCTS = os.Getenv("PLAID_PRODUCTS")
 	PLAID_COUNTRY_CODES = os.Getenv("PLAID_COUNTRY_CODES")
@@ -72,18 +65,13 @@ func init() {
 	if APP_PORT == "" {
 		APP_PORT = "8000"
 	}
-	if PLAID_CLIENT_ID == "" {
-		log.Fatal("PLAID_CLIENT_ID is not set. Make sure to fill out the .env file")
-	}
-	if PLAID_SECRET == "" {
-		log.Fatal("PLAID_SECRET is not set. Make sure to fill out the .env file")
-	}
 
 	// create Plaid client
 	configuration := plaid.NewConfiguration()
 	configuration.AddDefaultHeader("PLAID-CLIENT-ID", PLAID_CLIENT_ID)
 	configuration.AddDefaultHeader("PLAID-SECRET", PLAID_SECRET)
 	configuration.UseEnvironment(environments[PLAID_ENV])
+	configuration.HTTPClient = newPlaidHTTPClient()
 	client = plaid.NewAPIClient(configuration)
 
 	t := strings.ToLower(os.Getenv("STORE_DATA"))
@@ -93,9 +81,44 @@ func init() {
 }
 
 func main() {
+	// Checked here rather than in init so that tests run without
+	// credentials.
+	if PLAID_CLIENT_ID == "" || PLAID_SECRET == "" {
+		log.Fatal("Error: PLAID_SECRET or PLAID_CLIENT_ID is not set. Did you copy .env.example to .env and fill it out?")
+	}
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	connectMongo()
+	initHealth()
+	initAuth()
+	initItems()
+	initWebhooks()
+	initLinkToken()
+	initPaymentStatus()
+	initTransferSync()
+	initAssets()
+	initInvestments()
+	initIdentity()
+	initVault()
+	initBalances()
+	initItemHealth()
+	checkStartup()
+
 	r := gin.Default()
+	r.Use(otelgin.Middleware(serviceName))
 
-	r.POST("/api/info", info)
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+	r.POST("/webhook", receiveWebhook)
+
+	api := r.Group("/api", authenticate())
+
+	api.POST("/info", requireScope(scopeAdminItems), info)
 
 	// For OAuth flows, the process looks as follows.
 	// 1. Create a link token with the redirectURI (as white listed at https://dashboard.plaid.com/team/api).
@@ -104,46 +127,117 @@ func main() {
 	// 3. Re-initialize with the link token (from step 1) and the full received redirect URI
 	// from step 2.
 
-	r.POST("/api/set_access_token", getAccessToken)
-	r.POST("/api/create_link_token_for_payment", createLinkTokenForPayment)
-	r.GET("/api/auth", auth)
-	r.GET("/api/accounts", accounts)
-	r.GET("/api/balance", balance)
-	r.GET("/api/item", item)
-	r.POST("/api/item", item)
-	r.GET("/api/identity", identity)
-	r.GET("/api/transactions", transactions)
-	r.POST("/api/transactions", transactions)
-	r.GET("/api/payment", payment)
-	r.GET("/api/create_public_token", createPublicToken)
-	r.POST("/api/create_link_token", createLinkToken)
-	r.GET("/api/investment_transactions", investmentTransactions)
-	r.GET("/api/holdings", holdings)
-	r.GET("/api/assets", assets)
-	r.GET("/api/all/transactions/csv", allTransactionsAsCsv)
-	r.GET("/api/all/balances/csv", allAccountsAsCsv)
-	r.GET("/api/transfer", transfer)
-
-	err := r.Run(":" + APP_PORT)
+	api.POST("/set_access_token", requireScope(scopeLink), getAccessToken)
+	api.POST("/create_link_token_for_payment", requireScope(scopePayments), createLinkTokenForPayment)
+	api.GET("/auth", requireScope(scopeReadAccounts), auth)
+	api.GET("/auth/:account_id/verification", requireScope(scopeReadAccounts), getAccountVerification)
+	api.POST("/auth/:account_id/reveal", requireScope(scopeRevealNumbers), revealAccountNumbers)
+	api.GET("/accounts", requireScope(scopeReadAccounts), accounts)
+	api.GET("/balance", requireScope(scopeReadAccounts), balance)
+	api.GET("/networth", requireScope(scopeReadAccounts), netWorth)
+	api.GET("/item", requireScope(scopeReadAccounts), item)
+	api.POST("/item", requireScope(scopeReadAccounts), item)
+	api.GET("/identity", requireScope(scopeReadAccounts), identity)
+	api.POST("/identity/match", requireScope(scopeReadAccounts), identityMatch)
+	api.GET("/identity/match_checks", requireScope(scopeReadAccounts), listIdentityMatchChecks)
+	api.GET("/transactions", requireScope(scopeReadTransactions), transactions)
+	api.POST("/transactions", requireScope(scopeReadTransactions), transactions)
+	api.GET("/payment", requireScope(scopePayments), payment)
+	api.POST("/payments/recipients", requireScope(scopePayments), createPaymentRecipient)
+	api.GET("/payments/recipients", requireScope(scopePayments), listPaymentRecipients)
+	api.POST("/payments", requireScope(scopePayments), postPayment)
+	api.GET("/payments", requireScope(scopePayments), listPayments)
+	api.GET("/payments/:id", requireScope(scopePayments), getPayment)
+	api.GET("/create_public_token", requireScope(scopeLink), createPublicToken)
+	api.POST("/create_link_token", requireScope(scopeLink), createLinkToken)
+	api.GET("/investment_transactions", requireScope(scopeReadInvestments), investmentTransactions)
+	api.GET("/holdings", requireScope(scopeReadInvestments), holdings)
+	api.GET("/liabilities", requireScope(scopeReadAccounts), liabilities)
+	api.GET("/liabilities/projections", requireScope(scopeReadAccounts), liabilityProjections)
+	api.GET("/liabilities/upcoming", requireScope(scopeReadAccounts), upcomingLiabilityPayments)
+	api.GET("/liabilities/:account_id/schedule", requireScope(scopeReadAccounts), liabilitySchedule)
+	api.POST("/investments/backfill", requireScope(scopeReadInvestments), backfillInvestments)
+	api.GET("/investments/transactions", requireScope(scopeReadInvestments), listInvestmentTransactions)
+	api.GET("/investments/positions/:security_id", requireScope(scopeReadInvestments), positionHistory)
+	api.GET("/investments/cost_basis", requireScope(scopeReadInvestments), costBasis)
+	api.GET("/investments/performance", requireScope(scopeReadInvestments), investmentPerformance)
+	api.GET("/assets", requireScope(scopeReadAssets), assets)
+	api.POST("/assets", requireScope(scopeReadAssets), postAssetReport)
+	api.GET("/assets/reports", requireScope(scopeReadAssets), listAssetReports)
+	api.GET("/assets/:id", requireScope(scopeReadAssets), getAssetReport)
+	api.GET("/assets/:id/pdf", requireScope(scopeReadAssets), getAssetReportPdf)
+	api.POST("/assets/:id/refresh", requireScope(scopeReadAssets), postAssetReportRefresh)
+	api.POST("/assets/:id/filter", requireScope(scopeReadAssets), postAssetReportFilter)
+	api.POST("/assets/:id/audit_copies", requireScope(scopeShareAssets), postAssetReportAuditCopy)
+	api.DELETE("/assets/:id", requireScope(scopeShareAssets), removeAssetReport)
+	api.POST("/rules", requireScope(scopeWriteTransactions), createCategoryRule)
+	api.GET("/rules", requireScope(scopeReadTransactions), listCategoryRules)
+	api.PUT("/rules/:id", requireScope(scopeWriteTransactions), updateCategoryRule)
+	api.DELETE("/rules/:id", requireScope(scopeWriteTransactions), deleteCategoryRule)
+	api.POST("/rules/apply", requireScope(scopeWriteTransactions), postApplyCategoryRules)
+	api.GET("/reports/spending", requireScope(scopeReadTransactions), spendingReport)
+	api.GET("/recurring", requireScope(scopeReadTransactions), recurring)
+	api.POST("/budgets", requireScope(scopeWriteTransactions), createBudget)
+	api.GET("/budgets", requireScope(scopeReadTransactions), getBudgets)
+	api.GET("/budgets/alerts", requireScope(scopeReadTransactions), listBudgetAlerts)
+	api.GET("/budgets/:id", requireScope(scopeReadTransactions), getBudget)
+	api.PUT("/budgets/:id", requireScope(scopeWriteTransactions), updateBudget)
+	api.DELETE("/budgets/:id", requireScope(scopeWriteTransactions), deleteBudget)
+	api.GET("/budgets/:id/periods", requireScope(scopeReadTransactions), budgetPeriods)
+	api.GET("/all/transactions/csv", requireScope(scopeExport), allTransactionsAsCsv)
+	api.GET("/all/balances/csv", requireScope(scopeExport), allAccountsAsCsv)
+	api.GET("/transfer", requireScope(scopePayments), transfer)
+	api.POST("/transfers/authorize", requireScope(scopePayments), postTransferAuthorization)
+	api.POST("/transfers", requireScope(scopePayments), postTransfer)
+	api.GET("/transfers", requireScope(scopePayments), listTransfers)
+	api.GET("/transfers/:id", requireScope(scopePayments), getTransfer)
+	api.POST("/transfers/:id/cancel", requireScope(scopePayments), cancelTransfer)
+	api.GET("/reconciliation/transactions", requireScope(scopeReadTransactions), transactionReconciliation)
+	api.GET("/duplicates", requireScope(scopeReadTransactions), listDuplicates)
+	api.POST("/duplicates/scan", requireScope(scopeWriteTransactions), scanDuplicates)
+	api.POST("/duplicates/:id/merge", requireScope(scopeWriteTransactions), mergeDuplicate)
+	api.POST("/duplicates/:id/reject", requireScope(scopeWriteTransactions), rejectDuplicate)
+	api.GET("/reconciliation/transfers", requireScope(scopePayments), transferReconciliation)
+	api.GET("/reconciliation/transfers/csv", requireScope(scopeExport), transferReconciliationAsCsv)
+
+	api.GET("/items", requireScope(scopeReadAccounts), getItems)
+	api.DELETE("/items/:id", requireScope(scopeAdminItems), removeItem)
+	api.POST("/items/:id/webhook", requireScope(scopeAdminItems), updateItemWebhook)
+	api.POST("/items/:id/link_token/update", requireScope(scopeLink), createUpdateLinkToken)
+
+	api.POST("/keys", requireScope(scopeAdminKeys), createAPIKey)
+	api.GET("/keys", requireScope(scopeAdminKeys), listAPIKeys)
+	api.DELETE("/keys/:id", requireScope(scopeAdminKeys), revokeAPIKey)
+
+	startScheduler(context.Background())
+
+	err = r.Run(":" + APP_PORT)
 	if err != nil {
 		panic("unable to start server")
 	}
 }
 
-// We store the access_token in memory - in production, store it in a secure
-// persistent data store.
-var accessToken string
-var itemID string
+// validationError is a problem with the caller's input, rendered as a 400.
+type validationError struct {
+	msg string
+}
 
-var paymentID string
+func (e *validationError) Error() string {
+	return e.msg
+}
 
-// The transfer_id is only relevant for the Transfer ACH product.
-// We store the transfer_id in memory - in production, store it in a secure
-// persistent data store
-var transferID string
+func invalidf(format string, args ...interface{}) error {
+	return &validationError{msg: fmt.Sprintf(format, args...)}
+}
 
 func renderError(c *gin.Context, originalErr error) {
+	if _, ok := originalErr.(*validationError); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": originalErr.Error()})
+		return
+	}
+
 	if plaidError, err := plaid.ToPlaidError(originalErr); err == nil {
+		recordItemError(c, plaidError.ErrorCode)
 		// Return 200 and allow the front end to render the error.
 		c.JSON(http.StatusOK, gin.H{"error": plaidError})
 		return
@@ -154,7 +248,7 @@ func renderError(c *gin.Context, originalErr error) {
 
 func getAccessToken(c *gin.Context) {
 	publicToken := c.PostForm("public_token")
-	ctx := context.Background()
+	ctx := c.Request.Context()
 
 	// exchange the public_token for an access_token
 	exchangePublicTokenResp, _, err := client.PlaidApi.ItemPublicTokenExchange(ctx).ItemPublicTokenExchangeRequest(
@@ -165,96 +259,43 @@ func getAccessToken(c *gin.Context) {
 		return
 	}
 
-	accessToken = exchangePublicTokenResp.GetAccessToken()
-	itemID = exchangePublicTokenResp.GetItemId()
-	if itemExists(strings.Split(PLAID_PRODUCTS, ","), "transfer") {
-		transferID, err = authorizeAndCreateTransfer(ctx, client, accessToken)
-		if err != nil {
-			log.Println(err)
-		}
-	}
-
-	fmt.Println("public token: " + publicToken)
-	fmt.Println("access token: " + accessToken)
-	fmt.Println("item ID: " + itemID)
+	accessToken := exchangePublicTokenResp.GetAccessToken()
+	itemID := exchangePublicTokenResp.GetItemId()
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token": accessToken,
-		"item_id":      itemID,
-	})
-}
-
-// This functionality is only relevant for the UK Payment Initiation product.
-// Creates a link token configured for payment initiation. The payment
-// information will be associated with the link token, and will not have to be
-// passed in again when we initialize Plaid Link.
-func createLinkTokenForPayment(c *gin.Context) {
-	ctx := context.Background()
-
-	// Create payment recipient
-	paymentRecipientRequest := plaid.NewPaymentInitiationRecipientCreateRequest("Harry Potter")
-	paymentRecipientRequest.SetIban("GB33BUKB20201555555555")
-	paymentRecipientRequest.SetAddress(*plaid.NewPaymentInitiationAddress(
-		[]string{"4 Privet Drive"},
-		"Little Whinging",
-		"11111",
-		"GB",
-	))
-	paymentRecipientCreateResp, _, err := client.PlaidApi.PaymentInitiationRecipientCreate(ctx).PaymentInitiationRecipientCreateRequest(*paymentRecipientRequest).Execute()
-	if err != nil {
+	// The access_token is kept in the item store, owned by the caller.
+	p := currentPrincipal(c)
+	if err := ensureUser(ctx, p); err != nil {
 		renderError(c, err)
 		return
 	}
-
-	// Create payment
-	paymentCreateRequest := plaid.NewPaymentInitiationPaymentCreateRequest(
-		paymentRecipientCreateResp.GetRecipientId(),
-		"paymentRef",
-		*plaid.NewPaymentAmount("GBP", 1.34),
-	)
-	paymentCreateResp, _, err := client.PlaidApi.PaymentInitiationPaymentCreate(ctx).PaymentInitiationPaymentCreateRequest(*paymentCreateRequest).Execute()
-	if err != nil {
+	if err := saveItem(ctx, &storedItem{
+		ItemID:      itemID,
+		UserID:      p.Subject,
+		AccessToken: accessToken,
+		CreatedAt:   time.Now().UTC(),
+	}); err != nil {
 		renderError(c, err)
 		return
 	}
 
-	paymentID = paymentCreateResp.GetPaymentId()
-	fmt.Println("payment id: " + paymentID)
+	// Tokens are secrets of the item's owner and are never logged.
+	log.Printf("Item %s linked\n", itemID)
 
-	linkTokenCreateReqPaymentInitiation := plaid.NewLinkTokenCreateRequestPaymentInitiation(paymentID)
-	linkToken, err := linkTokenCreate(linkTokenCreateReqPaymentInitiation)
-	if err != nil {
-		renderError(c, err)
-		return
-	}
 	c.JSON(http.StatusOK, gin.H{
-		"link_token": linkToken,
+		"access_token": accessToken,
+		"item_id":      itemID,
 	})
 }
 
-func auth(c *gin.Context) {
-	ctx := context.Background()
-
-	authGetResp, _, err := client.PlaidApi.AuthGet(ctx).AuthGetRequest(
-		*plaid.NewAuthGetRequest(accessToken),
-	).Execute()
-
-	if err != nil {
-		renderError(c, err)
+func accounts(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := requireItem(c)
+	if !ok {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"accounts": authGetResp.GetAccounts(),
-		"numbers":  authGetResp.GetNumbers(),
-	})
-}
-
-func accounts(c *gin.Context) {
-	ctx := context.Background()
-
 	accountsGetResp, _, err := client.PlaidApi.AccountsGet(ctx).AccountsGetRequest(
-		*plaid.NewAccountsGetRequest(accessToken),
+		*plaid.NewAccountsGetRequest(it.AccessToken),
 	).Execute()
 
 	if err != nil {
@@ -267,28 +308,15 @@ func accounts(c *gin.Context) {
 	})
 }
 
-func balance(c *gin.Context) {
-	ctx := context.Background()
-
-	balancesGetResp, _, err := client.PlaidApi.AccountsBalanceGet(ctx).AccountsBalanceGetRequest(
-		*plaid.NewAccountsBalanceGetRequest(accessToken),
-	).Execute()
-
-	if err != nil {
-		renderError(c, err)
+func item(c *gin.Context) {
+	ctx := c.Request.Context()
+	it, ok := requireItem(c)
+	if !ok {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"accounts": balancesGetResp.GetAccounts(),
-	})
-}
-
-func item(c *gin.Context) {
-	ctx := context.Background()
-
 	itemGetResp, _, err := client.PlaidApi.ItemGet(ctx).ItemGetRequest(
-		*plaid.NewItemGetRequest(accessToken),
+		*plaid.NewItemGetRequest(it.AccessToken),
 	).Execute()
 
 	if err != nil {
@@ -299,7 +327,7 @@ func item(c *gin.Context) {
 	institutionGetByIdResp, _, err := client.PlaidApi.InstitutionsGetById(ctx).InstitutionsGetByIdRequest(
 		*plaid.NewInstitutionsGetByIdRequest(
 			*itemGetResp.GetItem().InstitutionId.Get(),
-			convertCountryCodes(strings.Split(PLAID_COUNTRY_CODES, ",")),
+			convertCountryCodes(splitList(PLAID_COUNTRY_CODES)),
 		),
 	).Execute()
 
@@ -314,23 +342,12 @@ func item(c *gin.Context) {
 	})
 }
 
-func identity(c *gin.Context) {
-	ctx := context.Background()
-
-	identityGetResp, _, err := client.PlaidApi.IdentityGet(ctx).IdentityGetRequest(
-		*plaid.NewIdentityGetRequest(accessToken),
-	).Execute()
-	if err != nil {
-		renderError(c, err)
+func transactions(c *gin.Context) {
+	it, ok := requireItem(c)
+	if !ok {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"identity": identityGetResp.GetAccounts(),
-	})
-}
-
-func transactions(c *gin.Context) {
 	const iso8601TimeFormat = "2006-01-02"
 	// pull transactions for the past year
 	endDate := time.Now().Local().Format(iso8601TimeFormat)
@@ -349,12 +366,13 @@ func transactions(c *gin.Context) {
 	log.Printf("%10s\t%10s\t%10s\n", "Offset", "Count", "Total")
 	log.Printf("%10d\t%10d\t%10d\n", offset, count, total)
 
-	ctx := context.Background()
+	ctx := c.Request.Context()
+	page := 0
 
 	for total < 0 || offset < total {
 
 		transGetReq := *plaid.NewTransactionsGetRequest(
-			accessToken,
+			it.AccessToken,
 			startDate,
 			endDate,
 		)
@@ -365,7 +383,7 @@ func transactions(c *gin.Context) {
 
 		transGetReq.Options = &options
 
-		response, _, err := client.PlaidApi.TransactionsGet(ctx).TransactionsGetRequest(
+		response, _, err := client.PlaidApi.TransactionsGet(withPlaidPage(ctx, page)).TransactionsGetRequest(
 			transGetReq,
 		).Execute()
 		//			response, err := client.GetTransactionsWithOptions(accessToken, options)
@@ -384,14 +402,15 @@ func transactions(c *gin.Context) {
 
 		total = response.TotalTransactions
 		offset += count
+		page++
 
 		log.Printf("%10d\t%10d\t%10d\n", offset, count, total)
 	}
 
 	if STORE_DATA {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
 		defer cancel()
-		if err := saveToDb(ctx, accounts, transactions); err != nil {
+		if err := saveToDb(ctx, it, accounts, transactions); err != nil {
 			renderError(c, err)
 			return
 		}
@@ -404,10 +423,10 @@ func transactions(c *gin.Context) {
 }
 
 func allAccountsAsCsv(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
 	defer cancel()
 
-	all, err := fetchAllAccounts(ctx)
+	all, err := fetchAllAccounts(ctx, currentPrincipal(c).Subject)
 	if err != nil {
 		renderError(c, err)
 		return
@@ -442,14 +461,17 @@ func allAccountsAsCsv(c *gin.Context) {
 }
 
 func allTransactionsAsCsv(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
 	defer cancel()
 
-	all, err := fetchAllTransactions(ctx)
+	all, err := fetchAllTransactions(ctx, currentPrincipal(c).Subject)
 	if err != nil {
 		renderError(c, err)
 		return
 	}
+	// Transactions merged into one of another item are exported once,
+	// unless include_duplicates asks for both copies.
+	includeDuplicates := strings.ToLower(c.Query("include_duplicates")) == "true"
 
 	c.Header("Content-Type", "text/csv")
 
@@ -459,6 +481,9 @@ func allTransactionsAsCsv(c *gin.Context) {
 	writeCsvHeaderTransactions(cw)
 	// write records
 	for _, t := range all {
+		if t.DuplicateOf != "" && !includeDuplicates {
+			continue
+		}
 		var rec []string
 		rec = append(rec, t.AccountId)
 		rec = append(rec, fmt.Sprintf("%f", t.Amount))
@@ -498,6 +523,10 @@ func allTransactionsAsCsv(c *gin.Context) {
 		rec = append(rec, *t.TransactionType)
 		rec = append(rec, string(t.GetTransactionCode()))
 
+		rec = append(rec, t.CustomCategory)
+		rec = append(rec, strings.Join(t.Tags, ","))
+		rec = append(rec, t.DuplicateOf)
+
 		cw.Write(rec)
 	}
 
@@ -563,6 +592,8 @@ func writeCsvHeaderTransactions(cw *csv.Writer) {
 		[]string{"PaymentChannel", "Pending", "PendingTransactionID", "AccountOwner", "ID", "Type", "Code"},
 	)
 
+	rec = append(rec, "custom_category", "tags", "duplicate_of")
+
 	cw.Write(rec)
 }
 
@@ -579,93 +610,42 @@ func addFieldsByJsonTag(rec []string, tType reflect.Type, fields []string) []str
 	return rec
 }
 
-// This functionality is only relevant for the UK Payment Initiation product.
-// Retrieve Payment for a specified Payment ID
-func payment(c *gin.Context) {
-	ctx := context.Background()
-
-	paymentGetResp, _, err := client.PlaidApi.PaymentInitiationPaymentGet(ctx).PaymentInitiationPaymentGetRequest(
-		*plaid.NewPaymentInitiationPaymentGetRequest(paymentID),
-	).Execute()
-
-	if err != nil {
-		renderError(c, err)
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"payment": paymentGetResp,
-	})
-}
-
-// This functionality is only relevant for the ACH Transfer product.
-// Retrieve Transfer for a specified Transfer ID
-func transfer(c *gin.Context) {
-	ctx := context.Background()
-
-	transferGetResp, _, err := client.PlaidApi.TransferGet(ctx).TransferGetRequest(
-		*plaid.NewTransferGetRequest(transferID),
-	).Execute()
-	if err != nil {
-		renderError(c, err)
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"transfer": transferGetResp.GetTransfer(),
-	})
-}
-
-func investmentTransactions(c *gin.Context) {
-	ctx := context.Background()
-
-	endDate := time.Now().Local().Format("2006-01-02")
-	startDate := time.Now().Local().Add(-30 * 24 * time.Hour).Format("2006-01-02")
-
-	request := plaid.NewInvestmentsTransactionsGetRequest(accessToken, startDate, endDate)
-	invTxResp, _, err := client.PlaidApi.InvestmentsTransactionsGet(ctx).InvestmentsTransactionsGetRequest(*request).Execute()
+// info reports the configured products and the caller's item. The item's
+// access token is only returned to authenticated callers; with AUTH_MODE
+// none anyone reaching the server would get it.
+func info(c *gin.Context) {
+	var itemID, accessToken string
 
-	if err != nil {
+	it, err := resolveItem(c)
+	if err != nil && err != errNoItem {
 		renderError(c, err)
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"investment_transactions": invTxResp,
-	})
-}
-
-func holdings(c *gin.Context) {
-	ctx := context.Background()
-
-	holdingsGetResp, _, err := client.PlaidApi.InvestmentsHoldingsGet(ctx).InvestmentsHoldingsGetRequest(
-		*plaid.NewInvestmentsHoldingsGetRequest(accessToken),
-	).Execute()
-	if err != nil {
-		renderError(c, err)
-		return
+	if it != nil {
+		itemID = it.ItemID
+		if currentPrincipal(c).authenticated() {
+			accessToken = it.AccessToken
+		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"holdings": holdingsGetResp,
-	})
-}
-
-func info(context *gin.Context) {
-	context.JSON(http.StatusOK, map[string]interface{}{
+	c.JSON(http.StatusOK, map[string]interface{}{
 		"item_id":      itemID,
 		"access_token": accessToken,
-		"products":     strings.Split(PLAID_PRODUCTS, ","),
+		"products":     splitList(PLAID_PRODUCTS),
 	})
 }
 
 func createPublicToken(c *gin.Context) {
-	ctx := context.Background()
+	ctx := c.Request.Context()
+	it, ok := requireItem(c)
+	if !ok {
+		return
+	}
 
 	// Create a one-time use public_token for the Item.
 	// This public_token can be used to initialize Link in update mode for a user
 	publicTokenCreateResp, _, err := client.PlaidApi.ItemCreatePublicToken(ctx).ItemPublicTokenCreateRequest(
-		*plaid.NewItemPublicTokenCreateRequest(accessToken),
+		*plaid.NewItemPublicTokenCreateRequest(it.AccessToken),
 	).Execute()
 
 	if err != nil {
@@ -679,7 +659,27 @@ func createPublicToken(c *gin.Context) {
 }
 
 func createLinkToken(c *gin.Context) {
-	linkToken, err := linkTokenCreate(nil)
+	ctx := c.Request.Context()
+	p := currentPrincipal(c)
+	if err := ensureUser(ctx, p); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	// An empty body keeps the configured defaults.
+	opts := linkTokenOptions{}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&opts); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := opts.validate(); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	linkToken, err := linkTokenCreate(ctx, p.Subject, &opts)
 	if err != nil {
 		renderError(c, err)
 		return
@@ -707,160 +707,6 @@ func convertProducts(productStrs []string) []plaid.Products {
 	return products
 }
 
-// linkTokenCreate creates a link token using the specified parameters
-func linkTokenCreate(
-	paymentInitiation *plaid.LinkTokenCreateRequestPaymentInitiation,
-) (string, error) {
-	ctx := context.Background()
-	countryCodes := convertCountryCodes(strings.Split(PLAID_COUNTRY_CODES, ","))
-	products := convertProducts(strings.Split(PLAID_PRODUCTS, ","))
-	redirectURI := PLAID_REDIRECT_URI
-
-	user := plaid.LinkTokenCreateRequestUser{
-		ClientUserId: time.Now().String(),
-	}
-
-	request := plaid.NewLinkTokenCreateRequest(
-		"Plaid Quickstart",
-		"en",
-		countryCodes,
-		user,
-	)
-
-	request.SetProducts(products)
-
-	if redirectURI != "" {
-		request.SetRedirectUri(redirectURI)
-	}
-
-	if paymentInitiation != nil {
-		request.SetPaymentInitiation(*paymentInitiation)
-	}
-
-	linkTokenCreateResp, _, err := client.PlaidApi.LinkTokenCreate(ctx).LinkTokenCreateRequest(*request).Execute()
-
-	if err != nil {
-		return "", err
-	}
-
-	return linkTokenCreateResp.GetLinkToken(), nil
-}
-
-func assets(c *gin.Context) {
-	ctx := context.Background()
-
-	// create the asset report
-	assetReportCreateResp, _, err := client.PlaidApi.AssetReportCreate(ctx).AssetReportCreateRequest(
-		*plaid.NewAssetReportCreateRequest([]string{accessToken}, 10),
-	).Execute()
-	if err != nil {
-		renderError(c, err)
-		return
-	}
-
-	assetReportToken := assetReportCreateResp.GetAssetReportToken()
-
-	// get the asset report
-	assetReportGetResp, err := pollForAssetReport(ctx, client, assetReportToken)
-	if err != nil {
-		renderError(c, err)
-		return
-	}
-
-	// get it as a pdf
-	pdfRequest := plaid.NewAssetReportPDFGetRequest(assetReportToken)
-	pdfFile, _, err := client.PlaidApi.AssetReportPdfGet(ctx).AssetReportPDFGetRequest(*pdfRequest).Execute()
-	if err != nil {
-		renderError(c, err)
-		return
-	}
-
-	reader := bufio.NewReader(pdfFile)
-	content, err := ioutil.ReadAll(reader)
-	if err != nil {
-		renderError(c, err)
-		return
-	}
-
-	// convert pdf to base64
-	encodedPdf := base64.StdEncoding.EncodeToString(content)
-
-	c.JSON(http.StatusOK, gin.H{
-		"json": assetReportGetResp.GetReport(),
-		"pdf":  encodedPdf,
-	})
-}
-
-func pollForAssetReport(ctx context.Context, client *plaid.APIClient, assetReportToken string) (*plaid.AssetReportGetResponse, error) {
-	numRetries := 20
-	request := plaid.NewAssetReportGetRequest(assetReportToken)
-
-	for i := 0; i < numRetries; i++ {
-		response, _, err := client.PlaidApi.AssetReportGet(ctx).AssetReportGetRequest(*request).Execute()
-		if err != nil {
-			plaidErr, err := plaid.ToPlaidError(err)
-			if plaidErr.ErrorCode == "PRODUCT_NOT_READY" {
-				time.Sleep(1 * time.Second)
-				continue
-			} else {
-				return nil, err
-			}
-		} else {
-			return &response, nil
-		}
-	}
-	return nil, errors.New("Timed out when polling for an asset report.")
-}
-
-// This is a helper function to authorize and create a Transfer after successful
-// exchange of a public_token for an access_token. The transfer_id is then used
-// to obtain the data about that particular Transfer.
-func authorizeAndCreateTransfer(ctx context.Context, client *plaid.APIClient, accessToken string) (string, error) {
-	// We call /accounts/get to obtain first account_id - in production,
-	// account_id's should be persisted in a data store and retrieved
-	// from there.
-	accountsGetResp, _, _ := client.PlaidApi.AccountsGet(ctx).AccountsGetRequest(
-		*plaid.NewAccountsGetRequest(accessToken),
-	).Execute()
-
-	accountID := accountsGetResp.GetAccounts()[0].AccountId
-
-	transferAuthorizationCreateUser := plaid.NewTransferUserInRequest("FirstName LastName")
-	transferAuthorizationCreateRequest := plaid.NewTransferAuthorizationCreateRequest(
-		accessToken,
-		accountID,
-		"credit",
-		"ach",
-		"1.34",
-		"ppd",
-		*transferAuthorizationCreateUser,
-	)
-	transferAuthorizationCreateResp, _, err := client.PlaidApi.TransferAuthorizationCreate(ctx).TransferAuthorizationCreateRequest(*transferAuthorizationCreateRequest).Execute()
-	if err != nil {
-		return "", err
-	}
-	authorizationID := transferAuthorizationCreateResp.GetAuthorization().Id
-
-	transferCreateRequest := plaid.NewTransferCreateRequest(
-		"1223abc456xyz7890001",
-		accessToken,
-		accountID,
-		authorizationID,
-		"credit",
-		"ach",
-		"1.34",
-		"Payment",
-		"ppd",
-		*transferAuthorizationCreateUser,
-	)
-	transferCreateResp, _, err := client.PlaidApi.TransferCreate(ctx).TransferCreateRequest(*transferCreateRequest).Execute()
-	if err != nil {
-		return "", err
-	}
-
-	return transferCreateResp.GetTransfer().Id, nil
-}
-
 // Helper function to determine if Transfer is in Plaid product array
 func itemExists(array []string, product string) bool {
 	for _, item := range array {
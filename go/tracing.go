@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "plaid-quickstart"
+
+// TRACING_EXPORTER selects where spans are sent: "otlp" (a collector reached
+// through the standard OTEL_EXPORTER_OTLP_* variables), "stdout", or "none".
+var TRACING_EXPORTER = ""
+
+var tracer = otel.Tracer("github.com/plaid/quickstart")
+
+// initTracing installs the global tracer provider. The returned function
+// flushes pending spans and must be called before the process exits.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	TRACING_EXPORTER = strings.ToLower(os.Getenv("TRACING_EXPORTER"))
+	if TRACING_EXPORTER == "" {
+		TRACING_EXPORTER = "none"
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch TRACING_EXPORTER {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown TRACING_EXPORTER %q", TRACING_EXPORTER)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(
+		resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	log.Printf("Tracing exporter: %s\n", TRACING_EXPORTER)
+
+	return tp.Shutdown, nil
+}
+
+type plaidPageKey struct{}
+
+// withPlaidPage marks the Plaid calls made with ctx as belonging to the given
+// page of a paginated request.
+func withPlaidPage(ctx context.Context, page int) context.Context {
+	return context.WithValue(ctx, plaidPageKey{}, page)
+}
+
+// plaidTransport records a client span for every request the Plaid client
+// sends, named after the endpoint it calls.
+type plaidTransport struct {
+	base http.RoundTripper
+}
+
+func newPlaidHTTPClient() *http.Client {
+	return &http.Client{Transport: &plaidTransport{base: http.DefaultTransport}}
+}
+
+func (t *plaidTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := req.URL.Path
+
+	attrs := []attribute.KeyValue{
+		attribute.String("plaid.endpoint", endpoint),
+		semconv.HTTPMethodKey.String(req.Method),
+		semconv.HTTPURLKey.String(req.URL.String()),
+	}
+	if page, ok := req.Context().Value(plaidPageKey{}).(int); ok {
+		attrs = append(attrs, attribute.Int("plaid.page", page))
+	}
+
+	ctx, span := tracer.Start(req.Context(), "plaid "+endpoint,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	defer span.End()
+
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TRANSFER_SYNC_INTERVAL is how often /transfer/event/sync is consumed. A
+// TRANSFER_EVENTS_UPDATE webhook triggers a sync right away.
+var TRANSFER_SYNC_INTERVAL = time.Minute
+
+// TRANSFER_PENDING_THRESHOLD is how long a transfer may stay pending before
+// the reconciliation report flags it as stuck.
+var TRANSFER_PENDING_THRESHOLD = 5 * 24 * time.Hour
+
+// transferSyncCursor is the _id of the cursors document holding the last
+// consumed transfer event.
+const transferSyncCursor = "transfer_events"
+
+// Plaid returns at most 25 events per /transfer/event/sync call.
+const transferEventPageSize = 25
+
+// transferStatusEvent is a transfer event as recorded on the transfer.
+type transferStatusEvent struct {
+	EventID       int32     `bson:"event_id" json:"event_id"`
+	EventType     string    `bson:"event_type" json:"event_type"`
+	Timestamp     time.Time `bson:"timestamp" json:"timestamp"`
+	FailureReason string    `bson:"failure_reason,omitempty" json:"failure_reason,omitempty"`
+}
+
+type syncCursor struct {
+	Name      string    `bson:"_id"`
+	AfterID   int32     `bson:"after_id"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+// transferSyncMu keeps the scheduled sync and webhook-triggered syncs from
+// consuming the same events concurrently.
+var transferSyncMu sync.Mutex
+
+func initTransferSync() {
+	if v := os.Getenv("TRANSFER_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid TRANSFER_SYNC_INTERVAL %q: %v", v, err)
+		}
+		TRANSFER_SYNC_INTERVAL = d
+	}
+	if v := os.Getenv("TRANSFER_PENDING_THRESHOLD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid TRANSFER_PENDING_THRESHOLD %q: %v", v, err)
+		}
+		TRANSFER_PENDING_THRESHOLD = d
+	}
+
+	// Without Transfer every sync fails, so there is nothing to consume.
+	if !productEnabled("transfer") {
+		return
+	}
+	registerWebhookHandler("TRANSFER", handleTransferWebhook)
+	registerJob("transfer-event-sync", TRANSFER_SYNC_INTERVAL, syncTransferEvents)
+}
+
+func handleTransferWebhook(ctx context.Context, wh *webhook) error {
+	if wh.WebhookCode != "TRANSFER_EVENTS_UPDATE" {
+		return nil
+	}
+	return syncTransferEvents(ctx)
+}
+
+// syncTransferEvents consumes transfer events after the persisted cursor and
+// applies them to the ledger. The cursor is saved after every page, so an
+// interrupted sync resumes where it stopped.
+func syncTransferEvents(ctx context.Context) error {
+	transferSyncMu.Lock()
+	defer transferSyncMu.Unlock()
+
+	var cursor syncCursor
+	err := collection("cursors").FindOne(ctx, bson.M{"_id": transferSyncCursor}).Decode(&cursor)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	for page := 0; ; page++ {
+		request := plaid.NewTransferEventSyncRequest(cursor.AfterID)
+		request.SetCount(transferEventPageSize)
+		eventSyncResp, _, err := client.PlaidApi.TransferEventSync(withPlaidPage(ctx, page)).TransferEventSyncRequest(*request).Execute()
+		if err != nil {
+			return err
+		}
+
+		events := eventSyncResp.GetTransferEvents()
+		for _, e := range events {
+			if err := applyTransferEvent(ctx, &e); err != nil {
+				return err
+			}
+			cursor.AfterID = e.GetEventId()
+		}
+
+		if len(events) > 0 {
+			_, err := collection("cursors").UpdateOne(ctx,
+				bson.M{"_id": transferSyncCursor},
+				bson.M{"$set": bson.M{"after_id": cursor.AfterID, "updated_at": time.Now().UTC()}},
+				options.Update().SetUpsert(true),
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(events) < transferEventPageSize {
+			return nil
+		}
+	}
+}
+
+// applyTransferEvent records the event on its transfer and moves the
+// transfer to the event's status. Events already applied are skipped, and
+// events for transfers not in the ledger are ignored.
+func applyTransferEvent(ctx context.Context, e *plaid.TransferEvent) error {
+	ev := transferStatusEvent{
+		EventID:   e.GetEventId(),
+		EventType: string(e.GetEventType()),
+		Timestamp: e.GetTimestamp().UTC(),
+	}
+	if failure, ok := e.GetFailureReasonOk(); ok && failure != nil {
+		ev.FailureReason = failure.GetDescription()
+	}
+
+	set := bson.M{
+		"status":        ev.EventType,
+		"last_event_id": ev.EventID,
+		"updated_at":    time.Now().UTC(),
+	}
+	if ev.FailureReason != "" {
+		set["failure_reason"] = ev.FailureReason
+	}
+
+	_, err := collection("transfers").UpdateOne(ctx,
+		bson.M{
+			"transfer_id":   e.GetTransferId(),
+			"last_event_id": bson.M{"$not": bson.M{"$gte": ev.EventID}},
+		},
+		bson.M{"$set": set, "$push": bson.M{"events": ev}},
+	)
+	return err
+}
+
+// Reconciliation issues.
+const (
+	transferIssueStuckPending = "stuck_pending"
+	transferIssueReturned     = "returned"
+)
+
+type transferIssue struct {
+	Issue    string          `json:"issue"`
+	Age      string          `json:"age"`
+	Transfer *storedTransfer `json:"transfer"`
+}
+
+// reconcileTransfers lists the user's transfers that need attention: those
+// pending for longer than threshold and those returned by the receiving
+// bank, which Plaid reports as reversed.
+func reconcileTransfers(ctx context.Context, userID string, threshold time.Duration) ([]transferIssue, error) {
+	now := time.Now().UTC()
+	curr, err := collection("transfers").Find(ctx,
+		bson.M{
+			"user_id": userID,
+			"$or": []bson.M{
+				{"status": transferStatusPending, "created_at": bson.M{"$lt": now.Add(-threshold)}},
+				{"status": transferStatusReversed},
+			},
+		},
+		options.Find().SetSort(bson.M{"created_at": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var transfers []storedTransfer
+	if err := curr.All(ctx, &transfers); err != nil {
+		return nil, err
+	}
+
+	issues := make([]transferIssue, 0, len(transfers))
+	for i := range transfers {
+		t := &transfers[i]
+		issue := transferIssueStuckPending
+		if t.Status == transferStatusReversed {
+			issue = transferIssueReturned
+		}
+		issues = append(issues, transferIssue{
+			Issue:    issue,
+			Age:      now.Sub(t.CreatedAt).Round(time.Minute).String(),
+			Transfer: t,
+		})
+	}
+	return issues, nil
+}
+
+// reconciliationThreshold reads the optional pending_threshold query
+// parameter, a duration such as "72h".
+func reconciliationThreshold(c *gin.Context) (time.Duration, error) {
+	v := c.Query("pending_threshold")
+	if v == "" {
+		return TRANSFER_PENDING_THRESHOLD, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, invalidf("pending_threshold must be a positive duration such as \"72h\"")
+	}
+	return d, nil
+}
+
+func transferReconciliation(c *gin.Context) {
+	threshold, err := reconciliationThreshold(c)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	issues, err := reconcileTransfers(c.Request.Context(), currentPrincipal(c).Subject, threshold)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pending_threshold": threshold.String(),
+		"issues":            issues,
+	})
+}
+
+func transferReconciliationAsCsv(c *gin.Context) {
+	threshold, err := reconciliationThreshold(c)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	issues, err := reconcileTransfers(ctx, currentPrincipal(c).Subject, threshold)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+
+	cw := csv.NewWriter(c.Writer)
+	cw.Comma = '#'
+
+	cw.Write([]string{
+		"issue", "age", "transfer_id", "authorization_id", "item_id", "account_id",
+		"type", "network", "amount", "description", "status", "failure_reason",
+		"created_at", "updated_at", "last_event_id",
+	})
+
+	for _, i := range issues {
+		t := i.Transfer
+		cw.Write([]string{
+			i.Issue,
+			i.Age,
+			t.TransferID,
+			t.AuthorizationID,
+			t.ItemID,
+			t.AccountID,
+			t.Type,
+			t.Network,
+			t.Amount,
+			t.Description,
+			t.Status,
+			t.FailureReason,
+			t.CreatedAt.Format(time.RFC3339),
+			t.UpdatedAt.Format(time.RFC3339),
+			strconv.Itoa(int(t.LastEventID)),
+		})
+	}
+
+	cw.Flush()
+}
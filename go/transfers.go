@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	plaid "github.com/plaid/plaid-go/plaid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// This functionality is only relevant for the ACH Transfer product. Every
+// authorization is recorded in the transfers ledger together with the
+// idempotency key its transfer is created with, so a retried create never
+// moves money twice.
+
+type transferUser struct {
+	LegalName    string `bson:"legal_name" json:"legal_name"`
+	EmailAddress string `bson:"email_address,omitempty" json:"email_address,omitempty"`
+	PhoneNumber  string `bson:"phone_number,omitempty" json:"phone_number,omitempty"`
+}
+
+type storedTransfer struct {
+	AuthorizationID   string                `bson:"_id" json:"authorization_id"`
+	TransferID        string                `bson:"transfer_id,omitempty" json:"transfer_id,omitempty"`
+	IdempotencyKey    string                `bson:"idempotency_key" json:"idempotency_key"`
+	UserID            string                `bson:"user_id" json:"-"`
+	ItemID            string                `bson:"item_id" json:"item_id"`
+	AccountID         string                `bson:"account_id" json:"account_id"`
+	Type              string                `bson:"type" json:"type"`
+	Network           string                `bson:"network" json:"network"`
+	AchClass          string                `bson:"ach_class" json:"ach_class"`
+	Amount            string                `bson:"amount" json:"amount"`
+	Description       string                `bson:"description" json:"description"`
+	User              transferUser          `bson:"user" json:"user"`
+	Decision          string                `bson:"decision" json:"decision"`
+	DecisionRationale string                `bson:"decision_rationale,omitempty" json:"decision_rationale,omitempty"`
+	Status            string                `bson:"status,omitempty" json:"status,omitempty"`
+	FailureReason     string                `bson:"failure_reason,omitempty" json:"failure_reason,omitempty"`
+	Events            []transferStatusEvent `bson:"events,omitempty" json:"events,omitempty"`
+	LastEventID       int32                 `bson:"last_event_id,omitempty" json:"-"`
+	CreatedAt         time.Time             `bson:"created_at" json:"created_at"`
+	UpdatedAt         time.Time             `bson:"updated_at" json:"updated_at"`
+}
+
+// Transfer statuses reported by Plaid.
+const (
+	transferStatusPending   = string(plaid.TRANSFERSTATUS_PENDING)
+	transferStatusPosted    = string(plaid.TRANSFERSTATUS_POSTED)
+	transferStatusCancelled = string(plaid.TRANSFERSTATUS_CANCELLED)
+	transferStatusFailed    = string(plaid.TRANSFERSTATUS_FAILED)
+	transferStatusReversed  = string(plaid.TRANSFERSTATUS_REVERSED)
+)
+
+var (
+	transferTypes      = []string{string(plaid.TRANSFERTYPE_DEBIT), string(plaid.TRANSFERTYPE_CREDIT)}
+	transferNetworks   = []string{string(plaid.TRANSFERNETWORK_ACH), string(plaid.TRANSFERNETWORK_SAME_DAY_ACH)}
+	transferAchClasses = []string{string(plaid.ACHCLASS_PPD), string(plaid.ACHCLASS_CCD), string(plaid.ACHCLASS_WEB)}
+
+	transferAmountRe = regexp.MustCompile(`^[0-9]+\.[0-9]{2}$`)
+)
+
+// Plaid limits transfer descriptions to 10 characters.
+const maxTransferDescription = 10
+
+type authorizeTransferRequest struct {
+	ItemID      string       `json:"item_id"`
+	AccountID   string       `json:"account_id"`
+	Type        string       `json:"type"`
+	Network     string       `json:"network"`
+	AchClass    string       `json:"ach_class"`
+	Amount      string       `json:"amount"`
+	Description string       `json:"description"`
+	User        transferUser `json:"user"`
+}
+
+func (r *authorizeTransferRequest) normalize() error {
+	r.Type = strings.ToLower(strings.TrimSpace(r.Type))
+	r.Network = strings.ToLower(strings.TrimSpace(r.Network))
+	r.AchClass = strings.ToLower(strings.TrimSpace(r.AchClass))
+	r.Amount = strings.TrimSpace(r.Amount)
+	r.Description = strings.TrimSpace(r.Description)
+	r.User.LegalName = strings.TrimSpace(r.User.LegalName)
+
+	if r.Network == "" {
+		r.Network = string(plaid.TRANSFERNETWORK_ACH)
+	}
+	if r.AchClass == "" {
+		r.AchClass = string(plaid.ACHCLASS_PPD)
+	}
+
+	if r.AccountID == "" {
+		return invalidf("account_id is required")
+	}
+	if !itemExists(transferTypes, r.Type) {
+		return invalidf("type must be one of %s", strings.Join(transferTypes, ", "))
+	}
+	if !itemExists(transferNetworks, r.Network) {
+		return invalidf("network must be one of %s", strings.Join(transferNetworks, ", "))
+	}
+	if !itemExists(transferAchClasses, r.AchClass) {
+		return invalidf("ach_class must be one of %s", strings.Join(transferAchClasses, ", "))
+	}
+	if !transferAmountRe.MatchString(r.Amount) {
+		return invalidf("amount must be a decimal string with two places, such as \"12.34\"")
+	}
+	if amount, _ := strconv.ParseFloat(r.Amount, 64); amount <= 0 {
+		return invalidf("amount must be positive")
+	}
+	if r.Description == "" || len(r.Description) > maxTransferDescription {
+		return invalidf("description must be 1 to %d characters", maxTransferDescription)
+	}
+	if r.User.LegalName == "" {
+		return invalidf("user.legal_name is required")
+	}
+	return nil
+}
+
+func (u transferUser) plaidUser() plaid.TransferUserInRequest {
+	user := plaid.NewTransferUserInRequest(u.LegalName)
+	if u.EmailAddress != "" {
+		user.SetEmailAddress(u.EmailAddress)
+	}
+	if u.PhoneNumber != "" {
+		user.SetPhoneNumber(u.PhoneNumber)
+	}
+	return *user
+}
+
+// newIdempotencyKey returns a random key for /transfer/create. Plaid accepts
+// up to 50 characters.
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authorizeTransfer asks Plaid to authorize the transfer and records the
+// decision in the ledger, along with the idempotency key the transfer will
+// be created with.
+func authorizeTransfer(ctx context.Context, it *storedItem, req *authorizeTransferRequest) (*storedTransfer, error) {
+	if err := req.normalize(); err != nil {
+		return nil, err
+	}
+
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+
+	authorizationCreateResp, _, err := client.PlaidApi.TransferAuthorizationCreate(ctx).TransferAuthorizationCreateRequest(
+		*plaid.NewTransferAuthorizationCreateRequest(
+			it.AccessToken,
+			req.AccountID,
+			plaid.TransferType(req.Type),
+			plaid.TransferNetwork(req.Network),
+			req.Amount,
+			plaid.ACHClass(req.AchClass),
+			req.User.plaidUser(),
+		),
+	).Execute()
+	if err != nil {
+		return nil, err
+	}
+	authorization := authorizationCreateResp.GetAuthorization()
+
+	now := time.Now().UTC()
+	t := storedTransfer{
+		AuthorizationID: authorization.GetId(),
+		IdempotencyKey:  key,
+		UserID:          it.UserID,
+		ItemID:          it.ItemID,
+		AccountID:       req.AccountID,
+		Type:            req.Type,
+		Network:         req.Network,
+		AchClass:        req.AchClass,
+		Amount:          req.Amount,
+		Description:     req.Description,
+		User:            req.User,
+		Decision:        authorization.GetDecision(),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if rationale, ok := authorization.GetDecisionRationaleOk(); ok && rationale != nil {
+		t.DecisionRationale = rationale.GetDescription()
+	}
+	if _, err := collection("transfers").InsertOne(ctx, t); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// createTransfer creates the transfer of an approved authorization. Calling
+// it again for the same authorization returns the existing transfer, and a
+// retry after a failure reuses the stored idempotency key.
+func createTransfer(ctx context.Context, it *storedItem, t *storedTransfer) error {
+	if t.TransferID != "" {
+		return nil
+	}
+	if t.Decision != "approved" {
+		return invalidf("authorization %s was %s", t.AuthorizationID, t.Decision)
+	}
+
+	transferCreateResp, _, err := client.PlaidApi.TransferCreate(ctx).TransferCreateRequest(
+		*plaid.NewTransferCreateRequest(
+			t.IdempotencyKey,
+			it.AccessToken,
+			t.AccountID,
+			t.AuthorizationID,
+			plaid.TransferType(t.Type),
+			plaid.TransferNetwork(t.Network),
+			t.Amount,
+			t.Description,
+			plaid.ACHClass(t.AchClass),
+			t.User.plaidUser(),
+		),
+	).Execute()
+	if err != nil {
+		return err
+	}
+	created := transferCreateResp.GetTransfer()
+
+	t.TransferID = created.GetId()
+	t.Status = string(created.GetStatus())
+	t.UpdatedAt = time.Now().UTC()
+	_, err = collection("transfers").UpdateOne(ctx,
+		bson.M{"_id": t.AuthorizationID},
+		bson.M{"$set": bson.M{
+			"transfer_id": t.TransferID,
+			"status":      t.Status,
+			"updated_at":  t.UpdatedAt,
+		}},
+	)
+	return err
+}
+
+func findTransfer(ctx context.Context, userID, transferID string) (*storedTransfer, error) {
+	var t storedTransfer
+	err := collection("transfers").FindOne(ctx, bson.M{"transfer_id": transferID, "user_id": userID}).Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// updateTransfer copies the status of a transfer fetched from Plaid into the
+// ledger.
+func updateTransfer(ctx context.Context, t *storedTransfer, latest *plaid.Transfer) error {
+	t.Status = string(latest.GetStatus())
+	t.FailureReason = ""
+	if failure, ok := latest.GetFailureReasonOk(); ok && failure != nil {
+		t.FailureReason = failure.GetDescription()
+	}
+	t.UpdatedAt = time.Now().UTC()
+
+	_, err := collection("transfers").UpdateOne(ctx,
+		bson.M{"_id": t.AuthorizationID},
+		bson.M{"$set": bson.M{
+			"status":         t.Status,
+			"failure_reason": t.FailureReason,
+			"updated_at":     t.UpdatedAt,
+		}},
+	)
+	return err
+}
+
+// ownedTransfer loads the caller's transfer named by the :id path parameter
+// and renders a 404 when it does not exist.
+func ownedTransfer(c *gin.Context) (*storedTransfer, bool) {
+	t, err := findTransfer(c.Request.Context(), currentPrincipal(c).Subject, c.Param("id"))
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "transfer not found"})
+		return nil, false
+	}
+	if err != nil {
+		renderError(c, err)
+		return nil, false
+	}
+	return t, true
+}
+
+// transferItem loads the caller's item named by itemID, or their most
+// recently linked item when itemID is empty, and renders a 404 when there is
+// none.
+func transferItem(c *gin.Context, itemID string) (*storedItem, bool) {
+	ctx := c.Request.Context()
+	userID := currentPrincipal(c).Subject
+
+	var it *storedItem
+	var err error
+	if itemID != "" {
+		it, err = findItem(ctx, userID, itemID)
+	} else {
+		it, err = latestItem(ctx, userID)
+	}
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": errNoItem.Error()})
+		return nil, false
+	}
+	if err != nil {
+		renderError(c, err)
+		return nil, false
+	}
+
+	c.Set(itemKey, it)
+	return it, true
+}
+
+func postTransferAuthorization(c *gin.Context) {
+	var req authorizeTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	it, ok := transferItem(c, req.ItemID)
+	if !ok {
+		return
+	}
+
+	t, err := authorizeTransfer(c.Request.Context(), it, &req)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"transfer": t})
+}
+
+// createTransferRequest either names an earlier authorization or carries the
+// details of a new transfer, which is then authorized and created in one go.
+type createTransferRequest struct {
+	AuthorizationID string `json:"authorization_id"`
+	authorizeTransferRequest
+}
+
+func postTransfer(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := currentPrincipal(c).Subject
+
+	var req createTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	itemID := req.ItemID
+	var t *storedTransfer
+	if req.AuthorizationID != "" {
+		t = &storedTransfer{}
+		err := collection("transfers").FindOne(ctx, bson.M{"_id": req.AuthorizationID, "user_id": userID}).Decode(t)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "authorization not found"})
+			return
+		}
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+		itemID = t.ItemID
+	}
+
+	it, ok := transferItem(c, itemID)
+	if !ok {
+		return
+	}
+
+	if t == nil {
+		var err error
+		t, err = authorizeTransfer(ctx, it, &req.authorizeTransferRequest)
+		if err != nil {
+			renderError(c, err)
+			return
+		}
+	}
+
+	if err := createTransfer(ctx, it, t); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"transfer": t})
+}
+
+func listTransfers(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	filter := bson.M{"user_id": currentPrincipal(c).Subject}
+	if id := c.Query("item_id"); id != "" {
+		filter["item_id"] = id
+	}
+	if status := c.Query("status"); status != "" {
+		filter["status"] = status
+	}
+
+	curr, err := collection("transfers").Find(ctx, filter,
+		options.Find().SetSort(bson.M{"created_at": -1}),
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	all := make([]storedTransfer, 0)
+	if err := curr.All(ctx, &all); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"transfers": all})
+}
+
+// getTransfer returns a transfer from the ledger after refreshing its status
+// from Plaid.
+func getTransfer(c *gin.Context) {
+	ctx := c.Request.Context()
+	t, ok := ownedTransfer(c)
+	if !ok {
+		return
+	}
+
+	transferGetResp, _, err := client.PlaidApi.TransferGet(ctx).TransferGetRequest(
+		*plaid.NewTransferGetRequest(t.TransferID),
+	).Execute()
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+	latest := transferGetResp.GetTransfer()
+	if err := updateTransfer(ctx, t, &latest); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"transfer": t})
+}
+
+func cancelTransfer(c *gin.Context) {
+	ctx := c.Request.Context()
+	t, ok := ownedTransfer(c)
+	if !ok {
+		return
+	}
+
+	_, _, err := client.PlaidApi.TransferCancel(ctx).TransferCancelRequest(
+		*plaid.NewTransferCancelRequest(t.TransferID),
+	).Execute()
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	t.Status = transferStatusCancelled
+	t.UpdatedAt = time.Now().UTC()
+	_, err = collection("transfers").UpdateOne(ctx,
+		bson.M{"_id": t.AuthorizationID},
+		bson.M{"$set": bson.M{"status": t.Status, "updated_at": t.UpdatedAt}},
+	)
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"transfer": t})
+}
+
+// transfer returns the caller's most recent transfer, as fetched from Plaid.
+func transfer(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var t storedTransfer
+	err := collection("transfers").FindOne(ctx,
+		bson.M{"user_id": currentPrincipal(c).Subject, "transfer_id": bson.M{"$exists": true}},
+		options.FindOne().SetSort(bson.M{"created_at": -1}),
+	).Decode(&t)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no transfers yet, create one with POST /api/transfers"})
+		return
+	}
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	transferGetResp, _, err := client.PlaidApi.TransferGet(ctx).TransferGetRequest(
+		*plaid.NewTransferGetRequest(t.TransferID),
+	).Execute()
+	if err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"transfer": transferGetResp.GetTransfer(),
+	})
+}
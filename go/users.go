@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// user is the owner of linked items. Its ID is the stable subject of the
+// authenticated principal and is sent to Plaid as the link token's
+// client_user_id.
+type user struct {
+	ID         string    `bson:"_id" json:"id"`
+	AuthMethod string    `bson:"auth_method" json:"auth_method"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+	LastSeenAt time.Time `bson:"last_seen_at" json:"last_seen_at"`
+}
+
+// ensureUser records the principal as a user, creating it on first use.
+func ensureUser(ctx context.Context, p *principal) error {
+	now := time.Now().UTC()
+	_, err := collection("users").UpdateOne(ctx,
+		bson.M{"_id": p.Subject},
+		bson.M{
+			"$set":         bson.M{"auth_method": p.Method, "last_seen_at": now},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
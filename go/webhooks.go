@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	plaid "github.com/plaid/plaid-go/plaid"
+)
+
+// WEBHOOK_VERIFICATION checks the Plaid-Verification signature of incoming
+// webhooks. It is on unless set to "false".
+var WEBHOOK_VERIFICATION = true
+
+// webhookMaxAge rejects signed webhooks older than this, as Plaid recommends.
+const webhookMaxAge = 5 * time.Minute
+
+// webhook holds the fields common to every Plaid webhook; Body is the raw
+// payload for handlers that need more.
+type webhook struct {
+	WebhookType string          `json:"webhook_type"`
+	WebhookCode string          `json:"webhook_code"`
+	ItemID      string          `json:"item_id"`
+	Error       *webhookError   `json:"error"`
+	Body        json.RawMessage `json:"-"`
+}
+
+type webhookError struct {
+	ErrorType    string `json:"error_type"`
+	ErrorCode    string `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+}
+
+type webhookHandler func(ctx context.Context, wh *webhook) error
+
+// webhookHandlers dispatches webhooks by webhook_type.
+var webhookHandlers = map[string]webhookHandler{}
+
+func registerWebhookHandler(webhookType string, h webhookHandler) {
+	webhookHandlers[webhookType] = h
+}
+
+func initWebhooks() {
+	WEBHOOK_VERIFICATION = strings.ToLower(os.Getenv("WEBHOOK_VERIFICATION")) != "false"
+	if !WEBHOOK_VERIFICATION {
+		log.Println("Warning: WEBHOOK_VERIFICATION is false, webhooks are not authenticated")
+	}
+}
+
+// receiveWebhook is the endpoint Plaid posts webhooks to.
+func receiveWebhook(c *gin.Context) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if WEBHOOK_VERIFICATION {
+		if err := verifyWebhook(c.Request.Context(), c.GetHeader("Plaid-Verification"), body); err != nil {
+			log.Println("Rejected webhook:", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid webhook signature"})
+			return
+		}
+	}
+
+	var wh webhook
+	if err := json.Unmarshal(body, &wh); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	wh.Body = body
+
+	log.Printf("Webhook %s %s for item %s\n", wh.WebhookType, wh.WebhookCode, wh.ItemID)
+
+	h, ok := webhookHandlers[wh.WebhookType]
+	if !ok {
+		c.Status(http.StatusOK)
+		return
+	}
+	if err := h(c.Request.Context(), &wh); err != nil {
+		renderError(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// webhookKeyFailureTTL is how long a failed verification key lookup is
+// remembered. The kid comes from the unverified JWT header, so without it
+// every forged webhook would cost a Plaid call.
+const webhookKeyFailureTTL = time.Minute
+
+// webhookKeyLookup is the lookup of one verification key, shared by every
+// webhook signed with its kid. done is closed once key or err is set.
+type webhookKeyLookup struct {
+	done      chan struct{}
+	key       *ecdsa.PublicKey
+	err       error
+	fetchedAt time.Time
+}
+
+// failedBefore tells whether the lookup is finished, failed and older than
+// webhookKeyFailureTTL at now.
+func (l *webhookKeyLookup) failedBefore(now time.Time) bool {
+	select {
+	case <-l.done:
+		return l.err != nil && now.Sub(l.fetchedAt) > webhookKeyFailureTTL
+	default:
+		return false
+	}
+}
+
+var webhookKeys = struct {
+	sync.Mutex
+	lookups map[string]*webhookKeyLookup
+}{lookups: map[string]*webhookKeyLookup{}}
+
+// verifyWebhook checks the ES256 JWT Plaid sends with each webhook: its
+// signature, its age and the hash of the body it covers.
+func verifyWebhook(ctx context.Context, signedJWT string, body []byte) error {
+	if signedJWT == "" {
+		return errors.New("missing Plaid-Verification header")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(signedJWT, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return webhookVerificationKey(ctx, kid)
+	}, jwt.WithValidMethods([]string{"ES256"}))
+	if err != nil {
+		return err
+	}
+
+	if iat, ok := claims["iat"].(float64); !ok || time.Since(time.Unix(int64(iat), 0)) > webhookMaxAge {
+		return errors.New("webhook is too old")
+	}
+
+	sum := sha256.Sum256(body)
+	if claims["request_body_sha256"] != hex.EncodeToString(sum[:]) {
+		return errors.New("body does not match signature")
+	}
+	return nil
+}
+
+// webhookVerificationKey returns the key with the given kid. Keys are
+// fetched from Plaid outside of the lock, once per kid, so that a slow or
+// failing lookup only holds up the webhooks signed with that kid.
+func webhookVerificationKey(ctx context.Context, kid string) (*ecdsa.PublicKey, error) {
+	now := time.Now()
+	webhookKeys.Lock()
+	l, ok := webhookKeys.lookups[kid]
+	if !ok || l.failedBefore(now) {
+		for k, old := range webhookKeys.lookups {
+			if old.failedBefore(now) {
+				delete(webhookKeys.lookups, k)
+			}
+		}
+		l = &webhookKeyLookup{done: make(chan struct{})}
+		webhookKeys.lookups[kid] = l
+		webhookKeys.Unlock()
+
+		l.key, l.err = fetchWebhookVerificationKey(ctx, kid)
+		l.fetchedAt = time.Now()
+		close(l.done)
+
+		// A lookup cut short by the request's context says nothing about
+		// the kid and is not remembered.
+		if l.err != nil && ctx.Err() != nil {
+			webhookKeys.Lock()
+			if webhookKeys.lookups[kid] == l {
+				delete(webhookKeys.lookups, kid)
+			}
+			webhookKeys.Unlock()
+		}
+		return l.key, l.err
+	}
+	webhookKeys.Unlock()
+
+	select {
+	case <-l.done:
+		return l.key, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func fetchWebhookVerificationKey(ctx context.Context, kid string) (*ecdsa.PublicKey, error) {
+	resp, _, err := client.PlaidApi.WebhookVerificationKeyGet(ctx).WebhookVerificationKeyGetRequest(
+		*plaid.NewWebhookVerificationKeyGetRequest(kid),
+	).Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	jwk := resp.GetKey()
+	if jwk.ExpiredAt.IsSet() && jwk.ExpiredAt.Get() != nil {
+		return nil, fmt.Errorf("webhook key %q has expired", kid)
+	}
+	key, err := jsonWebKey{Kid: jwk.Kid, Kty: jwk.Kty, Crv: jwk.Crv, X: jwk.X, Y: jwk.Y}.publicKey()
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("webhook key %q is not an EC key", kid)
+	}
+	return ecKey, nil
+}
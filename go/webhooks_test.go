@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWebhookKeyLookupFailedBefore(t *testing.T) {
+	now := time.Now()
+	finished := func(err error, age time.Duration) *webhookKeyLookup {
+		l := &webhookKeyLookup{done: make(chan struct{}), err: err, fetchedAt: now.Add(-age)}
+		close(l.done)
+		return l
+	}
+
+	tests := []struct {
+		name   string
+		lookup *webhookKeyLookup
+		want   bool
+	}{
+		{"in flight", &webhookKeyLookup{done: make(chan struct{})}, false},
+		{"found", finished(nil, time.Hour), false},
+		{"recent failure", finished(errors.New("not found"), time.Second), false},
+		{"old failure", finished(errors.New("not found"), 2*webhookKeyFailureTTL), true},
+	}
+	for _, tt := range tests {
+		if got := tt.lookup.failedBefore(now); got != tt.want {
+			t.Errorf("%s: failedBefore = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookVerificationKeyReusesLookups(t *testing.T) {
+	saved := webhookKeys.lookups
+	defer func() { webhookKeys.lookups = saved }()
+
+	notFound := errors.New("not found")
+	failed := &webhookKeyLookup{done: make(chan struct{}), err: notFound, fetchedAt: time.Now()}
+	close(failed.done)
+	inFlight := &webhookKeyLookup{done: make(chan struct{})}
+	webhookKeys.lookups = map[string]*webhookKeyLookup{"forged": failed, "slow": inFlight}
+
+	// A recent failure is returned without asking Plaid again.
+	if _, err := webhookVerificationKey(context.Background(), "forged"); err != notFound {
+		t.Errorf("forged kid: err = %v, want %v", err, notFound)
+	}
+
+	// A caller waiting on another's lookup gives up with its own context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := webhookVerificationKey(ctx, "slow"); err != context.DeadlineExceeded {
+		t.Errorf("slow kid: err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Once the lookup finishes its key is shared.
+	key := &ecdsa.PublicKey{}
+	inFlight.key, inFlight.fetchedAt = key, time.Now()
+	close(inFlight.done)
+	if got, err := webhookVerificationKey(context.Background(), "slow"); err != nil || got != key {
+		t.Errorf("slow kid: got %v, %v, want the fetched key", got, err)
+	}
+}